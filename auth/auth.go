@@ -4,9 +4,10 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/obaraelijah/echo-tools/hashing"
 	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/policy"
 	"github.com/obaraelijah/echo-tools/utilitymodels"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -14,31 +15,84 @@ var (
 	ErrAuthenticationFailed = errors.New("authentication failed")
 	ErrUsernameNotFound     = errors.New("username not found")
 	ErrHashError            = errors.New("hashing has failed")
+	ErrAccountLocked        = errors.New("account is temporarily locked")
 )
 
-// AuthenticateLocalUser tries to authenticate a local user with the given credentials
+// AuthenticateLocalUser tries to authenticate a local user with the given credentials.
+// If enabled with SetLockoutConfig, failed attempts are throttled per username. Returns ErrAccountLocked while the
+// username is locked.
 func AuthenticateLocalUser(db *gorm.DB, username string, password string) (*utilitymodels.LocalUser, error) {
+	return AuthenticateLocalUserFromIP(db, username, password, "")
+}
+
+// AuthenticateLocalUserFromIP works like AuthenticateLocalUser, but additionally throttles failed attempts
+// per client IP, e.g. echo.Context.RealIP(). An empty clientIP disables the throttling per IP.
+func AuthenticateLocalUserFromIP(db *gorm.DB, username string, password string, clientIP string) (*utilitymodels.LocalUser, error) {
+	config := getLockoutConfig()
+	if config == nil {
+		return authenticateLocalUser(db, username, password)
+	}
+
+	if err := checkLockout(db, username, clientIP); err != nil {
+		return nil, err
+	}
+
+	u, err := authenticateLocalUser(db, username, password)
+	if err != nil {
+		// Unknown usernames are tracked as well, else the lockout would reveal whether a user exists
+		if errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrUsernameNotFound) {
+			if lockErr := registerFailedLogin(db, config, username, clientIP); lockErr != nil {
+				return nil, lockErr
+			}
+		}
+		return nil, err
+	}
+
+	if err := resetFailedLogins(db, username); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func authenticateLocalUser(db *gorm.DB, username string, password string) (*utilitymodels.LocalUser, error) {
 	var u utilitymodels.LocalUser
 	var count int64
 
 	db.Find(&u, "username = ?", username).Count(&count)
 	if count == 0 {
 		// Comparing static hash in order to deny username enumeration by looking at the time a request took
-		bcrypt.CompareHashAndPassword(
-			[]byte("$2b$12$KisigGoquLISbypB3kHB1eUOXZUWm7AwOZcwIIH9V9YejhxvIvlo6"),
-			[]byte("Deny username enumeration"),
-		)
+		hashing.DummyVerify(password)
 		return nil, ErrUsernameNotFound
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+	ok, needsRehash, err := hashing.Verify(u.Password, password)
+	if err != nil || !ok {
 		return nil, ErrAuthenticationFailed
 	}
 
+	// The hash uses an outdated algorithm or parameters. The plaintext password is only available now.
+	// Failing to update is not fatal, it will be tried again on the next login.
+	if needsRehash {
+		if hash, err := hashing.Hash(password); err == nil {
+			if err := db.Model(&u).Update("password", hash).Error; err == nil {
+				u.Password = hash
+			}
+		}
+	}
+
 	return &u, nil
 }
 
+// SetNewPasswordForLocalUser sets a new password and invalidates all sessions of the user.
+// The password has to fulfill the default policy of the policy package, else a *policy.ViolationError is returned.
 func SetNewPasswordForLocalUser(db *gorm.DB, userID uint, newPassword string) error {
+	return setNewPassword(db, userID, newPassword, nil)
+}
+
+// setNewPassword implements SetNewPasswordForLocalUser. beforeSave is called in the transaction saving the password,
+// if it returns an error, the password isn't changed and its error is returned.
+func setNewPassword(db *gorm.DB, userID uint, newPassword string, beforeSave func(tx *gorm.DB) error) error {
 	var u utilitymodels.LocalUser
 	var count int64
 
@@ -50,19 +104,47 @@ func SetNewPasswordForLocalUser(db *gorm.DB, userID uint, newPassword string) er
 		return ErrUsernameNotFound
 	}
 
-	if hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12); err != nil {
-		return ErrHashError
-	} else {
-		u.Password = string(hash)
+	passwordPolicy := policy.GetDefaultPolicy()
+	if passwordPolicy != nil {
+		if err := passwordPolicy.Check(newPassword, u.Username, u.Email); err != nil {
+			return err
+		}
+		if err := passwordPolicy.CheckHistory(db, &u, newPassword); err != nil {
+			if errors.Is(err, policy.ErrPasswordPolicyViolation) {
+				return err
+			}
+			return middleware.ErrDatabaseError
+		}
 	}
 
-	if err := middleware.InvalidateSessions(db, userID, "local"); err != nil {
-		return err
+	oldHash := u.Password
+	if hash, err := hashing.Hash(newPassword); err != nil {
+		return ErrHashError
+	} else {
+		u.Password = hash
 	}
 
-	if err := db.Save(&u).Error; err != nil {
+	var beforeSaveErr error
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if beforeSave != nil {
+			if beforeSaveErr = beforeSave(tx); beforeSaveErr != nil {
+				return beforeSaveErr
+			}
+		}
+		if passwordPolicy != nil {
+			if err := passwordPolicy.RecordHistory(tx, u.ID, oldHash); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&u).Error
+	}); err != nil {
+		if beforeSaveErr != nil {
+			return beforeSaveErr
+		}
 		fmt.Println("unable to update user")
 		return middleware.ErrDatabaseError
 	}
-	return nil
+
+	// Only invalidate the sessions once the new password is stored, a failed update must not log the user out
+	return middleware.InvalidateSessions(db, userID, utilitymodels.LocalAuthKey)
 }
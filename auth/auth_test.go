@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/obaraelijah/echo-tools/hashing"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticateLocalUserRehash(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+
+	legacy, err := hashing.NewBcryptHasher(bcrypt.MinCost).Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := utilitymodels.LocalUser{Username: "alice", Password: legacy}
+	if err := db.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hashing.SetDefaultHasher(hashing.NewArgon2idHasher(&hashing.Argon2Config{Memory: 1024, Iterations: 1, Parallelism: 1}))
+	t.Cleanup(func() {
+		hashing.SetDefaultHasher(hashing.NewBcryptHasher(12))
+	})
+
+	// A failed login doesn't touch the hash
+	if _, err := AuthenticateLocalUser(db, "alice", "wrong password"); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+	}
+	var stored utilitymodels.LocalUser
+	db.First(&stored, u.ID)
+	if stored.Password != legacy {
+		t.Fatal("expected the hash to be unchanged")
+	}
+
+	authenticated, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.First(&stored, u.ID)
+	if !strings.HasPrefix(stored.Password, "$argon2id$") || authenticated.Password != stored.Password {
+		t.Fatalf("expected the password to be rehashed with the default hasher, got %s", stored.Password)
+	}
+	if ok, needsRehash, err := hashing.Verify(stored.Password, "correct horse battery staple"); err != nil || !ok || needsRehash {
+		t.Fatalf("expected the new hash to match without rehash, got %t, %t, %v", ok, needsRehash, err)
+	}
+
+	// The rehashed password keeps working
+	if _, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrLDAPProviderNotFound = errors.New("ldap provider not found")
+	ErrLDAPConnectionFailed = errors.New("connection to ldap server failed")
+	ErrLDAPBindFailed       = errors.New("bind with the configured ldap credentials failed")
+	ErrLDAPSearchFailed     = errors.New("ldap search failed")
+	ErrLDAPAmbiguousUser    = errors.New("ldap search returned more than one user")
+)
+
+const (
+	// defaultLDAPSearchFilter is used if the LDAPProvider has no SearchFilter set
+	defaultLDAPSearchFilter = "(uid=%s)"
+	// ldapTimeout limits dialing and every request, so an unreachable directory doesn't block the login
+	ldapTimeout = 10 * time.Second
+)
+
+// AuthenticateLDAPUser tries to authenticate a user against the LDAP server of the given provider.
+// The configured BindUser is used to search for the user with SearchFilter below SearchBase. Every occurrence of %s
+// in SearchFilter is replaced by the escaped username. If no SearchFilter is set, "(uid=%s)" is used.
+// The password is verified by binding as the DN of the found entry. Dialing and every request time out after
+// 10 seconds.
+// On success, the matching LDAPUser is created or updated, so it can be passed to middleware.Login.
+// Its DisplayName and Email are taken from the displayName and mail attributes of the entry.
+func AuthenticateLDAPUser(db *gorm.DB, providerID uint, username string, password string) (*utilitymodels.LDAPUser, error) {
+	var provider utilitymodels.LDAPProvider
+	var count int64
+
+	if err := db.Find(&provider, providerID).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if count != 1 {
+		return nil, ErrLDAPProviderNotFound
+	}
+
+	// Most LDAP servers treat a bind with an empty password as an anonymous bind, which would succeed
+	if password == "" {
+		return nil, ErrAuthenticationFailed
+	}
+
+	conn, err := ldap.DialURL(provider.Uri, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, ErrLDAPConnectionFailed
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if provider.BindUser != nil {
+		bindPassword := ""
+		if provider.BindPassword != nil {
+			bindPassword = *provider.BindPassword
+		}
+		if err := conn.Bind(*provider.BindUser, bindPassword); err != nil {
+			return nil, ErrLDAPBindFailed
+		}
+	}
+
+	filter := defaultLDAPSearchFilter
+	if provider.SearchFilter != nil && *provider.SearchFilter != "" {
+		filter = *provider.SearchFilter
+	}
+	filter = strings.ReplaceAll(filter, "%s", ldap.EscapeFilter(username))
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		provider.SearchBase,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // One more than needed to detect ambiguous filters
+		0,
+		false,
+		filter,
+		[]string{"dn", "displayName", "mail"},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, ErrLDAPAmbiguousUser
+		}
+		return nil, ErrLDAPSearchFailed
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUsernameNotFound
+	case 1:
+	default:
+		return nil, ErrLDAPAmbiguousUser
+	}
+	entry := result.Entries[0]
+	dn := entry.DN
+
+	// Verify the password of the user
+	if err := conn.Bind(dn, password); err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	// Create or update the local representation of the user. It is identified by the DN, as the directory may match
+	// differently typed usernames, e.g. "Alice" and "alice", to the same entry.
+	var u utilitymodels.LDAPUser
+	if err := db.Find(&u, "ldap_provider_id = ? AND dn = ?", provider.ID, dn).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+
+	u.DN = dn
+	u.DisplayName = entry.GetAttributeValue("displayName")
+	u.Email = entry.GetAttributeValue("mail")
+	if count == 0 {
+		u.LDAPProviderID = provider.ID
+		u.Username = username
+		if err := db.Create(&u).Error; err != nil {
+			return nil, middleware.ErrDatabaseError
+		}
+	} else {
+		if err := db.Model(&u).Updates(map[string]any{
+			"dn":           dn,
+			"display_name": u.DisplayName,
+			"email":        u.Email,
+		}).Error; err != nil {
+			return nil, middleware.ErrDatabaseError
+		}
+	}
+	u.LDAPProvider = provider
+
+	return &u, nil
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+const (
+	testLDAPBindDN       = "cn=admin,dc=example,dc=org"
+	testLDAPBindPassword = "admin"
+	testLDAPAliceDN      = "uid=alice,ou=people,dc=example,dc=org"
+)
+
+type testLDAPEntry struct {
+	dn         string
+	attributes map[string]string
+}
+
+// testLDAPServer is an in-process stand-in for a directory. It answers simple binds against passwords and searches
+// with the entries registered for the exact filter string.
+type testLDAPServer struct {
+	listener  net.Listener
+	lock      sync.Mutex
+	passwords map[string]string
+	results   map[string][]testLDAPEntry
+	filters   []string
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testLDAPServer{
+		listener:  listener,
+		passwords: map[string]string{testLDAPBindDN: testLDAPBindPassword},
+		results:   map[string][]testLDAPEntry{},
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *testLDAPServer) uri() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+func (server *testLDAPServer) receivedFilters() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string(nil), server.filters...)
+}
+
+func (server *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+
+			server.lock.Lock()
+			expected, exists := server.passwords[dn]
+			server.lock.Unlock()
+
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if exists && password != "" && password == expected {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(testLDAPMessage(messageID, ldap.ApplicationBindResponse, testLDAPResult(code)...))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+
+			server.lock.Lock()
+			server.filters = append(server.filters, filter)
+			entries := server.results[filter]
+			server.lock.Unlock()
+
+			for _, entry := range entries {
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, value := range entry.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+				conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultEntry,
+					ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""),
+					attributes,
+				))
+			}
+			conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultDone, testLDAPResult(ldap.LDAPResultSuccess)...))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func testLDAPMessage(messageID int64, tag ber.Tag, children ...*ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	for _, child := range children {
+		op.AppendChild(child)
+	}
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func testLDAPResult(code uint16) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+	}
+}
+
+func TestAuthenticateLDAPUser(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.passwords[testLDAPAliceDN] = "secret"
+	server.results["(uid=alice)"] = []testLDAPEntry{{
+		dn:         testLDAPAliceDN,
+		attributes: map[string]string{"displayName": "Alice", "mail": "alice@example.org"},
+	}}
+
+	db := testutil.OpenTestDB(t)
+	bindUser, bindPassword := testLDAPBindDN, testLDAPBindPassword
+	provider := utilitymodels.LDAPProvider{
+		Name:         "test",
+		Uri:          server.uri(),
+		BindUser:     &bindUser,
+		BindPassword: &bindPassword,
+		SearchBase:   "ou=people,dc=example,dc=org",
+	}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := AuthenticateLDAPUser(db, provider.ID, "alice", "secret")
+	if err != nil {
+		t.Fatalf("expected successful login, got %v", err)
+	}
+	if u.ID == 0 || u.DN != testLDAPAliceDN || u.DisplayName != "Alice" || u.Email != "alice@example.org" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	// A second login updates the existing user with the current attributes of the entry
+	server.lock.Lock()
+	server.results["(uid=alice)"][0].attributes["mail"] = "alice@example.com"
+	server.lock.Unlock()
+
+	updated, err := AuthenticateLDAPUser(db, provider.ID, "alice", "secret")
+	if err != nil {
+		t.Fatalf("expected successful login, got %v", err)
+	}
+	if updated.ID != u.ID || updated.Email != "alice@example.com" {
+		t.Fatalf("expected user %d to be updated, got %+v", u.ID, updated)
+	}
+
+	// The directory matches the username case-insensitively, the login is mapped to the same user by its DN
+	server.lock.Lock()
+	server.results["(uid=ALICE)"] = server.results["(uid=alice)"]
+	server.lock.Unlock()
+
+	uppercase, err := AuthenticateLDAPUser(db, provider.ID, "ALICE", "secret")
+	if err != nil {
+		t.Fatalf("expected successful login, got %v", err)
+	}
+	if uppercase.ID != u.ID || uppercase.Username != "alice" {
+		t.Fatalf("expected user %d, got %+v", u.ID, uppercase)
+	}
+
+	var users []utilitymodels.LDAPUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != "alice@example.com" {
+		t.Fatalf("expected one updated user, got %+v", users)
+	}
+}
+
+func TestAuthenticateLDAPUserFailures(t *testing.T) {
+	server := newTestLDAPServer(t)
+	server.passwords[testLDAPAliceDN] = "secret"
+	server.results["(uid=alice)"] = []testLDAPEntry{{dn: testLDAPAliceDN}}
+	server.results["(uid=bob)"] = []testLDAPEntry{
+		{dn: "uid=bob,ou=people,dc=example,dc=org"},
+		{dn: "uid=bob,ou=admins,dc=example,dc=org"},
+	}
+
+	db := testutil.OpenTestDB(t)
+	bindUser, bindPassword := testLDAPBindDN, testLDAPBindPassword
+	provider := utilitymodels.LDAPProvider{
+		Uri:          server.uri(),
+		BindUser:     &bindUser,
+		BindPassword: &bindPassword,
+		SearchBase:   "ou=people,dc=example,dc=org",
+	}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		providerID uint
+		username   string
+		password   string
+		expected   error
+	}{
+		{"wrong password", provider.ID, "alice", "wrong", ErrAuthenticationFailed},
+		{"empty password", provider.ID, "alice", "", ErrAuthenticationFailed},
+		{"unknown user", provider.ID, "carol", "secret", ErrUsernameNotFound},
+		{"ambiguous user", provider.ID, "bob", "secret", ErrLDAPAmbiguousUser},
+		{"unknown provider", provider.ID + 1, "alice", "secret", ErrLDAPProviderNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := AuthenticateLDAPUser(db, test.providerID, test.username, test.password); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&utilitymodels.LDAPUser{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no user to be created, got %d", count)
+	}
+
+	// A wrong password of the bind user is reported separately
+	wrong := "wrong"
+	db.Model(&provider).Update("bind_password", wrong)
+	if _, err := AuthenticateLDAPUser(db, provider.ID, "alice", "secret"); !errors.Is(err, ErrLDAPBindFailed) {
+		t.Fatalf("expected %v, got %v", ErrLDAPBindFailed, err)
+	}
+}
+
+func TestAuthenticateLDAPUserEscapesFilter(t *testing.T) {
+	server := newTestLDAPServer(t)
+
+	db := testutil.OpenTestDB(t)
+	filter := "(&(objectClass=person)(uid=%s))"
+	provider := utilitymodels.LDAPProvider{
+		Uri:          server.uri(),
+		SearchBase:   "ou=people,dc=example,dc=org",
+		SearchFilter: &filter,
+	}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AuthenticateLDAPUser(db, provider.ID, "*)(uid=*", "secret"); !errors.Is(err, ErrUsernameNotFound) {
+		t.Fatalf("expected %v, got %v", ErrUsernameNotFound, err)
+	}
+
+	filters := server.receivedFilters()
+	expected := `(&(objectClass=person)(uid=\2a\29\28uid=\2a))`
+	if len(filters) != 1 || filters[0] != expected {
+		t.Fatalf("expected filter %s, got %v", expected, filters)
+	}
+}
+
+func TestAuthenticateLDAPUserUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := "ldap://" + listener.Addr().String()
+	listener.Close()
+
+	db := testutil.OpenTestDB(t)
+	provider := utilitymodels.LDAPProvider{Uri: uri}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AuthenticateLDAPUser(db, provider.ID, "alice", "secret"); !errors.Is(err, ErrLDAPConnectionFailed) {
+		t.Fatalf("expected %v, got %v", ErrLDAPConnectionFailed, err)
+	}
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LockoutConfig Set the parameters of the brute-force protection of AuthenticateLocalUser.
+// Parameter MaxAttempts defaults to 5. Number of failed attempts per username until it is locked. Wrong second factor
+// codes are counted separately per user with the same limit, see VerifyLocalUserTOTP.
+// Parameter MaxAttemptsPerIP defaults to 50. Number of failed attempts per client IP until it is locked.
+// Parameter LockoutDuration defaults to 15 * time.Minute.
+// Parameter ResetAfter defaults to LockoutDuration. Failed attempts older than this are forgotten.
+// Parameter BaseDelay defaults to 250 * time.Millisecond. A failed attempt is answered after BaseDelay, doubled for
+// every previous failure of the username.
+// Parameter MaxDelay defaults to 4 * time.Second. Upper limit of the delay.
+type LockoutConfig struct {
+	MaxAttempts      int
+	MaxAttemptsPerIP int
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+}
+
+func (config *LockoutConfig) FixLockoutConfig() {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.MaxAttemptsPerIP <= 0 {
+		config.MaxAttemptsPerIP = 50
+	}
+	if config.LockoutDuration <= 0 {
+		config.LockoutDuration = 15 * time.Minute
+	}
+	if config.ResetAfter <= 0 {
+		config.ResetAfter = config.LockoutDuration
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 250 * time.Millisecond
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = 4 * time.Second
+	}
+}
+
+var (
+	lockoutLock   sync.RWMutex
+	lockoutConfig *LockoutConfig
+)
+
+// SetLockoutConfig enables the brute-force protection of AuthenticateLocalUser, it is disabled by default.
+// Unset parameters are replaced by their defaults. Pass nil to disable the protection again.
+// The state is stored in utilitymodels.LoginAttempt, so it's shared between all instances using the same database.
+func SetLockoutConfig(config *LockoutConfig) {
+	if config != nil {
+		config.FixLockoutConfig()
+	}
+
+	lockoutLock.Lock()
+	defer lockoutLock.Unlock()
+	lockoutConfig = config
+}
+
+func getLockoutConfig() *LockoutConfig {
+	lockoutLock.RLock()
+	defer lockoutLock.RUnlock()
+	return lockoutConfig
+}
+
+// UnlockLocalUser removes the lockout and all failed attempts of a username, including failed second factor codes
+func UnlockLocalUser(db *gorm.DB, username string) error {
+	var u utilitymodels.LocalUser
+	var count int64
+	if err := db.Find(&u, "username = ?", username).Count(&count).Error; err != nil {
+		return middleware.ErrDatabaseError
+	}
+	if count == 1 {
+		if err := resetFailures(db, secondFactorIdentifier(u.ID)); err != nil {
+			return err
+		}
+	}
+	return resetFailedLogins(db, username)
+}
+
+func usernameIdentifier(username string) string {
+	return "username:" + username
+}
+
+func ipIdentifier(clientIP string) string {
+	return "ip:" + clientIP
+}
+
+func secondFactorIdentifier(userID uint) string {
+	return fmt.Sprintf("totp:%d", userID)
+}
+
+// checkLockout returns ErrAccountLocked if either the username or the client IP is locked
+func checkLockout(db *gorm.DB, username string, clientIP string) error {
+	identifiers := []string{usernameIdentifier(username)}
+	if clientIP != "" {
+		identifiers = append(identifiers, ipIdentifier(clientIP))
+	}
+	return checkLockedIdentifiers(db, identifiers...)
+}
+
+// checkLockedIdentifiers returns ErrAccountLocked if any of the identifiers is locked
+func checkLockedIdentifiers(db *gorm.DB, identifiers ...string) error {
+	var count int64
+	if err := db.Model(&utilitymodels.LoginAttempt{}).
+		Where("identifier IN ? AND locked_until > ?", identifiers, time.Now().UTC()).
+		Count(&count).Error; err != nil {
+		return middleware.ErrDatabaseError
+	}
+
+	if count > 0 {
+		return ErrAccountLocked
+	}
+	return nil
+}
+
+// registerFailedLogin counts the failed attempt for the username and client IP, locks them if their limit is
+// reached and delays the response progressively
+func registerFailedLogin(db *gorm.DB, config *LockoutConfig, username string, clientIP string) error {
+	failures, err := incrementFailures(db, config, usernameIdentifier(username), config.MaxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if clientIP != "" {
+		if _, err := incrementFailures(db, config, ipIdentifier(clientIP), config.MaxAttemptsPerIP); err != nil {
+			return err
+		}
+	}
+
+	time.Sleep(failureDelay(config, failures))
+	return nil
+}
+
+// registerFailedSecondFactor counts a wrong second factor code of the user, locks the second factor if the limit
+// is reached and delays the response progressively
+func registerFailedSecondFactor(db *gorm.DB, config *LockoutConfig, userID uint) error {
+	failures, err := incrementFailures(db, config, secondFactorIdentifier(userID), config.MaxAttempts)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(failureDelay(config, failures))
+	return nil
+}
+
+// failureDelay returns BaseDelay doubled for every previous failure, limited to MaxDelay
+func failureDelay(config *LockoutConfig, failures int) time.Duration {
+	delay := config.BaseDelay
+	for i := 1; i < failures && delay < config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxDelay {
+		delay = config.MaxDelay
+	}
+	return delay
+}
+
+// incrementFailures increments the failures of the identifier with the row locked, so concurrent attempts
+// of several instances are counted correctly. Returns the number of failures before the lockout.
+func incrementFailures(db *gorm.DB, config *LockoutConfig, identifier string, maxAttempts int) (int, error) {
+	var failures int
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&utilitymodels.LoginAttempt{
+			Identifier:  identifier,
+			LastFailure: now,
+		}).Error; err != nil {
+			return err
+		}
+
+		var attempt utilitymodels.LoginAttempt
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			First(&attempt, "identifier = ?", identifier).Error; err != nil {
+			return err
+		}
+
+		if now.Sub(attempt.LastFailure) > config.ResetAfter {
+			attempt.Failures = 0
+		}
+		attempt.Failures++
+		attempt.LastFailure = now
+		failures = attempt.Failures
+
+		if attempt.Failures >= maxAttempts {
+			attempt.Failures = 0
+			attempt.LockedUntil = sql.NullTime{Time: now.Add(config.LockoutDuration), Valid: true}
+		}
+
+		return tx.Save(&attempt).Error
+	})
+	if err != nil {
+		return 0, middleware.ErrDatabaseError
+	}
+
+	return failures, nil
+}
+
+func resetFailedLogins(db *gorm.DB, username string) error {
+	return resetFailures(db, usernameIdentifier(username))
+}
+
+func resetFailures(db *gorm.DB, identifier string) error {
+	if err := db.Where("identifier = ?", identifier).Delete(&utilitymodels.LoginAttempt{}).Error; err != nil {
+		return middleware.ErrDatabaseError
+	}
+	return nil
+}
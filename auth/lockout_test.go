@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func setTestLockoutConfig(t *testing.T, config *LockoutConfig) {
+	t.Helper()
+	SetLockoutConfig(config)
+	t.Cleanup(func() {
+		SetLockoutConfig(nil)
+	})
+}
+
+func TestLockoutDisabledByDefault(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	createTestLocalUser(t, db, "alice")
+
+	for i := 0; i < 10; i++ {
+		if _, err := AuthenticateLocalUserFromIP(db, "alice", "wrong password", "192.0.2.1"); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+		}
+	}
+	if _, err := AuthenticateLocalUserFromIP(db, "alice", "correct horse battery staple", "192.0.2.1"); err != nil {
+		t.Fatalf("expected the login to succeed, got %v", err)
+	}
+
+	var count int64
+	db.Model(&utilitymodels.LoginAttempt{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no failed attempts to be stored, got %d", count)
+	}
+}
+
+func TestAuthenticateLocalUserLockout(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	createTestLocalUser(t, db, "alice")
+	setTestLockoutConfig(t, &LockoutConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	// A successful login resets the failed attempts
+	for i := 0; i < 2; i++ {
+		if _, err := AuthenticateLocalUser(db, "alice", "wrong password"); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+		}
+	}
+	if _, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := AuthenticateLocalUser(db, "alice", "wrong password"); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+		}
+	}
+
+	// Even the correct password is refused while the username is locked
+	if _, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+
+	if err := UnlockLocalUser(db, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple"); err != nil {
+		t.Fatalf("expected the login to succeed after unlocking, got %v", err)
+	}
+}
+
+func TestAuthenticateLocalUserLockoutUnknownUsername(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	setTestLockoutConfig(t, &LockoutConfig{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	// Unknown usernames are locked like existing ones, so the lockout doesn't reveal whether a user exists
+	for i := 0; i < 2; i++ {
+		if _, err := AuthenticateLocalUser(db, "bob", "wrong password"); !errors.Is(err, ErrUsernameNotFound) {
+			t.Fatalf("expected %v, got %v", ErrUsernameNotFound, err)
+		}
+	}
+	if _, err := AuthenticateLocalUser(db, "bob", "wrong password"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+}
+
+func TestAuthenticateLocalUserFromIPThrottling(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	createTestLocalUser(t, db, "alice")
+	setTestLockoutConfig(t, &LockoutConfig{
+		MaxAttempts:      10,
+		MaxAttemptsPerIP: 3,
+		BaseDelay:        time.Millisecond,
+		MaxDelay:         time.Millisecond,
+	})
+
+	// Guessing different usernames from the same IP locks the IP, but not the usernames
+	for _, username := range []string{"bob", "carol", "dave"} {
+		if _, err := AuthenticateLocalUserFromIP(db, username, "wrong password", "192.0.2.1"); !errors.Is(err, ErrUsernameNotFound) {
+			t.Fatalf("expected %v, got %v", ErrUsernameNotFound, err)
+		}
+	}
+
+	if _, err := AuthenticateLocalUserFromIP(db, "alice", "correct horse battery staple", "192.0.2.1"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+	if _, err := AuthenticateLocalUserFromIP(db, "alice", "correct horse battery staple", "192.0.2.2"); err != nil {
+		t.Fatalf("expected the login from another IP to succeed, got %v", err)
+	}
+	if _, err := AuthenticateLocalUser(db, "alice", "correct horse battery staple"); err != nil {
+		t.Fatalf("expected the login without IP to succeed, got %v", err)
+	}
+}
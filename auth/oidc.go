@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrOIDCProviderNotFound    = errors.New("oidc provider not found")
+	ErrOIDCDiscoveryFailed     = errors.New("oidc discovery failed")
+	ErrOIDCInvalidState        = errors.New("oidc state is missing or invalid")
+	ErrOIDCAuthorizationDenied = errors.New("oidc authorization was denied")
+	ErrOIDCCodeExchangeFailed  = errors.New("oidc code exchange failed")
+	ErrOIDCInvalidIDToken      = errors.New("oidc id token is invalid")
+	ErrOIDCMissingSubject      = errors.New("oidc id token has no subject")
+)
+
+const (
+	oidcStateCookie  = "oidc_state"
+	oidcRequestAge   = 10 * time.Minute
+	oidcDiscoveryAge = 24 * time.Hour
+)
+
+// cachedOIDCProvider is the result of a discovery, the keys of the issuer are refreshed by the provider itself
+type cachedOIDCProvider struct {
+	provider     *oidc.Provider
+	discoveredAt time.Time
+}
+
+var (
+	oidcProviderCache     = make(map[string]cachedOIDCProvider)
+	oidcProviderCacheLock sync.Mutex
+)
+
+// oidcClaims are the claims of the ID token which are used for the OIDCUser
+type oidcClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// BeginOIDCLogin starts the authorization code flow with the given provider and returns the URL of the authorization
+// endpoint, the user has to be redirected to. State, nonce and PKCE verifier are stored in the database, the state is
+// additionally bound to the browser with a short-lived cookie.
+func BeginOIDCLogin(db *gorm.DB, c echo.Context, providerID uint) (string, error) {
+	provider, err := getOIDCProvider(db, providerID)
+	if err != nil {
+		return "", err
+	}
+
+	_, config, err := discoverOIDCProvider(c, provider)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := generateOIDCToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateOIDCToken()
+	if err != nil {
+		return "", err
+	}
+
+	request := utilitymodels.OIDCAuthRequest{
+		OIDCProviderID: provider.ID,
+		State:          state,
+		Nonce:          nonce,
+		CodeVerifier:   oauth2.GenerateVerifier(),
+		ValidUntil:     time.Now().UTC().Add(oidcRequestAge),
+	}
+	if err := db.Create(&request).Error; err != nil {
+		c.Logger().Errorf("Error saving oidc auth request: %s", err.Error())
+		return "", middleware.ErrDatabaseError
+	}
+
+	// SameSite=Lax is required, as the callback is a top-level cross-site navigation
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcRequestAge.Seconds()),
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return config.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(request.CodeVerifier),
+	), nil
+}
+
+// FinishOIDCLogin handles the callback of the provider. The code is exchanged for an ID token, which is validated
+// against the keys of the provider. The OIDCUser matching the subject is created or updated, so it can be passed to
+// middleware.Login.
+func FinishOIDCLogin(db *gorm.DB, c echo.Context) (*utilitymodels.OIDCUser, error) {
+	state := c.QueryParam("state")
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, ErrOIDCInvalidState
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:   oidcStateCookie,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+		Secure: c.Scheme() == "https",
+	})
+
+	// Requests of abandoned logins are never used, they are deleted here
+	now := time.Now().UTC()
+	if err := db.Where("valid_until <= ?", now).Delete(&utilitymodels.OIDCAuthRequest{}).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+
+	var request utilitymodels.OIDCAuthRequest
+	var count int64
+	if err := db.Find(&request, "state = ? AND valid_until > ?", state, now).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if count != 1 {
+		return nil, ErrOIDCInvalidState
+	}
+
+	// Every state can only be used once
+	res := db.Delete(&request)
+	if res.Error != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return nil, ErrOIDCInvalidState
+	}
+
+	if errorCode := c.QueryParam("error"); errorCode != "" {
+		c.Logger().Debugf("OIDC provider returned error %s: %s", errorCode, c.QueryParam("error_description"))
+		return nil, ErrOIDCAuthorizationDenied
+	}
+
+	provider, err := getOIDCProvider(db, request.OIDCProviderID)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProvider, config, err := discoverOIDCProvider(c, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(c.Request().Context(), c.QueryParam("code"), oauth2.VerifierOption(request.CodeVerifier))
+	if err != nil {
+		c.Logger().Debugf("OIDC code exchange failed: %s", err.Error())
+		return nil, ErrOIDCCodeExchangeFailed
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	idToken, err := oidcProvider.Verifier(&oidc.Config{ClientID: provider.ClientID}).Verify(c.Request().Context(), rawIDToken)
+	if err != nil {
+		c.Logger().Debugf("OIDC id token verification failed: %s", err.Error())
+		return nil, ErrOIDCInvalidIDToken
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, ErrOIDCInvalidIDToken
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(request.Nonce)) != 1 {
+		return nil, ErrOIDCInvalidIDToken
+	}
+	if idToken.Subject == "" {
+		return nil, ErrOIDCMissingSubject
+	}
+
+	// Create or update the local representation of the user. The struct condition leaves the column names to the
+	// naming strategy, which splits the OIDC prefix.
+	var u utilitymodels.OIDCUser
+	if err := db.Where(&utilitymodels.OIDCUser{OIDCProviderID: provider.ID, Subject: idToken.Subject}).Find(&u).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+
+	u.Username = claims.PreferredUsername
+	if u.Username == "" {
+		u.Username = idToken.Subject
+	}
+	u.Email = nil
+	if claims.Email != "" {
+		u.Email = &claims.Email
+	}
+
+	if count == 0 {
+		u.OIDCProviderID = provider.ID
+		u.Subject = idToken.Subject
+		if err := db.Omit("OIDCProvider").Create(&u).Error; err != nil {
+			return nil, middleware.ErrDatabaseError
+		}
+	} else {
+		if err := db.Model(&u).Updates(map[string]any{
+			"username": u.Username,
+			"email":    u.Email,
+		}).Error; err != nil {
+			return nil, middleware.ErrDatabaseError
+		}
+	}
+	u.OIDCProvider = *provider
+
+	return &u, nil
+}
+
+func getOIDCProvider(db *gorm.DB, providerID uint) (*utilitymodels.OIDCProvider, error) {
+	var provider utilitymodels.OIDCProvider
+	var count int64
+
+	if err := db.Find(&provider, providerID).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if count != 1 {
+		return nil, ErrOIDCProviderNotFound
+	}
+
+	return &provider, nil
+}
+
+// discoverOIDCProvider retrieves the discovery document of the issuer and builds the oauth2 config.
+// The discovery is cached per issuer for 24 hours, failed discoveries are not cached.
+func discoverOIDCProvider(c echo.Context, provider *utilitymodels.OIDCProvider) (*oidc.Provider, *oauth2.Config, error) {
+	oidcProvider, err := getDiscoveredOIDCProvider(c, provider.Issuer)
+	if err != nil {
+		c.Logger().Errorf("OIDC discovery of %s failed: %s", provider.Issuer, err.Error())
+		return nil, nil, ErrOIDCDiscoveryFailed
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	if provider.Scopes != nil {
+		for _, scope := range strings.Fields(*provider.Scopes) {
+			if scope != oidc.ScopeOpenID {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return oidcProvider, &oauth2.Config{
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  provider.RedirectURL,
+		Endpoint:     oidcProvider.Endpoint(),
+		Scopes:       scopes,
+	}, nil
+}
+
+func getDiscoveredOIDCProvider(c echo.Context, issuer string) (*oidc.Provider, error) {
+	oidcProviderCacheLock.Lock()
+	cached, ok := oidcProviderCache[issuer]
+	oidcProviderCacheLock.Unlock()
+	if ok && time.Since(cached.discoveredAt) < oidcDiscoveryAge {
+		return cached.provider, nil
+	}
+
+	oidcProvider, err := oidc.NewProvider(c.Request().Context(), issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProviderCacheLock.Lock()
+	oidcProviderCache[issuer] = cachedOIDCProvider{provider: oidcProvider, discoveredAt: time.Now()}
+	oidcProviderCacheLock.Unlock()
+
+	return oidcProvider, nil
+}
+
+func generateOIDCToken() (string, error) {
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return "", ErrRandomFailed
+	}
+	return fmt.Sprintf("%x", r), nil
+}
@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+const (
+	testOIDCClientID     = "echo-tools"
+	testOIDCClientSecret = "client-secret"
+	testOIDCRedirectURL  = "https://app.example.org/callback"
+)
+
+// testOIDCAuthorization is what the identity provider remembers about an issued authorization code
+type testOIDCAuthorization struct {
+	codeChallenge string
+	claims        map[string]any
+}
+
+// testIdentityProvider is a minimal OpenID provider serving discovery, keys and the token endpoint
+type testIdentityProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock           sync.Mutex
+	authorizations map[string]testOIDCAuthorization
+	discoveries    int
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdentityProvider{key: key, authorizations: make(map[string]testOIDCAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.serveDiscovery)
+	mux.HandleFunc("/keys", idp.serveKeys)
+	mux.HandleFunc("/token", idp.serveToken)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *testIdentityProvider) serveDiscovery(w http.ResponseWriter, _ *http.Request) {
+	idp.lock.Lock()
+	idp.discoveries++
+	idp.lock.Unlock()
+
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *testIdentityProvider) serveKeys(w http.ResponseWriter, _ *http.Request) {
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *testIdentityProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+		writeTestJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.lock.Lock()
+	authorization, ok := idp.authorizations[r.PostFormValue("code")]
+	delete(idp.authorizations, r.PostFormValue("code"))
+	idp.lock.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("redirect_uri") != testOIDCRedirectURL ||
+		base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.codeChallenge {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.signIDToken(authorization.claims),
+	})
+}
+
+// authorize issues an authorization code for the authorization URL, as if the user had logged in at the provider
+func (idp *testIdentityProvider) authorize(t *testing.T, authURL string, claims map[string]any) url.Values {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != testOIDCClientID || query.Get("code_challenge_method") != "S256" ||
+		query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	idToken := map[string]any{
+		"iss":   idp.URL,
+		"aud":   testOIDCClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for claim, value := range claims {
+		idToken[claim] = value
+	}
+
+	code, err := generateOIDCToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.lock.Lock()
+	idp.authorizations[code] = testOIDCAuthorization{codeChallenge: query.Get("code_challenge"), claims: idToken}
+	idp.lock.Unlock()
+
+	return url.Values{"state": {query.Get("state")}, "code": {code}}
+}
+
+func (idp *testIdentityProvider) signIDToken(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *testIdentityProvider) discoveryCount() int {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	return idp.discoveries
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func createTestOIDCProvider(t *testing.T, db *gorm.DB, issuer string) *utilitymodels.OIDCProvider {
+	t.Helper()
+
+	provider := utilitymodels.OIDCProvider{
+		Name:         "Test",
+		Issuer:       issuer,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCClientSecret,
+		RedirectURL:  testOIDCRedirectURL,
+	}
+	if err := db.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &provider
+}
+
+// beginTestOIDCLogin starts a login and returns the authorization URL and the state cookie
+func beginTestOIDCLogin(t *testing.T, db *gorm.DB, providerID uint) (string, *http.Cookie) {
+	t.Helper()
+
+	c, rec := newTestContext(nil)
+	authURL, err := BeginOIDCLogin(db, c, providerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authURL, responseCookie(t, rec, oidcStateCookie)
+}
+
+func finishTestOIDCLogin(db *gorm.DB, callback url.Values, cookie *http.Cookie) (*utilitymodels.OIDCUser, error) {
+	req := httptest.NewRequest(http.MethodGet, "/callback?"+callback.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return FinishOIDCLogin(db, echo.New().NewContext(req, httptest.NewRecorder()))
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	idp := newTestIdentityProvider(t)
+	provider := createTestOIDCProvider(t, db, idp.URL)
+
+	authURL, cookie := beginTestOIDCLogin(t, db, provider.ID)
+	callback := idp.authorize(t, authURL, map[string]any{
+		"sub":                "subject-1",
+		"email":              "alice@example.org",
+		"preferred_username": "alice",
+	})
+	u, err := finishTestOIDCLogin(db, callback, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Subject != "subject-1" || u.Username != "alice" || u.Email == nil || *u.Email != "alice@example.org" ||
+		u.OIDCProviderID != provider.ID {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	// The second login updates the existing user
+	authURL, cookie = beginTestOIDCLogin(t, db, provider.ID)
+	callback = idp.authorize(t, authURL, map[string]any{"sub": "subject-1"})
+	updated, err := finishTestOIDCLogin(db, callback, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != u.ID || updated.Username != "subject-1" || updated.Email != nil {
+		t.Fatalf("unexpected updated user %+v", updated)
+	}
+
+	var count int64
+	db.Model(&utilitymodels.OIDCUser{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected one user, got %d", count)
+	}
+
+	// The discovery document was only requested once
+	if discoveries := idp.discoveryCount(); discoveries != 1 {
+		t.Fatalf("expected one discovery, got %d", discoveries)
+	}
+}
+
+func TestOIDCLoginFailures(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	idp := newTestIdentityProvider(t)
+	provider := createTestOIDCProvider(t, db, idp.URL)
+
+	subject := map[string]any{"sub": "subject-1"}
+
+	c, _ := newTestContext(nil)
+	if _, err := BeginOIDCLogin(db, c, provider.ID+1); !errors.Is(err, ErrOIDCProviderNotFound) {
+		t.Fatalf("expected %v, got %v", ErrOIDCProviderNotFound, err)
+	}
+
+	tests := []struct {
+		name     string
+		callback func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie)
+		expected error
+	}{
+		{
+			name: "missing cookie",
+			callback: func(t *testing.T, authURL string, _ *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, subject), nil
+			},
+			expected: ErrOIDCInvalidState,
+		},
+		{
+			name: "state mismatch",
+			callback: func(t *testing.T, authURL string, _ *http.Cookie) (url.Values, *http.Cookie) {
+				_, otherCookie := beginTestOIDCLogin(t, db, provider.ID)
+				return idp.authorize(t, authURL, subject), otherCookie
+			},
+			expected: ErrOIDCInvalidState,
+		},
+		{
+			name: "authorization denied",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				callback := idp.authorize(t, authURL, subject)
+				callback.Del("code")
+				callback.Set("error", "access_denied")
+				return callback, cookie
+			},
+			expected: ErrOIDCAuthorizationDenied,
+		},
+		{
+			name: "unknown code",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				callback := idp.authorize(t, authURL, subject)
+				callback.Set("code", "unknown")
+				return callback, cookie
+			},
+			expected: ErrOIDCCodeExchangeFailed,
+		},
+		{
+			name: "pkce mismatch",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				// The code was issued for the challenge of another login
+				otherURL, _ := beginTestOIDCLogin(t, db, provider.ID)
+				otherCallback := idp.authorize(t, otherURL, subject)
+				callback := idp.authorize(t, authURL, subject)
+				callback.Set("code", otherCallback.Get("code"))
+				return callback, cookie
+			},
+			expected: ErrOIDCCodeExchangeFailed,
+		},
+		{
+			name: "nonce mismatch",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, map[string]any{"sub": "subject-1", "nonce": "other"}), cookie
+			},
+			expected: ErrOIDCInvalidIDToken,
+		},
+		{
+			name: "wrong audience",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, map[string]any{"sub": "subject-1", "aud": "other-client"}), cookie
+			},
+			expected: ErrOIDCInvalidIDToken,
+		},
+		{
+			name: "wrong issuer",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, map[string]any{"sub": "subject-1", "iss": "https://attacker.example"}), cookie
+			},
+			expected: ErrOIDCInvalidIDToken,
+		},
+		{
+			name: "expired token",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, map[string]any{"sub": "subject-1", "exp": time.Now().Add(-time.Hour).Unix()}), cookie
+			},
+			expected: ErrOIDCInvalidIDToken,
+		},
+		{
+			name: "missing subject",
+			callback: func(t *testing.T, authURL string, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return idp.authorize(t, authURL, nil), cookie
+			},
+			expected: ErrOIDCMissingSubject,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authURL, cookie := beginTestOIDCLogin(t, db, provider.ID)
+			callback, cookie := test.callback(t, authURL, cookie)
+			if _, err := finishTestOIDCLogin(db, callback, cookie); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&utilitymodels.OIDCUser{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no user to be created, got %d", count)
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	idp := newTestIdentityProvider(t)
+	provider := createTestOIDCProvider(t, db, idp.URL)
+
+	authURL, cookie := beginTestOIDCLogin(t, db, provider.ID)
+	callback := idp.authorize(t, authURL, map[string]any{"sub": "subject-1"})
+	if _, err := finishTestOIDCLogin(db, callback, cookie); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finishTestOIDCLogin(db, callback, cookie); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Fatalf("expected %v, got %v", ErrOIDCInvalidState, err)
+	}
+}
+
+func TestOIDCExpiredRequests(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	idp := newTestIdentityProvider(t)
+	provider := createTestOIDCProvider(t, db, idp.URL)
+
+	beginTestOIDCLogin(t, db, provider.ID)
+	authURL, cookie := beginTestOIDCLogin(t, db, provider.ID)
+	if err := db.Model(&utilitymodels.OIDCAuthRequest{}).Where("true").
+		Update("valid_until", time.Now().UTC().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	callback := idp.authorize(t, authURL, map[string]any{"sub": "subject-1"})
+	if _, err := finishTestOIDCLogin(db, callback, cookie); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Fatalf("expected %v, got %v", ErrOIDCInvalidState, err)
+	}
+
+	// Both the expired and the abandoned request were deleted
+	var count int64
+	db.Model(&utilitymodels.OIDCAuthRequest{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected expired requests to be deleted, got %d", count)
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+)
+
+// IssuePasswordResetToken creates a password reset token for the local user with the given username or email
+// and passes it to send, which should deliver it to the user, e.g. by mail.
+// Previously issued tokens of the user are invalidated. A username takes precedence over the email of another user.
+// If no user matches, send isn't called and nil is returned, so the caller can't reveal whether the account exists.
+// As send is called synchronously, callers who don't want to reveal it through the response time either should
+// call IssuePasswordResetToken in a new goroutine. Errors of send are returned.
+func IssuePasswordResetToken(db *gorm.DB, usernameOrEmail string, validity time.Duration, send func(user *utilitymodels.LocalUser, token string) error) error {
+	var users []utilitymodels.LocalUser
+	if err := db.Find(&users, "username = ? OR email = ?", usernameOrEmail, usernameOrEmail).Error; err != nil {
+		return middleware.ErrDatabaseError
+	}
+
+	var u *utilitymodels.LocalUser
+	for i := range users {
+		if users[i].Username == usernameOrEmail {
+			u = &users[i]
+			break
+		}
+		u = &users[i]
+	}
+	if u == nil {
+		return nil
+	}
+
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return ErrRandomFailed
+	}
+	token := fmt.Sprintf("%x", r)
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("local_user_id = ?", u.ID).Delete(&utilitymodels.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Omit("LocalUser").Create(&utilitymodels.PasswordResetToken{
+			LocalUserID: u.ID,
+			TokenHash:   hashResetToken(token),
+			ValidUntil:  time.Now().UTC().Add(validity),
+		}).Error
+	}); err != nil {
+		return middleware.ErrDatabaseError
+	}
+
+	return send(u, token)
+}
+
+// RedeemPasswordResetToken sets a new password for the owner of the token with SetNewPasswordForLocalUser, which
+// also invalidates all sessions of the user. The token is consumed in the transaction changing the password, so it
+// can only be used once. If the new password violates the password policy, a *policy.ViolationError is returned and
+// the token stays valid.
+func RedeemPasswordResetToken(db *gorm.DB, token string, newPassword string) error {
+	var t utilitymodels.PasswordResetToken
+	var count int64
+
+	if err := db.Find(&t, "token_hash = ? AND valid_until > ?", hashResetToken(token), time.Now().UTC()).Count(&count).Error; err != nil {
+		return middleware.ErrDatabaseError
+	}
+	if count != 1 {
+		return ErrInvalidResetToken
+	}
+
+	return setNewPassword(db, t.LocalUserID, newPassword, func(tx *gorm.DB) error {
+		// A concurrent request may have consumed the token in the meantime
+		res := tx.Delete(&t)
+		if res.Error != nil {
+			return middleware.ErrDatabaseError
+		}
+		if res.RowsAffected != 1 {
+			return ErrInvalidResetToken
+		}
+
+		// Tokens issued in the meantime are not needed anymore
+		if err := tx.Where("local_user_id = ?", t.LocalUserID).Delete(&utilitymodels.PasswordResetToken{}).Error; err != nil {
+			return middleware.ErrDatabaseError
+		}
+		return nil
+	})
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/hashing"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/policy"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// issueTestResetToken issues a reset token. Returns the user the token was sent to.
+func issueTestResetToken(t *testing.T, db *gorm.DB, usernameOrEmail string, validity time.Duration) (*utilitymodels.LocalUser, string) {
+	t.Helper()
+
+	var recipient *utilitymodels.LocalUser
+	var sent string
+	err := IssuePasswordResetToken(db, usernameOrEmail, validity, func(user *utilitymodels.LocalUser, token string) error {
+		recipient, sent = user, token
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient == nil {
+		t.Fatal("reset token was not sent")
+	}
+	return recipient, sent
+}
+
+func setTestEmail(t *testing.T, db *gorm.DB, u *utilitymodels.LocalUser, email string) {
+	t.Helper()
+
+	if err := u.SetEmail(db, &email); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+	setTestEmail(t, db, u, "alice@example.org")
+
+	recipient, token := issueTestResetToken(t, db, "alice@example.org", time.Hour)
+	if recipient.ID != u.ID {
+		t.Fatalf("expected token for user %d, got %d", u.ID, recipient.ID)
+	}
+
+	// A second token invalidates the first one
+	_, secondToken := issueTestResetToken(t, db, "alice", time.Hour)
+	if err := RedeemPasswordResetToken(db, token, "a new password for alice"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidResetToken, err)
+	}
+
+	if err := RedeemPasswordResetToken(db, secondToken, "a new password for alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthenticateLocalUser(db, "alice", "a new password for alice"); err != nil {
+		t.Fatalf("expected the new password to be set, got %v", err)
+	}
+
+	// Every token can only be used once
+	if err := RedeemPasswordResetToken(db, secondToken, "another password for alice"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidResetToken, err)
+	}
+
+	_, expiredToken := issueTestResetToken(t, db, "alice", -time.Minute)
+	if err := RedeemPasswordResetToken(db, expiredToken, "another password for alice"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidResetToken, err)
+	}
+}
+
+func TestPasswordResetUnknownUser(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	createTestLocalUser(t, db, "alice")
+
+	err := IssuePasswordResetToken(db, "bob", time.Hour, func(*utilitymodels.LocalUser, string) error {
+		t.Error("send must not be called for unknown users")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	db.Model(&utilitymodels.PasswordResetToken{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no token, got %d", count)
+	}
+}
+
+func TestPasswordResetPrefersUsername(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	alice := createTestLocalUser(t, db, "alice")
+	bob := createTestLocalUser(t, db, "bob")
+
+	// The email of bob is the username of alice
+	setTestEmail(t, db, bob, "alice")
+	recipient, _ := issueTestResetToken(t, db, "alice", time.Hour)
+	if recipient.ID != alice.ID {
+		t.Fatalf("expected token for user %d, got %d", alice.ID, recipient.ID)
+	}
+
+	setTestEmail(t, db, alice, "bob")
+	recipient, _ = issueTestResetToken(t, db, "bob", time.Hour)
+	if recipient.ID != bob.ID {
+		t.Fatalf("expected token for user %d, got %d", bob.ID, recipient.ID)
+	}
+}
+
+func TestPasswordResetPolicyViolation(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	previous := policy.GetDefaultPolicy()
+	policy.SetDefaultPolicy(&policy.PasswordPolicy{MinLength: 20})
+	t.Cleanup(func() {
+		policy.SetDefaultPolicy(previous)
+	})
+
+	_, token := issueTestResetToken(t, db, "alice", time.Hour)
+	var violation *policy.ViolationError
+	if err := RedeemPasswordResetToken(db, token, "too short"); !errors.As(err, &violation) {
+		t.Fatalf("expected a policy violation, got %v", err)
+	}
+
+	// The token stays valid, so the user can try again
+	if err := RedeemPasswordResetToken(db, token, "long enough for the policy"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored utilitymodels.LocalUser
+	db.First(&stored, u.ID)
+	if ok, _, _ := hashing.Verify(stored.Password, "long enough for the policy"); !ok {
+		t.Fatal("expected the new password to be set")
+	}
+}
+
+func TestPasswordResetTokenConsumedWithPassword(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+	_, token := issueTestResetToken(t, db, "alice", time.Hour)
+
+	var stored utilitymodels.LocalUser
+	db.First(&stored, u.ID)
+
+	// Without a session middleware, the sessions are invalidated in the database
+	store := middleware.NewGormSessionStore(db)
+	if err := store.Create(&utilitymodels.Session{
+		AuthID:     u.ID,
+		AuthKey:    utilitymodels.LocalAuthKey,
+		SessionID:  "alice",
+		ValidUntil: time.Now().UTC().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token consumed by a concurrent request isn't accepted, and the password stays unchanged
+	if err := setNewPassword(db, u.ID, "a new password for alice", func(tx *gorm.DB) error {
+		return ErrInvalidResetToken
+	}); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidResetToken, err)
+	}
+	var unchanged utilitymodels.LocalUser
+	db.First(&unchanged, u.ID)
+	if unchanged.Password != stored.Password {
+		t.Fatal("expected the password to be unchanged")
+	}
+	if _, err := store.Get("alice"); err != nil {
+		t.Fatalf("expected the session to be kept, got %v", err)
+	}
+
+	// A failed password change leaves the token usable
+	if err := db.Delete(&utilitymodels.LocalUser{}, u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := RedeemPasswordResetToken(db, token, "a new password for alice"); !errors.Is(err, ErrUsernameNotFound) {
+		t.Fatalf("expected %v, got %v", ErrUsernameNotFound, err)
+	}
+	var count int64
+	db.Model(&utilitymodels.PasswordResetToken{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected the token to be kept, got %d tokens", count)
+	}
+}
+
+func TestPasswordResetSendError(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	createTestLocalUser(t, db, "alice")
+
+	sendErr := errors.New("mail server unavailable")
+	err := IssuePasswordResetToken(db, "alice", time.Hour, func(*utilitymodels.LocalUser, string) error {
+		return sendErr
+	})
+	if !errors.Is(err, sendErr) {
+		t.Fatalf("expected %v, got %v", sendErr, err)
+	}
+}
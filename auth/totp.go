@@ -0,0 +1,501 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("totp is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("totp enrollment was not started")
+	ErrTOTPNotEnabled     = errors.New("totp is not enabled")
+	ErrInvalidTOTPCode    = errors.New("invalid totp code")
+	ErrTOTPKeyMissing     = errors.New("no totp encryption key is set")
+	ErrTOTPSecretInvalid  = errors.New("totp secret can't be decrypted with the set keys")
+	ErrRandomFailed       = middleware.ErrRandomFailed
+)
+
+const (
+	totpDigits            = 6
+	totpPeriod            = 30 // Seconds
+	totpSkew              = 1  // Number of periods accepted before and after the current one
+	totpSecretLength      = 20 // Bytes, as recommended by RFC 4226
+	recoveryCodeCount     = 10
+	recoveryCodeLength    = 10 // Characters, formatted as two groups of five
+	recoveryCodeAlphabet  = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryCodeSeparator = "-"
+	totpSecretPrefix      = "aesgcm:" // Marks encrypted secrets, secrets without it were stored in plaintext
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var (
+	totpKeyLock sync.RWMutex
+	totpKeys    []cipher.AEAD
+)
+
+// SetTOTPKeys sets the keys used to encrypt TOTP secrets in the database with AES-GCM. The first key encrypts,
+// all keys decrypt, so a new key can be put in front while secrets of older keys stay readable. Every key must have
+// 16, 24 or 32 bytes, else SetTOTPKeys panics.
+// BeginTOTPEnrollment returns ErrTOTPKeyMissing until a key is set. Secrets stored in plaintext or with an older key
+// are encrypted with the first key on their next successful use.
+func SetTOTPKeys(keys ...[]byte) {
+	aeads := make([]cipher.AEAD, 0, len(keys))
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			panic("invalid totp key: " + err.Error())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			panic("invalid totp key: " + err.Error())
+		}
+		aeads = append(aeads, aead)
+	}
+
+	totpKeyLock.Lock()
+	defer totpKeyLock.Unlock()
+	totpKeys = aeads
+}
+
+func getTOTPKeys() []cipher.AEAD {
+	totpKeyLock.RLock()
+	defer totpKeyLock.RUnlock()
+	return totpKeys
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for a local user and returns the otpauth:// URI, which can be
+// displayed as QR code. The secret is only used after the enrollment was confirmed with ConfirmTOTPEnrollment.
+// Calling this method again replaces a not yet confirmed secret. Returns ErrTOTPKeyMissing if SetTOTPKeys wasn't called.
+func BeginTOTPEnrollment(db *gorm.DB, userID uint, issuer string) (string, error) {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return "", err
+	}
+
+	if u.TOTPEnabled {
+		return "", ErrTOTPAlreadyEnabled
+	}
+
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", ErrRandomFailed
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+
+	sealed, err := sealTOTPSecret(u.ID, encoded)
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.Model(u).Updates(map[string]any{
+		"totp_secret":       sealed,
+		"totp_last_counter": 0,
+	}).Error; err != nil {
+		return "", middleware.ErrDatabaseError
+	}
+
+	return totpURI(issuer, u.Username, encoded), nil
+}
+
+// ConfirmTOTPEnrollment verifies a code generated from the secret of BeginTOTPEnrollment and enables TOTP for the user.
+// The returned recovery codes can be used once each instead of a TOTP code. They are only stored hashed and
+// can't be retrieved again.
+func ConfirmTOTPEnrollment(db *gorm.DB, userID uint, code string) ([]string, error) {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if u.TOTPSecret == nil {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	secret, _, err := openTOTPSecret(u.ID, *u.TOTPSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	counter, ok := validateTOTP(secret, code, u.TOTPLastCounter, time.Now())
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(u).Updates(map[string]any{
+			"totp_enabled":      true,
+			"totp_last_counter": counter,
+		}).Error; err != nil {
+			return err
+		}
+
+		codes, err = replaceRecoveryCodes(tx, u.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrRandomFailed) {
+			return nil, err
+		}
+		return nil, middleware.ErrDatabaseError
+	}
+
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes invalidates all recovery codes of a user and returns a new set
+func RegenerateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		codes, err = replaceRecoveryCodes(tx, u.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrRandomFailed) {
+			return nil, err
+		}
+		return nil, middleware.ErrDatabaseError
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP removes the TOTP secret and all recovery codes of a user
+func DisableTOTP(db *gorm.DB, userID uint) error {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(u).Updates(map[string]any{
+			"totp_secret":       nil,
+			"totp_enabled":      false,
+			"totp_last_counter": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("local_user_id = ?", u.ID).Delete(&utilitymodels.RecoveryCode{}).Error
+	}); err != nil {
+		return middleware.ErrDatabaseError
+	}
+
+	return nil
+}
+
+// VerifyLocalUserTOTP checks the given code against the TOTP secret of the user. If it is not a valid TOTP code,
+// it is checked against the user's recovery codes. A used recovery code is deleted.
+// A TOTP code is only accepted once. Wrong codes are throttled per user like failed logins, if enabled with
+// SetLockoutConfig.
+// Returns ErrAccountLocked while the second factor of the user is locked.
+func VerifyLocalUserTOTP(db *gorm.DB, userID uint, code string) error {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return err
+	}
+
+	if !u.TOTPEnabled || u.TOTPSecret == nil {
+		return ErrTOTPNotEnabled
+	}
+
+	config := getLockoutConfig()
+	if config != nil {
+		if err := checkLockedIdentifiers(db, secondFactorIdentifier(u.ID)); err != nil {
+			return err
+		}
+	}
+
+	secret, outdated, err := openTOTPSecret(u.ID, *u.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	err = verifyTOTPOrRecoveryCode(db, u, secret, code)
+	if config != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			if lockErr := registerFailedSecondFactor(db, config, u.ID); lockErr != nil {
+				return lockErr
+			}
+		} else if err == nil {
+			if err := resetFailures(db, secondFactorIdentifier(u.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Failing to encrypt with the current key is not fatal, it will be tried again on the next use
+	if outdated {
+		if sealed, err := sealTOTPSecret(u.ID, secret); err == nil {
+			db.Model(u).Update("totp_secret", sealed)
+		}
+	}
+
+	return nil
+}
+
+// verifyTOTPOrRecoveryCode accepts a TOTP code newer than the last accepted one or an unused recovery code
+func verifyTOTPOrRecoveryCode(db *gorm.DB, u *utilitymodels.LocalUser, secret string, code string) error {
+	if counter, ok := validateTOTP(secret, code, u.TOTPLastCounter, time.Now()); ok {
+		// Only update if nobody else used this or a later code in the meantime
+		res := db.Model(&utilitymodels.LocalUser{}).
+			Where("id = ? AND totp_last_counter < ?", u.ID, counter).
+			Update("totp_last_counter", counter)
+		if res.Error != nil {
+			return middleware.ErrDatabaseError
+		}
+		if res.RowsAffected != 1 {
+			return ErrInvalidTOTPCode
+		}
+		return nil
+	}
+
+	// Try recovery codes
+	res := db.Where("local_user_id = ? AND code_hash = ?", u.ID, hashRecoveryCode(code)).
+		Delete(&utilitymodels.RecoveryCode{})
+	if res.Error != nil {
+		return middleware.ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return ErrInvalidTOTPCode
+	}
+
+	return nil
+}
+
+// VerifySecondFactor verifies the code for the pending second factor of the current session
+// and marks the session as fully authenticated on success.
+// Only sessions of a utilitymodels.LocalUser are supported.
+func VerifySecondFactor(db *gorm.DB, c echo.Context, code string) error {
+	sessionContext, err := middleware.GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	if !sessionContext.IsSecondFactorPending() {
+		return middleware.ErrSecondFactorNotPending
+	}
+
+	u, ok := sessionContext.GetUser().(*utilitymodels.LocalUser)
+	if !ok {
+		return ErrTOTPNotEnabled
+	}
+
+	if err := VerifyLocalUserTOTP(db, u.ID, code); err != nil {
+		return err
+	}
+
+	return middleware.CompleteSecondFactor(db, c)
+}
+
+func getLocalUser(db *gorm.DB, userID uint) (*utilitymodels.LocalUser, error) {
+	var u utilitymodels.LocalUser
+	var count int64
+
+	if err := db.Find(&u, userID).Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+
+	if count != 1 {
+		return nil, ErrUsernameNotFound
+	}
+
+	return &u, nil
+}
+
+// replaceRecoveryCodes deletes all existing recovery codes of the user and creates new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("local_user_id = ?", userID).Delete(&utilitymodels.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	models := make([]utilitymodels.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		models = append(models, utilitymodels.RecoveryCode{
+			LocalUserID: userID,
+			CodeHash:    hashRecoveryCode(code),
+		})
+	}
+
+	if err := tx.Omit("LocalUser").Create(&models).Error; err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func generateRecoveryCode() (string, error) {
+	r := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(r); err != nil {
+		return "", ErrRandomFailed
+	}
+
+	var b strings.Builder
+	for i, v := range r {
+		if i == recoveryCodeLength/2 {
+			b.WriteString(recoveryCodeSeparator)
+		}
+		// The alphabet is short enough that the modulo bias is negligible
+		b.WriteByte(recoveryCodeAlphabet[int(v)%len(recoveryCodeAlphabet)])
+	}
+	return b.String(), nil
+}
+
+// hashRecoveryCode normalizes the user input before hashing, so codes are accepted regardless of
+// case, whitespace and the separator
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(code), ""))
+	normalized = strings.ReplaceAll(normalized, recoveryCodeSeparator, "")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// sealTOTPSecret encrypts the base32 encoded secret with the first key. The user id is authenticated as well, so the
+// secret can't be copied to another user.
+func sealTOTPSecret(userID uint, secret string) (string, error) {
+	keys := getTOTPKeys()
+	if len(keys) == 0 {
+		return "", ErrTOTPKeyMissing
+	}
+
+	nonce := make([]byte, keys[0].NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", ErrRandomFailed
+	}
+	sealed := keys[0].Seal(nonce, nonce, []byte(secret), totpSecretAdditionalData(userID))
+
+	return totpSecretPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret returns the base32 encoded secret of the stored value. outdated is true if the secret wasn't
+// encrypted with the first key.
+func openTOTPSecret(userID uint, stored string) (secret string, outdated bool, err error) {
+	if !strings.HasPrefix(stored, totpSecretPrefix) {
+		return stored, true, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, totpSecretPrefix))
+	if err != nil {
+		return "", false, ErrTOTPSecretInvalid
+	}
+
+	for i, key := range getTOTPKeys() {
+		if len(sealed) < key.NonceSize() {
+			break
+		}
+		nonce, ciphertext := sealed[:key.NonceSize()], sealed[key.NonceSize():]
+		if plaintext, err := key.Open(nil, nonce, ciphertext, totpSecretAdditionalData(userID)); err == nil {
+			return string(plaintext), i != 0, nil
+		}
+	}
+	return "", false, ErrTOTPSecretInvalid
+}
+
+func totpSecretAdditionalData(userID uint) []byte {
+	return []byte(fmt.Sprintf("totp:%d", userID))
+}
+
+// totpURI builds the otpauth:// URI as understood by authenticator apps
+func totpURI(issuer string, accountName string, secret string) string {
+	label := url.PathEscape(accountName)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	if issuer != "" {
+		values.Set("issuer", issuer)
+	}
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	// Some authenticator apps don't decode "+" as space
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(values.Encode(), "+", "%20")
+}
+
+// validateTOTP checks the code against the time steps around t. Codes of time steps lower or equal to lastCounter
+// are rejected. Returns the matched time step.
+func validateTOTP(secret string, code string, lastCounter int64, t time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := current + int64(i)
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generateTOTP(key, uint64(counter))), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// generateTOTP implements the HOTP algorithm of RFC 4226 with the time step as counter (RFC 6238)
+func generateTOTP(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/database"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+func setTestTOTPKeys(t *testing.T, keys ...[]byte) {
+	t.Helper()
+	SetTOTPKeys(keys...)
+	t.Cleanup(func() {
+		SetTOTPKeys()
+	})
+}
+
+func createTestLocalUser(t *testing.T, db *gorm.DB, username string) *utilitymodels.LocalUser {
+	t.Helper()
+	u, err := database.CreateLocalUser(db, username, "correct horse battery staple", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// enrollTestTOTP enrolls the user and returns the decoded secret and the recovery codes
+func enrollTestTOTP(t *testing.T, db *gorm.DB, userID uint) ([]byte, []string) {
+	t.Helper()
+
+	uri, err := BeginTOTPEnrollment(db, userID, "Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := ConfirmTOTPEnrollment(db, userID, testTOTPCode(key, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, codes
+}
+
+// testTOTPCode returns the code of the current time step shifted by offset
+func testTOTPCode(key []byte, offset int64) string {
+	return generateTOTP(key, uint64(time.Now().Unix()/totpPeriod+offset))
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	if _, err := BeginTOTPEnrollment(db, u.ID, "Example"); !errors.Is(err, ErrTOTPKeyMissing) {
+		t.Fatalf("expected %v, got %v", ErrTOTPKeyMissing, err)
+	}
+
+	setTestTOTPKeys(t, []byte("0123456789abcdef0123456789abcdef"))
+
+	uri, err := BeginTOTPEnrollment(db, u.ID, "Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/Example:alice?") {
+		t.Fatalf("unexpected uri %s", uri)
+	}
+	parsed, _ := url.Parse(uri)
+	secret := parsed.Query().Get("secret")
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret is only stored encrypted
+	u, _ = getLocalUser(db, u.ID)
+	if u.TOTPSecret == nil || !strings.HasPrefix(*u.TOTPSecret, totpSecretPrefix) || strings.Contains(*u.TOTPSecret, secret) {
+		t.Fatalf("expected encrypted secret, got %v", u.TOTPSecret)
+	}
+	if u.TOTPEnabled {
+		t.Fatal("expected totp to be disabled until confirmed")
+	}
+
+	if _, err := ConfirmTOTPEnrollment(db, u.ID, "0000000"); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expected %v, got %v", ErrInvalidTOTPCode, err)
+	}
+	codes, err := ConfirmTOTPEnrollment(db, u.ID, testTOTPCode(key, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	if _, err := BeginTOTPEnrollment(db, u.ID, "Example"); !errors.Is(err, ErrTOTPAlreadyEnabled) {
+		t.Fatalf("expected %v, got %v", ErrTOTPAlreadyEnabled, err)
+	}
+
+	// The code used for the confirmation can't be replayed
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 0)); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expected %v, got %v", ErrInvalidTOTPCode, err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); err != nil {
+		t.Fatalf("expected code of the next time step to be accepted, got %v", err)
+	}
+
+	if err := DisableTOTP(db, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); !errors.Is(err, ErrTOTPNotEnabled) {
+		t.Fatalf("expected %v, got %v", ErrTOTPNotEnabled, err)
+	}
+}
+
+func TestTOTPKeyRotation(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	oldKey := []byte("0123456789abcdef")
+	setTestTOTPKeys(t, oldKey)
+	key, _ := enrollTestTOTP(t, db, u.ID)
+
+	u, _ = getLocalUser(db, u.ID)
+	before := *u.TOTPSecret
+
+	// Without the old key the secret can't be read anymore
+	SetTOTPKeys([]byte("fedcba9876543210"))
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); !errors.Is(err, ErrTOTPSecretInvalid) {
+		t.Fatalf("expected %v, got %v", ErrTOTPSecretInvalid, err)
+	}
+
+	// A secret of an older key is encrypted with the first key on its next use
+	SetTOTPKeys([]byte("fedcba9876543210"), oldKey)
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = getLocalUser(db, u.ID)
+	if *u.TOTPSecret == before {
+		t.Fatal("expected secret to be encrypted with the new key")
+	}
+	SetTOTPKeys([]byte("fedcba9876543210"))
+	if _, _, err := openTOTPSecret(u.ID, *u.TOTPSecret); err != nil {
+		t.Fatalf("expected secret to be readable with the new key, got %v", err)
+	}
+
+	// The secret is bound to its user
+	if _, _, err := openTOTPSecret(u.ID+1, *u.TOTPSecret); !errors.Is(err, ErrTOTPSecretInvalid) {
+		t.Fatalf("expected %v, got %v", ErrTOTPSecretInvalid, err)
+	}
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+	setTestTOTPKeys(t, []byte("0123456789abcdef"))
+	_, codes := enrollTestTOTP(t, db, u.ID)
+
+	// Recovery codes are accepted regardless of case, whitespace and separator
+	code := strings.ToUpper(strings.ReplaceAll(codes[0], recoveryCodeSeparator, " "))
+	if err := VerifyLocalUserTOTP(db, u.ID, code); err != nil {
+		t.Fatalf("expected recovery code to be accepted, got %v", err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, codes[0]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expected used recovery code to be rejected, got %v", err)
+	}
+
+	regenerated, err := RegenerateRecoveryCodes(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, codes[1]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expected replaced recovery code to be rejected, got %v", err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, regenerated[1]); err != nil {
+		t.Fatalf("expected new recovery code to be accepted, got %v", err)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+	setTestTOTPKeys(t, []byte("0123456789abcdef"))
+	key, _ := enrollTestTOTP(t, db, u.ID)
+	setTestLockoutConfig(t, &LockoutConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if err := VerifyLocalUserTOTP(db, u.ID, "000000"); !errors.Is(err, ErrInvalidTOTPCode) {
+			t.Fatalf("expected %v, got %v", ErrInvalidTOTPCode, err)
+		}
+	}
+
+	// Even a correct code is refused while the second factor is locked
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+
+	if err := UnlockLocalUser(db, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLocalUserTOTP(db, u.ID, testTOTPCode(key, 1)); err != nil {
+		t.Fatalf("expected code to be accepted after unlocking, got %v", err)
+	}
+}
+
+// serveTestSession handles a request with the session middleware of m and returns the response.
+// The cookies of the response are added to cookies.
+func serveTestSession(t *testing.T, m *middleware.SessionManager, cookies map[string]*http.Cookie, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if err := m.Middleware()(handler)(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(cookies, cookie.Name)
+		} else {
+			cookies[cookie.Name] = cookie
+		}
+	}
+	return rec
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+	setTestTOTPKeys(t, []byte("0123456789abcdef"))
+	key, _ := enrollTestTOTP(t, db, u.ID)
+	u, _ = getLocalUser(db, u.ID)
+
+	secure := false
+	m := middleware.NewSessionManager(db, &middleware.SessionConfig{Secure: &secure, Store: middleware.NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	cookies := map[string]*http.Cookie{}
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(u, c, true)
+	})
+	pendingCookie := cookies["session_id"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		sessionContext, _ := middleware.GetSessionContext(c)
+		if !sessionContext.IsSecondFactorPending() || sessionContext.IsAuthenticated() {
+			t.Fatal("expected the second factor to be pending")
+		}
+		if err := VerifySecondFactor(db, c, "000000"); !errors.Is(err, ErrInvalidTOTPCode) {
+			t.Fatalf("expected %v, got %v", ErrInvalidTOTPCode, err)
+		}
+		if err := VerifySecondFactor(db, c, testTOTPCode(key, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if !sessionContext.IsAuthenticated() {
+			t.Fatal("expected the session to be authenticated")
+		}
+		return nil
+	})
+
+	// The session id was rotated, the pending session can't be used anymore
+	if cookies["session_id"].Value == pendingCookie.Value {
+		t.Fatal("expected a new session id")
+	}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		sessionContext, _ := middleware.GetSessionContext(c)
+		if !sessionContext.IsAuthenticated() {
+			t.Fatal("expected the new session to be authenticated")
+		}
+		if err := VerifySecondFactor(db, c, testTOTPCode(key, 1)); !errors.Is(err, middleware.ErrSecondFactorNotPending) {
+			t.Fatalf("expected %v, got %v", middleware.ErrSecondFactorNotPending, err)
+		}
+		return nil
+	})
+	serveTestSession(t, m, map[string]*http.Cookie{"session_id": pendingCookie}, func(c echo.Context) error {
+		sessionContext, _ := middleware.GetSessionContext(c)
+		if sessionContext.IsAuthenticated() || sessionContext.IsSecondFactorPending() {
+			t.Fatal("expected the pending session to be gone")
+		}
+		return nil
+	})
+}
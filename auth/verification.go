@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/mail"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("email verification token is invalid or expired")
+	ErrEmailMissing             = errors.New("user has no email")
+)
+
+// IssueEmailVerificationToken creates a token, which proves the ownership of the current email of the user.
+// The token is signed with secret using HMAC-SHA256 and isn't stored. It's bound to the email, so it can't be used
+// anymore after the email has changed.
+func IssueEmailVerificationToken(user *utilitymodels.LocalUser, secret []byte, validity time.Duration) (string, error) {
+	if user.Email == nil {
+		return "", ErrEmailMissing
+	}
+
+	payload := fmt.Sprintf("%d:%d:%s", user.ID, time.Now().Add(validity).Unix(), *user.Email)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + signVerificationPayload(encoded, secret), nil
+}
+
+// SendEmailVerification issues a verification token and sends it to the email of the user.
+// compose is called with the token and returns subject and body of the mail, e.g. containing a link to the
+// endpoint calling VerifyEmail.
+func SendEmailVerification(mailer mail.Mailer, user *utilitymodels.LocalUser, secret []byte, validity time.Duration, compose func(token string) (string, string)) error {
+	token, err := IssueEmailVerificationToken(user, secret, validity)
+	if err != nil {
+		return err
+	}
+
+	subject, body := compose(token)
+	return mailer.Send(*user.Email, subject, body)
+}
+
+// VerifyEmail checks the token issued by IssueEmailVerificationToken and marks the email of its user as verified
+func VerifyEmail(db *gorm.DB, token string, secret []byte) (*utilitymodels.LocalUser, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signVerificationPayload(encoded, secret))) {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	parts := strings.SplitN(string(payload), ":", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidVerificationToken
+	}
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	u, err := getLocalUser(db, uint(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	// The email has changed since the token was issued
+	if u.Email == nil || *u.Email != parts[2] {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	now := time.Now().UTC()
+	if err := db.Model(u).Update("email_verified", now).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	u.EmailVerified.Time = now
+	u.EmailVerified.Valid = true
+
+	return u, nil
+}
+
+func signVerificationPayload(encoded string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("email-verification:" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
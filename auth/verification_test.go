@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/mail"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var testVerificationSecret = []byte("verification secret")
+
+// sendTestVerification sends a verification mail to the user and returns the token contained in it
+func sendTestVerification(t *testing.T, u *utilitymodels.LocalUser, validity time.Duration) string {
+	t.Helper()
+
+	mailer := mail.NewMemoryMailer()
+	err := SendEmailVerification(mailer, u, testVerificationSecret, validity, func(token string) (string, string) {
+		return "Verify your email", "https://example.org/verify?token=" + token
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != *u.Email {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	_, token, _ := strings.Cut(messages[0].Body, "token=")
+	return token
+}
+
+func isTestEmailVerified(t *testing.T, db *gorm.DB, userID uint) bool {
+	t.Helper()
+
+	var u utilitymodels.LocalUser
+	if err := db.First(&u, userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return u.IsEmailVerified()
+}
+
+func ptrTestEmail(email string) *string {
+	return &email
+}
+
+func TestEmailVerification(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	if err := SendEmailVerification(mail.NewMemoryMailer(), u, testVerificationSecret, time.Hour, nil); !errors.Is(err, ErrEmailMissing) {
+		t.Fatalf("expected %v, got %v", ErrEmailMissing, err)
+	}
+
+	setTestEmail(t, db, u, "alice@example.org")
+	token := sendTestVerification(t, u, time.Hour)
+
+	if _, err := VerifyEmail(db, token, []byte("other secret")); !errors.Is(err, ErrInvalidVerificationToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidVerificationToken, err)
+	}
+	if _, err := VerifyEmail(db, token+"x", testVerificationSecret); !errors.Is(err, ErrInvalidVerificationToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidVerificationToken, err)
+	}
+
+	verified, err := VerifyEmail(db, token, testVerificationSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.IsEmailVerified() || !isTestEmailVerified(t, db, u.ID) {
+		t.Fatal("expected the email to be verified")
+	}
+
+	expired := sendTestVerification(t, u, -time.Minute)
+	if _, err := VerifyEmail(db, expired, testVerificationSecret); !errors.Is(err, ErrInvalidVerificationToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidVerificationToken, err)
+	}
+}
+
+func TestEmailChangeResetsVerification(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	verify := func(t *testing.T) *utilitymodels.LocalUser {
+		t.Helper()
+
+		var current utilitymodels.LocalUser
+		db.First(&current, u.ID)
+		verified, err := VerifyEmail(db, sendTestVerification(t, &current, time.Hour), testVerificationSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verified
+	}
+
+	for i, email := range []*string{ptrTestEmail("alice+new@example.org"), nil} {
+		setTestEmail(t, db, u, "alice@example.org")
+		verified := verify(t)
+		token := sendTestVerification(t, verified, time.Hour)
+
+		if err := verified.SetEmail(db, email); err != nil {
+			t.Fatal(err)
+		}
+		if verified.IsEmailVerified() || isTestEmailVerified(t, db, u.ID) {
+			t.Fatalf("expected the verification to be reset by change %d", i)
+		}
+
+		// The token of the previous email can't verify the new one
+		if _, err := VerifyEmail(db, token, testVerificationSecret); !errors.Is(err, ErrInvalidVerificationToken) {
+			t.Fatalf("expected %v, got %v", ErrInvalidVerificationToken, err)
+		}
+	}
+
+	// Saving other columns keeps the verification
+	setTestEmail(t, db, u, "alice@example.org")
+	verified := verify(t)
+	verified.Username = "alice2"
+	if err := db.Save(verified).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(verified).Update("username", "alice3").Error; err != nil {
+		t.Fatal(err)
+	}
+	if !isTestEmailVerified(t, db, u.ID) {
+		t.Fatal("expected the verification to be kept")
+	}
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/middleware"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrWebAuthnCeremonyMissing = errors.New("webauthn ceremony is missing or expired")
+	ErrWebAuthnFailed          = errors.New("webauthn ceremony failed")
+	ErrWebAuthnCloneWarning    = errors.New("the authenticator may have been cloned")
+	ErrPasskeyNotFound         = errors.New("passkey not found")
+)
+
+const (
+	webAuthnCeremonyCookie = "webauthn_ceremony"
+	webAuthnCeremonyAge    = 5 * time.Minute
+)
+
+// webAuthnUser adapts a LocalUser and its credentials to webauthn.User
+type webAuthnUser struct {
+	user        *utilitymodels.LocalUser
+	credentials []utilitymodels.WebAuthnCredential
+}
+
+// WebAuthnID The user handle is the big endian encoded ID of the LocalUser
+func (u *webAuthnUser) WebAuthnID() []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(u.user.ID))
+	return id
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		var transports []protocol.AuthenticatorTransport
+		if c.Transport != "" {
+			for _, t := range strings.Split(c.Transport, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserVerified:   c.UserVerified,
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// BeginPasskeyRegistration starts the registration of a new passkey for the given local user.
+// The returned options must be passed to navigator.credentials.create() in the browser.
+// The state of the ceremony is kept in the database and referenced by a short-lived cookie.
+func BeginPasskeyRegistration(db *gorm.DB, wa *webauthn.WebAuthn, c echo.Context, userID uint) (*protocol.CredentialCreation, error) {
+	u, err := getWebAuthnUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
+	for _, credential := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := wa.BeginRegistration(
+		u,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		c.Logger().Debugf("Could not begin webauthn registration: %s", err.Error())
+		return nil, ErrWebAuthnFailed
+	}
+
+	if err := saveWebAuthnCeremony(db, c, session); err != nil {
+		return nil, err
+	}
+
+	return creation, nil
+}
+
+// FinishPasskeyRegistration validates the response of navigator.credentials.create(), which must be the body of
+// the current request, and stores the new passkey for the given local user.
+func FinishPasskeyRegistration(db *gorm.DB, wa *webauthn.WebAuthn, c echo.Context, userID uint, name string) (*utilitymodels.WebAuthnCredential, error) {
+	session, err := loadWebAuthnCeremony(db, c)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := getWebAuthnUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := wa.FinishRegistration(u, *session, c.Request())
+	if err != nil {
+		c.Logger().Debugf("Could not finish webauthn registration: %s", err.Error())
+		return nil, ErrWebAuthnFailed
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	model := utilitymodels.WebAuthnCredential{
+		LocalUserID:     u.user.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transport:       strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := db.Omit("LocalUser").Create(&model).Error; err != nil {
+		c.Logger().Errorf("Error saving webauthn credential: %s", err.Error())
+		return nil, middleware.ErrDatabaseError
+	}
+
+	return &model, nil
+}
+
+// BeginPasskeyLogin starts a login with a discoverable passkey. The returned options must be passed to
+// navigator.credentials.get() in the browser.
+func BeginPasskeyLogin(db *gorm.DB, wa *webauthn.WebAuthn, c echo.Context) (*protocol.CredentialAssertion, error) {
+	assertion, session, err := wa.BeginDiscoverableLogin()
+	if err != nil {
+		c.Logger().Debugf("Could not begin webauthn login: %s", err.Error())
+		return nil, ErrWebAuthnFailed
+	}
+
+	if err := saveWebAuthnCeremony(db, c, session); err != nil {
+		return nil, err
+	}
+
+	return assertion, nil
+}
+
+// FinishPasskeyLogin validates the response of navigator.credentials.get(), which must be the body of the current
+// request, and returns the owner of the passkey. The user can be passed to middleware.Login, which results in the same
+// session as a login with AuthenticateLocalUser. If the user has TOTP enabled, the second factor is still required.
+func FinishPasskeyLogin(db *gorm.DB, wa *webauthn.WebAuthn, c echo.Context) (*utilitymodels.LocalUser, error) {
+	session, err := loadWebAuthnCeremony(db, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var u *webAuthnUser
+	credential, err := wa.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != 8 {
+			return nil, ErrPasskeyNotFound
+		}
+		user, err := getWebAuthnUser(db, uint(binary.BigEndian.Uint64(userHandle)))
+		if err != nil {
+			return nil, err
+		}
+		u = user
+		return user, nil
+	}, *session, c.Request())
+	if err != nil {
+		c.Logger().Debugf("Could not finish webauthn login: %s", err.Error())
+		return nil, ErrAuthenticationFailed
+	}
+
+	if credential.Authenticator.CloneWarning {
+		c.Logger().Warnf("Sign count of passkey of user %d decreased, the authenticator may have been cloned", u.user.ID)
+		return nil, ErrWebAuthnCloneWarning
+	}
+
+	if err := db.Model(&utilitymodels.WebAuthnCredential{}).
+		Where("credential_id = ? AND local_user_id = ?", credential.ID, u.user.ID).
+		Updates(map[string]any{
+			"sign_count":    credential.Authenticator.SignCount,
+			"backup_state":  credential.Flags.BackupState,
+			"user_verified": credential.Flags.UserVerified,
+			"last_used_at":  sql.NullTime{Time: time.Now().UTC(), Valid: true},
+		}).Error; err != nil {
+		c.Logger().Errorf("Error updating webauthn credential: %s", err.Error())
+		return nil, middleware.ErrDatabaseError
+	}
+
+	return u.user, nil
+}
+
+// GetPasskeys returns all passkeys of a local user
+func GetPasskeys(db *gorm.DB, userID uint) ([]utilitymodels.WebAuthnCredential, error) {
+	var credentials []utilitymodels.WebAuthnCredential
+	if err := db.Find(&credentials, "local_user_id = ?", userID).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	return credentials, nil
+}
+
+// DeletePasskey removes a passkey of a local user
+func DeletePasskey(db *gorm.DB, userID uint, passkeyID uint) error {
+	res := db.Where("id = ? AND local_user_id = ?", passkeyID, userID).Delete(&utilitymodels.WebAuthnCredential{})
+	if res.Error != nil {
+		return middleware.ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+func getWebAuthnUser(db *gorm.DB, userID uint) (*webAuthnUser, error) {
+	u, err := getLocalUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := GetPasskeys(db, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{user: u, credentials: credentials}, nil
+}
+
+// saveWebAuthnCeremony stores the ceremony state in the database and sets the cookie referencing it
+func saveWebAuthnCeremony(db *gorm.DB, c echo.Context, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return ErrWebAuthnFailed
+	}
+
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return ErrRandomFailed
+	}
+
+	ceremony := utilitymodels.WebAuthnCeremony{
+		CeremonyID: fmt.Sprintf("%x", r),
+		Data:       string(data),
+		ValidUntil: time.Now().UTC().Add(webAuthnCeremonyAge),
+	}
+	if err := db.Create(&ceremony).Error; err != nil {
+		c.Logger().Errorf("Error saving webauthn ceremony: %s", err.Error())
+		return middleware.ErrDatabaseError
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     webAuthnCeremonyCookie,
+		Value:    ceremony.CeremonyID,
+		Path:     "/",
+		MaxAge:   int(webAuthnCeremonyAge.Seconds()),
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// loadWebAuthnCeremony retrieves and deletes the ceremony state referenced by the cookie of the current request.
+// Every ceremony can only be finished once. Expired ceremonies, which were never finished, are deleted as well.
+func loadWebAuthnCeremony(db *gorm.DB, c echo.Context) (*webauthn.SessionData, error) {
+	cookie, err := c.Cookie(webAuthnCeremonyCookie)
+	if err != nil {
+		return nil, ErrWebAuthnCeremonyMissing
+	}
+
+	if err := db.Where("valid_until <= ?", time.Now().UTC()).Delete(&utilitymodels.WebAuthnCeremony{}).Error; err != nil {
+		c.Logger().Errorf("Error deleting expired webauthn ceremonies: %s", err.Error())
+		return nil, middleware.ErrDatabaseError
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:   webAuthnCeremonyCookie,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+		Secure: c.Scheme() == "https",
+	})
+
+	var ceremony utilitymodels.WebAuthnCeremony
+	var count int64
+	if err := db.Find(&ceremony, "ceremony_id = ? AND valid_until > ?", cookie.Value, time.Now().UTC()).
+		Count(&count).Error; err != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if count != 1 {
+		return nil, ErrWebAuthnCeremonyMissing
+	}
+
+	// A concurrent request may have consumed the ceremony in the meantime
+	res := db.Delete(&ceremony)
+	if res.Error != nil {
+		return nil, middleware.ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return nil, ErrWebAuthnCeremonyMissing
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(ceremony.Data), &session); err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+
+	return &session, nil
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+const (
+	testRPID     = "example.org"
+	testRPOrigin = "https://example.org"
+)
+
+// testAuthenticator is a software authenticator with a P-256 key, which creates the responses of
+// navigator.credentials.create() and navigator.credentials.get()
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	origin       string
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &testAuthenticator{key: key, credentialID: credentialID, origin: testRPOrigin}
+}
+
+func (a *testAuthenticator) clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *testAuthenticator) authenticatorData(flags byte, attestedCredential []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedCredential...)
+}
+
+// register returns the body of a registration with the "none" attestation format
+func (a *testAuthenticator) register(t *testing.T, challenge []byte) []byte {
+	t.Helper()
+
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // EC2
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	// User present, user verified and attested credential data included
+	attestationObject, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(0x45, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]any{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+		"transports":        []string{"internal"},
+	})
+}
+
+// assert returns the body of a login with the passkey of the given user handle
+func (a *testAuthenticator) assert(t *testing.T, challenge []byte, userHandle []byte) []byte {
+	t.Helper()
+
+	clientData := a.clientData(t, "webauthn.get", challenge)
+	authenticatorData := a.authenticatorData(0x05, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]any{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(userHandle),
+	})
+}
+
+func (a *testAuthenticator) credential(t *testing.T, response map[string]any) []byte {
+	t.Helper()
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, err := json.Marshal(map[string]any{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func newTestWebAuthn(t *testing.T) *webauthn.WebAuthn {
+	t.Helper()
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "Example",
+		RPOrigins:     []string{testRPOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wa
+}
+
+// newTestContext returns a context for a request with the given body and cookies
+func newTestContext(body []byte, cookies ...*http.Cookie) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func responseCookie(t *testing.T, rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	t.Fatalf("cookie %s was not set", name)
+	return nil
+}
+
+// registerTestPasskey registers the authenticator for the user
+func registerTestPasskey(t *testing.T, db *gorm.DB, wa *webauthn.WebAuthn, authenticator *testAuthenticator, userID uint) *utilitymodels.WebAuthnCredential {
+	t.Helper()
+
+	c, rec := newTestContext(nil)
+	creation, err := BeginPasskeyRegistration(db, wa, c, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ = newTestContext(authenticator.register(t, creation.Response.Challenge), responseCookie(t, rec, webAuthnCeremonyCookie))
+	credential, err := FinishPasskeyRegistration(db, wa, c, userID, "Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credential
+}
+
+// loginTestPasskey finishes a passkey login with the authenticator
+func loginTestPasskey(t *testing.T, db *gorm.DB, wa *webauthn.WebAuthn, authenticator *testAuthenticator, userID uint) (*utilitymodels.LocalUser, error) {
+	t.Helper()
+
+	c, rec := newTestContext(nil)
+	assertion, err := BeginPasskeyLogin(db, wa, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userHandle := binary.BigEndian.AppendUint64(nil, uint64(userID))
+	c, _ = newTestContext(authenticator.assert(t, assertion.Response.Challenge, userHandle), responseCookie(t, rec, webAuthnCeremonyCookie))
+	return FinishPasskeyLogin(db, wa, c)
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	wa := newTestWebAuthn(t)
+	u := createTestLocalUser(t, db, "alice")
+	authenticator := newTestAuthenticator(t)
+
+	credential := registerTestPasskey(t, db, wa, authenticator, u.ID)
+	if credential.LocalUserID != u.ID || !bytes.Equal(credential.CredentialID, authenticator.credentialID) ||
+		credential.Name != "Laptop" || credential.Transport != "internal" || !credential.UserVerified {
+		t.Fatalf("unexpected credential %+v", credential)
+	}
+
+	authenticator.signCount = 5
+	loggedIn, err := loginTestPasskey(t, db, wa, authenticator, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loggedIn.ID != u.ID {
+		t.Fatalf("expected user %d, got %d", u.ID, loggedIn.ID)
+	}
+
+	passkeys, err := GetPasskeys(db, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 || passkeys[0].SignCount != 5 || !passkeys[0].LastUsedAt.Valid {
+		t.Fatalf("expected sign count and last use to be updated, got %+v", passkeys)
+	}
+
+	// A decreasing sign count indicates a cloned authenticator
+	authenticator.signCount = 3
+	if _, err := loginTestPasskey(t, db, wa, authenticator, u.ID); !errors.Is(err, ErrWebAuthnCloneWarning) {
+		t.Fatalf("expected %v, got %v", ErrWebAuthnCloneWarning, err)
+	}
+
+	if err := DeletePasskey(db, u.ID, credential.ID); err != nil {
+		t.Fatal(err)
+	}
+	authenticator.signCount = 6
+	if _, err := loginTestPasskey(t, db, wa, authenticator, u.ID); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+	}
+}
+
+func TestPasskeyLoginFailures(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	wa := newTestWebAuthn(t)
+	alice := createTestLocalUser(t, db, "alice")
+	bob := createTestLocalUser(t, db, "bob")
+	authenticator := newTestAuthenticator(t)
+	registerTestPasskey(t, db, wa, authenticator, alice.ID)
+
+	// The passkey of alice can't be used for bob
+	if _, err := loginTestPasskey(t, db, wa, authenticator, bob.ID); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+	}
+
+	// The response of another origin is rejected
+	authenticator.origin = "https://attacker.example"
+	if _, err := loginTestPasskey(t, db, wa, authenticator, alice.ID); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected %v, got %v", ErrAuthenticationFailed, err)
+	}
+	authenticator.origin = testRPOrigin
+
+	// A ceremony can only be finished once
+	c, rec := newTestContext(nil)
+	assertion, err := BeginPasskeyLogin(db, wa, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := responseCookie(t, rec, webAuthnCeremonyCookie)
+	userHandle := binary.BigEndian.AppendUint64(nil, uint64(alice.ID))
+
+	authenticator.signCount = 1
+	c, _ = newTestContext(authenticator.assert(t, assertion.Response.Challenge, userHandle), cookie)
+	if _, err := FinishPasskeyLogin(db, wa, c); err != nil {
+		t.Fatal(err)
+	}
+	authenticator.signCount = 2
+	c, _ = newTestContext(authenticator.assert(t, assertion.Response.Challenge, userHandle), cookie)
+	if _, err := FinishPasskeyLogin(db, wa, c); !errors.Is(err, ErrWebAuthnCeremonyMissing) {
+		t.Fatalf("expected %v, got %v", ErrWebAuthnCeremonyMissing, err)
+	}
+
+	c, _ = newTestContext(nil)
+	if _, err := FinishPasskeyLogin(db, wa, c); !errors.Is(err, ErrWebAuthnCeremonyMissing) {
+		t.Fatalf("expected %v, got %v", ErrWebAuthnCeremonyMissing, err)
+	}
+}
+
+func TestWebAuthnCeremonyCleanup(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	wa := newTestWebAuthn(t)
+	u := createTestLocalUser(t, db, "alice")
+
+	expired := utilitymodels.WebAuthnCeremony{CeremonyID: "expired", Data: "{}", ValidUntil: time.Now().UTC().Add(-time.Minute)}
+	if err := db.Create(&expired).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired ceremony can't be finished
+	c, _ := newTestContext(nil, &http.Cookie{Name: webAuthnCeremonyCookie, Value: expired.CeremonyID})
+	if _, err := FinishPasskeyLogin(db, wa, c); !errors.Is(err, ErrWebAuthnCeremonyMissing) {
+		t.Fatalf("expected %v, got %v", ErrWebAuthnCeremonyMissing, err)
+	}
+
+	// Finishing any ceremony deletes the expired ones
+	expired.ID = 0
+	expired.CeremonyID = "expired-again"
+	if err := db.Create(&expired).Error; err != nil {
+		t.Fatal(err)
+	}
+	registerTestPasskey(t, db, wa, newTestAuthenticator(t), u.ID)
+
+	var count int64
+	db.Model(&utilitymodels.WebAuthnCeremony{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected all ceremonies to be deleted, got %d", count)
+	}
+}
@@ -3,8 +3,9 @@ package database
 import (
 	"os"
 
+	"github.com/obaraelijah/echo-tools/hashing"
+	"github.com/obaraelijah/echo-tools/policy"
 	"github.com/obaraelijah/echo-tools/utilitymodels"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -19,6 +20,20 @@ func Initialize(dial gorm.Dialector, models ...interface{}) *gorm.DB {
 	models = append(models, &utilitymodels.LDAPUser{})
 	models = append(models, &utilitymodels.LDAPProvider{})
 	models = append(models, &utilitymodels.Session{})
+	models = append(models, &utilitymodels.RecoveryCode{})
+	models = append(models, &utilitymodels.WebAuthnCredential{})
+	models = append(models, &utilitymodels.WebAuthnCeremony{})
+	models = append(models, &utilitymodels.OIDCProvider{})
+	models = append(models, &utilitymodels.OIDCUser{})
+	models = append(models, &utilitymodels.OIDCAuthRequest{})
+	models = append(models, &utilitymodels.PasswordHistory{})
+	models = append(models, &utilitymodels.PasswordResetToken{})
+	models = append(models, &utilitymodels.LoginAttempt{})
+	models = append(models, &utilitymodels.APIToken{})
+	models = append(models, &utilitymodels.SessionRevocation{})
+	models = append(models, &utilitymodels.RememberToken{})
+	models = append(models, &utilitymodels.ImpersonationLog{})
+	models = append(models, &utilitymodels.SessionLock{})
 
 	// Migrate
 	if err := conn.AutoMigrate(
@@ -30,9 +45,17 @@ func Initialize(dial gorm.Dialector, models ...interface{}) *gorm.DB {
 	return conn
 }
 
-// CreateLocalUser Helper method to create a user. bcrypt with a cost of 12 is used as hash.
+// CreateLocalUser Helper method to create a user. The password is hashed with the default hasher of
+// hashing, which is bcrypt with a cost of 12 unless changed with hashing.SetDefaultHasher.
+// The password has to fulfill the default policy of the policy package, else a *policy.ViolationError is returned.
 func CreateLocalUser(db *gorm.DB, username string, password string, email *string) (*utilitymodels.LocalUser, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if passwordPolicy := policy.GetDefaultPolicy(); passwordPolicy != nil {
+		if err := passwordPolicy.Check(password, username, email); err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := hashing.Hash(password)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +63,7 @@ func CreateLocalUser(db *gorm.DB, username string, password string, email *strin
 	u := utilitymodels.LocalUser{
 		Username: username,
 		Email:    email,
-		Password: string(hash),
+		Password: hash,
 	}
 	if err := db.Create(&u).Error; err != nil {
 		return nil, err
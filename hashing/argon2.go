@@ -0,0 +1,141 @@
+package hashing
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Config Parameters of argon2id.
+// Parameter Memory in KiB, defaults to 64 * 1024.
+// Parameter Iterations defaults to 3.
+// Parameter Parallelism defaults to 4.
+// Parameter SaltLength in bytes, defaults to 16.
+// Parameter KeyLength in bytes, defaults to 32.
+type Argon2Config struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idHasher struct {
+	config Argon2Config
+}
+
+// argon2idParams are the parameters encoded in a hash
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// NewArgon2idHasher creates a PasswordHasher using argon2id. Pass nil to use the default parameters.
+// Hashes are stored in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func NewArgon2idHasher(config *Argon2Config) PasswordHasher {
+	c := Argon2Config{}
+	if config != nil {
+		c = *config
+	}
+	if c.Memory == 0 {
+		c.Memory = 64 * 1024
+	}
+	if c.Iterations == 0 {
+		c.Iterations = 3
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = 4
+	}
+	if c.SaltLength == 0 {
+		c.SaltLength = 16
+	}
+	if c.KeyLength == 0 {
+		c.KeyLength = 32
+	}
+	return &argon2idHasher{config: c}
+}
+
+func (a *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.config.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.config.Iterations, a.config.Memory, a.config.Parallelism, a.config.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		a.config.Memory,
+		a.config.Iterations,
+		a.config.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a *argon2idHasher) Verify(encoded string, password string) (bool, error) {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (a *argon2idHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.memory < a.config.Memory ||
+		params.iterations < a.config.Iterations ||
+		params.parallelism != a.config.Parallelism ||
+		uint32(len(params.salt)) < a.config.SaltLength ||
+		uint32(len(params.key)) < a.config.KeyLength
+}
+
+func decodeArgon2id(encoded string) (*argon2idParams, error) {
+	// The first part is empty, as the hash starts with $
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrInvalidHash
+	}
+
+	var params argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		return nil, ErrInvalidHash
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(params.key) == 0 {
+		return nil, ErrInvalidHash
+	}
+
+	return &params, nil
+}
@@ -0,0 +1,111 @@
+package hashing
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrUnknownHashFormat = errors.New("unknown hash format")
+	ErrInvalidHash       = errors.New("hash is malformed")
+)
+
+// PasswordHasher is implemented by every supported password hashing algorithm.
+// Encoded hashes identify their algorithm by their prefix: argon2id uses the PHC string format,
+// bcrypt keeps its modular crypt format, so existing bcrypt hashes stay valid.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password including algorithm, parameters and salt
+	Hash(password string) (string, error)
+	// Verify returns true if the password matches the encoded hash
+	Verify(encoded string, password string) (bool, error)
+	// Supports returns true if the encoded hash was created by this algorithm
+	Supports(encoded string) bool
+	// NeedsRehash returns true if the encoded hash was created with weaker parameters than configured
+	NeedsRehash(encoded string) bool
+}
+
+// dummyPassword is hashed for DummyVerify
+const dummyPassword = "Deny username enumeration"
+
+var (
+	lock          sync.RWMutex
+	defaultHasher PasswordHasher = NewBcryptHasher(12)
+	// dummyHash is the hash of dummyPassword by the default hasher, precomputed for the initial one
+	dummyHash = "$2a$12$2C9EdR2B4.XYm6I/Ur23IOGv6EhvPaHqsf1LuocW5IVjPY3Ta2lga"
+)
+
+// knownHashers are used to verify hashes which were not created by the default hasher.
+// The parameters of these are irrelevant, as they are read from the encoded hash.
+var knownHashers = []PasswordHasher{
+	NewBcryptHasher(12),
+	NewArgon2idHasher(nil),
+}
+
+// SetDefaultHasher sets the hasher used for new hashes. Hashes of other algorithms, or with outdated parameters,
+// are still accepted by Verify, but reported as in need of a rehash. Defaults to bcrypt with a cost of 12.
+// The hash used by DummyVerify is computed here, so call it during startup.
+func SetDefaultHasher(h PasswordHasher) {
+	if h == nil {
+		panic("hasher must not be nil")
+	}
+
+	hash, err := h.Hash(dummyPassword)
+	if err != nil {
+		panic("hasher can't hash: " + err.Error())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	defaultHasher = h
+	dummyHash = hash
+}
+
+// Hash hashes the password with the default hasher
+func Hash(password string) (string, error) {
+	lock.RLock()
+	h := defaultHasher
+	lock.RUnlock()
+
+	return h.Hash(password)
+}
+
+// Verify checks the password against an encoded hash of any known algorithm.
+// needsRehash is true if the password matched, but the hash wasn't created by the default hasher
+// with its current parameters.
+func Verify(encoded string, password string) (ok bool, needsRehash bool, err error) {
+	lock.RLock()
+	h := defaultHasher
+	lock.RUnlock()
+
+	var verifier PasswordHasher
+	if h.Supports(encoded) {
+		verifier = h
+	} else {
+		for _, known := range knownHashers {
+			if known.Supports(encoded) {
+				verifier = known
+				break
+			}
+		}
+	}
+	if verifier == nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	ok, err = verifier.Verify(encoded, password)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	return true, !h.Supports(encoded) || h.NeedsRehash(encoded), nil
+}
+
+// DummyVerify takes roughly as long as Verify with a hash of the default hasher. Use it if there is no hash
+// to compare against, to deny username enumeration by looking at the time a request took.
+func DummyVerify(password string) {
+	lock.RLock()
+	h, hash := defaultHasher, dummyHash
+	lock.RUnlock()
+
+	h.Verify(hash, password)
+}
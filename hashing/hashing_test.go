@@ -0,0 +1,171 @@
+package hashing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Config keeps the tests fast, it is far too weak for production
+var testArgon2Config = Argon2Config{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func setTestDefaultHasher(t *testing.T, h PasswordHasher) {
+	t.Helper()
+
+	lock.RLock()
+	previous, previousDummyHash := defaultHasher, dummyHash
+	lock.RUnlock()
+
+	SetDefaultHasher(h)
+	t.Cleanup(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		defaultHasher, dummyHash = previous, previousDummyHash
+	})
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	config := testArgon2Config
+	h := NewArgon2idHasher(&config)
+
+	encoded, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") || strings.Count(encoded, "$") != 5 {
+		t.Fatalf("expected a PHC string, got %s", encoded)
+	}
+	if !h.Supports(encoded) || NewBcryptHasher(bcrypt.MinCost).Supports(encoded) {
+		t.Fatal("expected the hash to be identified as argon2id")
+	}
+
+	if ok, err := h.Verify(encoded, "secret"); err != nil || !ok {
+		t.Fatalf("expected the password to match, got %t, %v", ok, err)
+	}
+	if ok, err := h.Verify(encoded, "wrong"); err != nil || ok {
+		t.Fatalf("expected the password not to match, got %t, %v", ok, err)
+	}
+
+	// The parameters are read from the hash, not from the config of the hasher
+	if ok, err := NewArgon2idHasher(nil).Verify(encoded, "secret"); err != nil || !ok {
+		t.Fatalf("expected the password to match, got %t, %v", ok, err)
+	}
+
+	// The same password gets a different salt
+	if other, _ := h.Hash("secret"); other == encoded {
+		t.Fatal("expected a random salt")
+	}
+}
+
+func TestArgon2idMalformedHash(t *testing.T) {
+	h := NewArgon2idHasher(nil)
+
+	for _, encoded := range []string{
+		"",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+	} {
+		if _, err := h.Verify(encoded, "secret"); !errors.Is(err, ErrInvalidHash) {
+			t.Fatalf("expected %v for %q, got %v", ErrInvalidHash, encoded, err)
+		}
+		if !h.NeedsRehash(encoded) {
+			t.Fatalf("expected %q to need a rehash", encoded)
+		}
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	config := testArgon2Config
+	encoded, err := NewArgon2idHasher(&config).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if NewArgon2idHasher(&config).NeedsRehash(encoded) {
+		t.Fatal("expected no rehash with the same parameters")
+	}
+
+	for name, changed := range map[string]Argon2Config{
+		"memory":      {Memory: 2048, Iterations: 1, Parallelism: 1},
+		"iterations":  {Memory: 1024, Iterations: 2, Parallelism: 1},
+		"parallelism": {Memory: 1024, Iterations: 1, Parallelism: 2},
+		"salt":        {Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 32},
+		"key":         {Memory: 1024, Iterations: 1, Parallelism: 1, KeyLength: 64},
+	} {
+		if !NewArgon2idHasher(&changed).NeedsRehash(encoded) {
+			t.Fatalf("expected a rehash after changing the %s", name)
+		}
+	}
+
+	// Weaker parameters don't require a rehash, except for the parallelism
+	weaker := Argon2Config{Memory: 512, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16}
+	if NewArgon2idHasher(&weaker).NeedsRehash(encoded) {
+		t.Fatal("expected no rehash with weaker parameters")
+	}
+}
+
+func TestBcryptNeedsRehash(t *testing.T) {
+	encoded, err := NewBcryptHasher(bcrypt.MinCost).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if NewBcryptHasher(bcrypt.MinCost).NeedsRehash(encoded) {
+		t.Fatal("expected no rehash with the same cost")
+	}
+	if !NewBcryptHasher(bcrypt.MinCost + 1).NeedsRehash(encoded) {
+		t.Fatal("expected a rehash with a higher cost")
+	}
+}
+
+func TestVerifyFallback(t *testing.T) {
+	config := testArgon2Config
+	setTestDefaultHasher(t, NewArgon2idHasher(&config))
+
+	// bcrypt hashes created before the default hasher was changed are still accepted
+	legacy, err := NewBcryptHasher(bcrypt.MinCost).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, needsRehash, err := Verify(legacy, "secret"); err != nil || !ok || !needsRehash {
+		t.Fatalf("expected the bcrypt hash to match and need a rehash, got %t, %t, %v", ok, needsRehash, err)
+	}
+	if ok, needsRehash, err := Verify(legacy, "wrong"); err != nil || ok || needsRehash {
+		t.Fatalf("expected the password not to match, got %t, %t, %v", ok, needsRehash, err)
+	}
+
+	current, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(current, "$argon2id$") {
+		t.Fatalf("expected the default hasher to be used, got %s", current)
+	}
+	if ok, needsRehash, err := Verify(current, "secret"); err != nil || !ok || needsRehash {
+		t.Fatalf("expected the hash to match without rehash, got %t, %t, %v", ok, needsRehash, err)
+	}
+
+	if _, _, err := Verify("plaintext", "plaintext"); !errors.Is(err, ErrUnknownHashFormat) {
+		t.Fatalf("expected %v, got %v", ErrUnknownHashFormat, err)
+	}
+}
+
+func TestSetDefaultHasherDummyHash(t *testing.T) {
+	config := testArgon2Config
+	setTestDefaultHasher(t, NewArgon2idHasher(&config))
+
+	lock.RLock()
+	hash := dummyHash
+	lock.RUnlock()
+
+	if ok, _, err := Verify(hash, dummyPassword); err != nil || !ok || !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("expected the dummy hash to be created by the default hasher, got %s, %v", hash, err)
+	}
+	DummyVerify("secret")
+}
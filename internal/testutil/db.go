@@ -0,0 +1,24 @@
+// Package testutil contains helpers shared by the tests of this module
+package testutil
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/obaraelijah/echo-tools/database"
+	"gorm.io/gorm"
+)
+
+// OpenTestDB returns a migrated SQLite database, which is removed after the test
+func OpenTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := database.Initialize(sqlite.Open(filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)"))
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
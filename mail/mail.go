@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidHeader    = errors.New("header must not contain line breaks")
+	ErrAuthNotSupported = errors.New("smtp server doesn't support authentication")
+)
+
+// Mailer is used to send mails to users, e.g. for email verification
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// Message is a mail sent through a MemoryMailer
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer keeps all mails in memory instead of sending them. Intended for tests.
+type MemoryMailer struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	if err := checkHeaders(to, subject); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = append(m.messages, Message{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Messages returns all mails sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+func checkHeaders(headers ...string) error {
+	for _, h := range headers {
+		if strings.ContainsAny(h, "\r\n") {
+			return ErrInvalidHeader
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSMTPMail is a mail received by the testSMTPServer
+type testSMTPMail struct {
+	from string
+	to   []string
+	auth string
+	data string
+}
+
+// testSMTPServer is a minimal SMTP server accepting every mail, unless a recipient is rejected
+type testSMTPServer struct {
+	listener net.Listener
+	// rejected recipients are answered with 550
+	rejected map[string]bool
+
+	lock  sync.Mutex
+	mails []testSMTPMail
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSMTPServer{listener: listener, rejected: make(map[string]bool)}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *testSMTPServer) port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (server *testSMTPServer) received() []testSMTPMail {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]testSMTPMail(nil), server.mails...)
+}
+
+func (server *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	var mail testSMTPMail
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250-8BITMIME")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(argument, "PLAIN "))
+			mail.auth = string(credentials)
+			text.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			mail.from = testSMTPAddress(argument)
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			to := testSMTPAddress(argument)
+			if server.rejected[to] {
+				text.PrintfLine("550 5.1.1 Mailbox unavailable")
+				continue
+			}
+			mail.to = append(mail.to, to)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			server.lock.Lock()
+			server.mails = append(server.mails, mail)
+			server.lock.Unlock()
+			mail = testSMTPMail{}
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// testSMTPAddress returns the address of a MAIL or RCPT argument, e.g. FROM:<alice@example.org> BODY=8BITMIME
+func testSMTPAddress(argument string) string {
+	_, address, _ := strings.Cut(argument, "<")
+	address, _, _ = strings.Cut(address, ">")
+	return address
+}
+
+// parseTestMail splits the received data in headers and body
+func parseTestMail(t *testing.T, data string) (textproto.MIMEHeader, string) {
+	t.Helper()
+
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := strings.Cut(data, "\n\n")
+	return header, body
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newTestSMTPServer(t)
+	mailer := NewSMTPMailer(&SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.org"})
+
+	if err := mailer.Send("alice@example.org", "Verify your email ✓", "Hello Alice,\r\nplease verify.\n.\nBye"); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := server.received()
+	if len(mails) != 1 {
+		t.Fatalf("expected one mail, got %d", len(mails))
+	}
+	received := mails[0]
+	if received.from != "noreply@example.org" || len(received.to) != 1 || received.to[0] != "alice@example.org" || received.auth != "" {
+		t.Fatalf("unexpected envelope %+v", received)
+	}
+
+	header, body := parseTestMail(t, received.data)
+	if header.Get("From") != "noreply@example.org" || header.Get("To") != "alice@example.org" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+	if header.Get("Subject") != "=?utf-8?q?Verify_your_email_=E2=9C=93?=" {
+		t.Fatalf("unexpected subject %q", header.Get("Subject"))
+	}
+	if header.Get("Content-Type") != "text/plain; charset=utf-8" || header.Get("Date") == "" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+	// The line endings were normalized and the lone dot was transmitted transparently
+	if body != "Hello Alice,\nplease verify.\n.\nBye\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestSMTPMailerAuth(t *testing.T) {
+	server := newTestSMTPServer(t)
+
+	// net/smtp only sends credentials without TLS to localhost
+	mailer := NewSMTPMailer(&SMTPConfig{
+		Host:     "localhost",
+		Port:     server.port(),
+		Username: "mailer",
+		Password: "secret",
+		From:     "noreply@example.org",
+	})
+	if err := mailer.Send("alice@example.org", "Subject", "Body"); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := server.received()
+	if len(mails) != 1 || mails[0].auth != "\x00mailer\x00secret" {
+		t.Fatalf("expected PLAIN authentication, got %+v", mails)
+	}
+}
+
+func TestSMTPMailerErrors(t *testing.T) {
+	server := newTestSMTPServer(t)
+	server.rejected["unknown@example.org"] = true
+	mailer := NewSMTPMailer(&SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.org"})
+
+	var smtpErr *textproto.Error
+	if err := mailer.Send("unknown@example.org", "Subject", "Body"); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("expected the rejection of the server, got %v", err)
+	}
+
+	if err := mailer.Send("alice@example.org\r\nBcc: bob@example.org", "Subject", "Body"); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+	}
+	if err := mailer.Send("alice@example.org", "Subject\nBcc: bob@example.org", "Body"); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+	}
+	if mails := server.received(); len(mails) != 0 {
+		t.Fatalf("expected no mail to be sent, got %d", len(mails))
+	}
+
+	// Nothing listens on the port of the closed server
+	server.listener.Close()
+	closed := NewSMTPMailer(&SMTPConfig{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.org"})
+	if err := closed.Send("alice@example.org", "Subject", "Body"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSMTPMailerTimeout(t *testing.T) {
+	// The server accepts connections, but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	mailer := NewSMTPMailer(&SMTPConfig{
+		Host:    "127.0.0.1",
+		Port:    listener.Addr().(*net.TCPAddr).Port,
+		From:    "noreply@example.org",
+		Timeout: 100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	var netErr net.Error
+	if err := mailer.Send("alice@example.org", "Subject", "Body"); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the send to time out, took %v", elapsed)
+	}
+	(<-accepted).Close()
+}
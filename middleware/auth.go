@@ -1,9 +1,7 @@
 package middleware
 
 import (
-	"crypto/rand"
 	"errors"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -13,9 +11,12 @@ import (
 )
 
 var (
-	ErrDatabaseError         = errors.New("there was a problem updating the database")
-	ErrCookieNotFound        = errors.New("cookie is missing")
-	ErrSessionContextMissing = errors.New("session context is missing")
+	ErrDatabaseError          = errors.New("there was a problem updating the database")
+	ErrCookieNotFound         = errors.New("cookie is missing")
+	ErrSessionContextMissing  = errors.New("session context is missing")
+	ErrSecondFactorNotPending = errors.New("no second factor is pending for this session")
+	ErrEmailNotVerified       = errors.New("email is not verified")
+	ErrNotAuthenticated       = errors.New("request is not authenticated")
 )
 
 // GetSessionContext returns a SessionContext from a Context
@@ -33,81 +34,207 @@ type IdentifiedAuthModel interface {
 	UpdateLastLogin(c echo.Context, db *gorm.DB, loginTime time.Time)
 }
 
+// SecondFactorAuthModel can be implemented by an IdentifiedAuthModel to require a second factor.
+// If RequiresSecondFactor returns true, Login creates a session whose second factor is pending.
+// Call CompleteSecondFactor once the second factor was verified.
+type SecondFactorAuthModel interface {
+	RequiresSecondFactor() bool
+}
+
+// EmailVerifiableAuthModel can be implemented by a user model to be refused by Login and LoginRequired
+// as long as IsEmailVerified returns false. Only used if SessionConfig.RequireVerifiedEmail is set.
+type EmailVerifiableAuthModel interface {
+	IsEmailVerified() bool
+}
+
+// isEmailVerificationMissing returns true if the config requires a verified email and the user has none
+func isEmailVerificationMissing(config *SessionConfig, user any) bool {
+	if !config.RequireVerifiedEmail {
+		return false
+	}
+	model, ok := user.(EmailVerifiableAuthModel)
+	return ok && !model.IsEmailVerified()
+}
+
 // Login This method is used to log a user in. auth.Authenticate has to be called before.
 // A cookie is set if the user can be logged in.
+// The SessionManager of the Session middleware, which handled the request, is used, including its database.
+// Parameter db is unused, it is kept for compatibility.
 // Parameter user: Can be retrieved by auth.Authenticate.
 // Parameter c: Pointer to the current context. Must implement middleware.SessionContext
-// Parameter config: Refer to SessionConfig.
 // Parameter isSessionCookie: Sets a session cookie if true, else a persistent cookie will be set.
 func Login(db *gorm.DB, model IdentifiedAuthModel, c echo.Context, isSessionCookie bool) error {
-	context := c.Get("SessionContext").(SessionContext)
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().Login(model, c, isSessionCookie)
+}
+
+// Login logs the user in, see the package function Login. The request must have been handled by the middleware
+// of this manager, else ErrSessionContextMissing is returned.
+func (m *SessionManager) Login(model IdentifiedAuthModel, c echo.Context, isSessionCookie bool) error {
+	context, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	if isEmailVerificationMissing(context.GetSessionConfig(), model) {
+		return ErrEmailNotVerified
+	}
 
 	// Couldn't find session with the current user associated
 	authKey, authID := model.GetAuthModelIdentifier()
-	session := utilitymodels.Session{
+	session, err := newSession(c, m.config, authKey, authID, !isSessionCookie)
+	if err != nil {
+		return err
+	}
+	if sf, ok := model.(SecondFactorAuthModel); ok && sf.RequiresSecondFactor() {
+		session.SecondFactorPending = true
+	}
+
+	// Values of the previous session, e.g. of an anonymous visitor, are kept
+	data, err := context.encodeData()
+	if err != nil {
+		return err
+	}
+	session.Data = data
+
+	if err := m.startSession(c, context, session, true); err != nil {
+		return err
+	}
+
+	model.UpdateLastLogin(c, m.db, session.CreatedAt)
+	return nil
+}
+
+// newSession returns a session of the given user, which starts now
+func newSession(c echo.Context, config *SessionConfig, authKey string, authID uint, persistent bool) (*utilitymodels.Session, error) {
+	now := time.Now().UTC()
+	publicID, err := generatePublicSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &utilitymodels.Session{
 		AuthKey:    authKey,
 		AuthID:     authID,
-		ValidUntil: time.Now().UTC().Add(*context.GetSessionConfig().CookieAge),
+		ValidUntil: sessionValidUntil(config, now, now),
+		Persistent: persistent,
+		PublicID:   publicID,
+		IP:         c.RealIP(),
+		UserAgent:  c.Request().UserAgent(),
+		LastSeenAt: now,
 	}
+	session.CreatedAt = now
+	return session, nil
+}
 
-	// Generation of session id
-	var count int64
-	r := make([]byte, 64)
-	for {
-		if _, err := rand.Read(r); err != nil {
-			c.Logger().Error("Error while generating random numbers")
-			continue
+// startSession saves the session, sets its cookie and makes it the session of the current request.
+// If limited is set, SessionConfig.MaxSessions is enforced.
+func (m *SessionManager) startSession(c echo.Context, context SessionContext, session *utilitymodels.Session, limited bool) error {
+	config := m.config
+	if config.Stateless != nil {
+		revision, err := config.Stateless.Revocations.GetRevision(session.AuthKey, session.AuthID)
+		if err != nil {
+			c.Logger().Errorf("Error retrieving session revision: %s", err.Error())
+			return ErrDatabaseError
 		}
-		sessionID := fmt.Sprintf("%x", r)
-		db.Find(&utilitymodels.Session{}, "session_id = ?", sessionID).Count(&count)
-		if count == 0 {
-			session.SessionID = sessionID
-			break
+
+		p, err := newStatelessSession(session, revision)
+		if err != nil {
+			return err
 		}
-		c.Logger().Debugf("Generated session_id already in database, regenerating ..")
+		if err := issueStatelessSession(c, config, p); err != nil {
+			return err
+		}
+
+		context.setStatelessSession(p)
+		return nil
 	}
 
-	if err := db.Create(&session).Error; err != nil {
-		c.Logger().Errorf("Error saving session to database: %s", err.Error())
-		return ErrDatabaseError
-	} else {
-		now := time.Now().UTC()
-		model.UpdateLastLogin(c, db, now)
-
-		// Session was saved, we can set the cookie
-		cookie := &http.Cookie{
-			Name:     context.GetSessionConfig().CookieName,
-			Value:    session.SessionID,
-			Path:     context.GetSessionConfig().CookiePath,
-			Domain:   "", // Only allow current site
-			Secure:   *context.GetSessionConfig().Secure,
-			SameSite: http.SameSiteDefaultMode,
-		}
+	// The session the client had before is deleted, so a fixated session id can't be used anymore
+	var previousSessionIDs []string
+	if cookie, err := c.Cookie(config.CookieName); err == nil {
+		previousSessionIDs = storedSessionIDs(config, cookie.Value)
+	}
 
-		if !isSessionCookie {
-			cookie.MaxAge = int(context.GetSessionConfig().CookieAge.Seconds())
+	create := func(session *utilitymodels.Session) error {
+		for _, sessionID := range previousSessionIDs {
+			if err := config.Store.Delete(sessionID); err != nil {
+				c.Logger().Errorf("Error deleting previous session: %s", err.Error())
+				return err
+			}
 		}
+		return config.Store.Create(session)
+	}
+	if limited && config.MaxSessions > 0 {
+		// The previous session is only deleted, if the limit allows the new one
+		create = func(session *utilitymodels.Session) error {
+			return config.Store.CreateLimited(session, config.MaxSessions, config.SessionLimitPolicy == EvictOldestSession, previousSessionIDs...)
+		}
+	}
 
-		c.SetCookie(cookie)
+	// Generation of session id
+	rawSessionID, err := storeSession(c, config, session, create)
+	if errors.Is(err, ErrSessionLimitReached) {
+		return err
+	} else if err != nil {
+		c.Logger().Errorf("Error saving session to database: %s", err.Error())
+		return ErrDatabaseError
 	}
+
+	// Session was saved, we can set the cookie
+	setSessionCookie(c, config, rawSessionID, session)
+	context.setSession(session)
 	return nil
 }
 
 // Logout Helper method to logout and therefore invalidating a user's session. If the user isn't logged in,
-// nil is returned
+// ErrCookieNotFound is returned. For stateless sessions, all sessions of the user are revoked.
+// The SessionManager of the Session middleware, which handled the request, is used, including its database.
+// Parameter db is unused, it is kept for compatibility.
 func Logout(db *gorm.DB, c echo.Context) error {
-	sessionContext := c.Get("SessionContext").(SessionContext)
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().Logout(c)
+}
+
+// Logout logs the user out, see the package function Logout. The request must have been handled by the middleware
+// of this manager, else ErrSessionContextMissing is returned.
+func (m *SessionManager) Logout(c echo.Context) error {
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
 
 	// If user is not authenticated, there's nothing to do
-	if !sessionContext.IsAuthenticated() {
+	if !sessionContext.IsAuthenticated() && !sessionContext.IsSecondFactorPending() {
 		return ErrCookieNotFound
 	}
 
-	if err := db.Where("session_id = ?", *sessionContext.GetSessionID()).Delete(&utilitymodels.Session{}).Error; err != nil {
+	if p := sessionContext.getStatelessSession(); p != nil {
+		// A single stateless session can't be revoked, its cookie stays valid until it expires
+		if _, err := sessionContext.GetSessionConfig().Stateless.Revocations.Revoke(p.AuthKey, p.AuthID); err != nil {
+			c.Logger().Error(err.Error())
+			return ErrDatabaseError
+		}
+	} else if sessionContext.GetSessionID() == nil {
+		// Requests authenticated by an API token have no session, tokens are revoked with RevokeAPIToken
+		return ErrCookieNotFound
+	} else if err := sessionContext.GetSessionConfig().Store.Delete(*sessionContext.GetSessionID()); err != nil {
 		c.Logger().Error(err.Error())
 		return ErrDatabaseError
 	}
 
+	// The device must not be logged in again by its remember me token
+	if err := forgetRememberedDevice(m.db, c, m.config); err != nil {
+		c.Logger().Error(err.Error())
+		return err
+	}
+
 	c.SetCookie(&http.Cookie{
 		Name:   sessionContext.GetSessionConfig().CookieName,
 		Value:  "",
@@ -122,10 +249,96 @@ func Logout(db *gorm.DB, c echo.Context) error {
 	return nil
 }
 
-// InvalidateSessions Helper method to invalidate all sessions of a user
+// CompleteSecondFactor marks the second factor of the current session as verified and rotates the session id.
+// The caller is responsible for verifying the second factor before, see auth.VerifySecondFactor.
+// For stateless sessions, the previous cookie stays valid with the second factor still pending until it expires.
+// Returns ErrSecondFactorNotPending if the current session has no pending second factor.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func CompleteSecondFactor(db *gorm.DB, c echo.Context) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().CompleteSecondFactor(c)
+}
+
+// CompleteSecondFactor completes the second factor of the current session, see the package function
+// CompleteSecondFactor
+func (m *SessionManager) CompleteSecondFactor(c echo.Context) error {
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	if !sessionContext.IsSecondFactorPending() {
+		return ErrSecondFactorNotPending
+	}
+
+	if p := sessionContext.getStatelessSession(); p != nil {
+		completed, err := p.rotated()
+		if err != nil {
+			return err
+		}
+		completed.SecondFactorPending = false
+		if err := issueStatelessSession(c, sessionContext.GetSessionConfig(), completed); err != nil {
+			return err
+		}
+		sessionContext.setStatelessSession(completed)
+		return nil
+	}
+
+	config := sessionContext.GetSessionConfig()
+	session, err := config.Store.Get(*sessionContext.GetSessionID())
+	if err != nil {
+		c.Logger().Error(err.Error())
+		return ErrDatabaseError
+	}
+
+	// The privileges of the session change, so its id is rotated as well
+	session.SecondFactorPending = false
+	return rotateSession(c, sessionContext, session)
+}
+
+// InvalidateSessions Helper method to invalidate all sessions of a user, including the sessions in which the user
+// impersonates another user.
+// The SessionManager of the last constructed Session middleware is used. If the middleware wasn't constructed yet,
+// the sessions are deleted from db. Remember me tokens and API tokens of the user are deleted. If the middleware
+// uses stateless sessions, the revision of the user is incremented as well. Managers created with NewSessionManager
+// are not affected, call SessionManager.InvalidateSessions for each of them.
 func InvalidateSessions(db *gorm.DB, authID uint, authKey string) error {
-	if err := db.Where("auth_id = ? AND auth_key = ?", authID, authKey).Delete(&utilitymodels.Session{}).Error; err != nil {
+	if m := getDefaultManager(); m != nil {
+		return m.InvalidateSessions(authID, authKey)
+	}
+	return invalidateSessions(db, NewGormSessionStore(db), nil, authID, authKey)
+}
+
+// InvalidateSessions invalidates all sessions of a user, see the package function InvalidateSessions
+func (m *SessionManager) InvalidateSessions(authID uint, authKey string) error {
+	var revocations RevocationStore
+	if m.config.Stateless != nil {
+		revocations = m.config.Stateless.Revocations
+	}
+	return invalidateSessions(m.db, m.config.Store, revocations, authID, authKey)
+}
+
+func invalidateSessions(db *gorm.DB, store SessionStore, revocations RevocationStore, authID uint, authKey string) error {
+	if err := store.DeleteByAuth(authKey, authID); err != nil {
 		return ErrDatabaseError
 	}
+	if db != nil {
+		if err := db.Where("auth_id = ? AND auth_key = ?", authID, authKey).Delete(&utilitymodels.RememberToken{}).Error; err != nil {
+			return ErrDatabaseError
+		}
+		// API tokens would keep granting access to a user whose credentials may be compromised
+		if err := db.Where("auth_id = ? AND auth_key = ?", authID, authKey).Delete(&utilitymodels.APIToken{}).Error; err != nil {
+			return ErrDatabaseError
+		}
+	}
+	if revocations != nil {
+		if _, err := revocations.Revoke(authKey, authID); err != nil {
+			return ErrDatabaseError
+		}
+	}
 	return nil
 }
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrCSRFTokenInvalid = errors.New("csrf token is missing or invalid")
+)
+
+// CSRFConfig Set the parameters of the CSRF middleware.
+// Parameter HeaderName defaults to "X-CSRF-Token". Checked before FormField.
+// Parameter FormField defaults to "csrf_token".
+// Parameter CookieName defaults to "csrf_token". Used for the double-submit token of requests without session.
+// Parameter Secure defaults to true. If set, the double-submit cookie can only be sent through an HTTPS connection.
+// Parameter Secret defaults to random bytes. Tokens are signed with it, set it if tokens must survive a restart
+// or be accepted by multiple instances.
+// Parameter ErrorHandler defaults to a 403 response. Called with ErrCSRFTokenInvalid if the token was rejected.
+type CSRFConfig struct {
+	HeaderName   string
+	FormField    string
+	CookieName   string
+	Secure       *bool
+	Secret       []byte
+	ErrorHandler func(c echo.Context, err error) error
+}
+
+func (config *CSRFConfig) FixCSRFConfig() {
+	if config.HeaderName == "" {
+		config.HeaderName = "X-CSRF-Token"
+	}
+	if config.FormField == "" {
+		config.FormField = "csrf_token"
+	}
+	if config.CookieName == "" {
+		config.CookieName = "csrf_token"
+	}
+	if config.Secure == nil {
+		secure := true
+		config.Secure = &secure
+	}
+	if config.Secret == nil {
+		config.Secret = make([]byte, 32)
+		if _, err := rand.Read(config.Secret); err != nil {
+			panic("generating csrf secret failed")
+		}
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = func(c echo.Context, err error) error {
+			return c.JSON(403, struct{ Error string }{Error: "CSRF token invalid"})
+		}
+	}
+}
+
+// csrfState is stored in the context, so GetCSRFToken can derive the token of the current session
+type csrfState struct {
+	config      *CSRFConfig
+	doubleToken string
+}
+
+// CSRF Use as middleware after Session. Requests with an unsafe method must send the token of GetCSRFToken in the
+// header or form field. Requests with a session use a token bound to the session, which changes when the session id
+// changes. Requests without session use a signed double-submit cookie. Requests authenticated by an API token are exempt.
+func CSRF(config *CSRFConfig) echo.MiddlewareFunc {
+	if config == nil {
+		config = &CSRFConfig{}
+	}
+	config.FixCSRFConfig()
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			sessionContext, err := GetSessionContext(c)
+			if err != nil {
+				return err
+			}
+
+			state := &csrfState{config: config}
+			if cookie, err := c.Cookie(config.CookieName); err == nil && verifyCSRFDoubleToken(config, cookie.Value) {
+				state.doubleToken = cookie.Value
+			}
+			c.Set("CSRF", state)
+
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+				return next(c)
+			}
+
+			// Bearer tokens are not sent automatically by the browser
+			if sessionContext.IsTokenAuthenticated() {
+				return next(c)
+			}
+
+			submitted := c.Request().Header.Get(config.HeaderName)
+			if submitted == "" {
+				submitted = c.FormValue(config.FormField)
+			}
+
+			var expected string
+			if binding, ok := csrfSessionBinding(sessionContext); ok {
+				expected = signCSRF(config, binding)
+			} else {
+				expected = state.doubleToken
+			}
+
+			if expected == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(expected)) != 1 {
+				if !sessionContext.GetSessionConfig().DisableLogging {
+					c.Logger().Debugf("Rejected request with invalid csrf token")
+				}
+				return config.ErrorHandler(c, ErrCSRFTokenInvalid)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// GetCSRFToken Returns the token, which has to be sent with requests using an unsafe method.
+// Call it after Login, as the token of a session changes with its id. Requires CSRF as a middleware.
+func GetCSRFToken(c echo.Context) (string, error) {
+	state, ok := c.Get("CSRF").(*csrfState)
+	if !ok {
+		return "", ErrSessionContextMissing
+	}
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return "", err
+	}
+
+	if binding, ok := csrfSessionBinding(sessionContext); ok {
+		return signCSRF(state.config, binding), nil
+	}
+
+	if state.doubleToken == "" {
+		r := make([]byte, 32)
+		if _, err := rand.Read(r); err != nil {
+			return "", ErrRandomFailed
+		}
+		nonce := base64.RawURLEncoding.EncodeToString(r)
+		state.doubleToken = nonce + "." + signCSRF(state.config, "double:"+nonce)
+
+		c.SetCookie(&http.Cookie{
+			Name:     state.config.CookieName,
+			Value:    state.doubleToken,
+			Path:     "/",
+			Secure:   *state.config.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return state.doubleToken, nil
+}
+
+// csrfSessionBinding returns a value identifying the session of the request, if there is one
+func csrfSessionBinding(sessionContext SessionContext) (string, bool) {
+	if sessionID := sessionContext.GetSessionID(); sessionID != nil {
+		return "session:" + *sessionID, true
+	}
+	if p := sessionContext.getStatelessSession(); p != nil {
+		if p.Nonce != "" {
+			return "stateless:" + p.Nonce, true
+		}
+		// Cookies sealed before the nonce was introduced are bound to their user and login time
+		return fmt.Sprintf("stateless:%s:%d:%d", p.AuthKey, p.AuthID, p.CreatedAt), true
+	}
+	return "", false
+}
+
+func signCSRF(config *CSRFConfig, value string) string {
+	mac := hmac.New(sha256.New, config.Secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCSRFDoubleToken checks the signature of a double-submit token, so only tokens issued by GetCSRFToken are accepted
+func verifyCSRFDoubleToken(config *CSRFConfig, token string) bool {
+	nonce, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signCSRF(config, "double:"+nonce)))
+}
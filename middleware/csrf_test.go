@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// serveTestCSRF handles the request with the session middleware of m and the CSRF middleware and returns the
+// response. The cookies are added to the request, the cookies of the response are added to cookies.
+func serveTestCSRF(t *testing.T, m *SessionManager, config *CSRFConfig, req *http.Request, cookies map[string]*http.Cookie, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if err := m.Middleware()(CSRF(config)(handler))(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range rec.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return rec
+}
+
+// newTestCSRFRequest returns a POST request, which sends the token in the header or, if form is set, in the form field
+func newTestCSRFRequest(token string, form bool) *http.Request {
+	if form {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		return req
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if token != "" {
+		req.Header.Set("X-CSRF-Token", token)
+	}
+	return req
+}
+
+func newTestCSRFManager(t *testing.T, config *SessionConfig) *SessionManager {
+	t.Helper()
+
+	secure := false
+	config.Secure = &secure
+	config.Store = NewMemorySessionStore()
+	return NewSessionManager(testutil.OpenTestDB(t), config)
+}
+
+// getTestCSRFToken returns the token of GetCSRFToken for a GET request with the cookies
+func getTestCSRFToken(t *testing.T, m *SessionManager, config *CSRFConfig, cookies map[string]*http.Cookie) string {
+	t.Helper()
+
+	var token string
+	serveTestCSRF(t, m, config, httptest.NewRequest(http.MethodGet, "/", nil), cookies, func(c echo.Context) error {
+		var err error
+		token, err = GetCSRFToken(c)
+		return err
+	})
+	if token == "" {
+		t.Fatal("expected a csrf token")
+	}
+	return token
+}
+
+func assertTestCSRFStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func testOKHandler(c echo.Context) error {
+	return c.NoContent(http.StatusOK)
+}
+
+func TestCSRFSessionToken(t *testing.T) {
+	m := newTestCSRFManager(t, &SessionConfig{})
+	alice := createTestUser(t, m.db, "alice")
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(m.db))
+	config := &CSRFConfig{}
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(alice, c, true)
+	})
+	token := getTestCSRFToken(t, m, config, cookies)
+	if cookies["csrf_token"] != nil {
+		t.Fatal("expected no double-submit cookie for requests with a session")
+	}
+
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest("", false), cookies, testOKHandler), http.StatusForbidden)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest("invalid", false), cookies, testOKHandler), http.StatusForbidden)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, false), cookies, testOKHandler), http.StatusOK)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, true), cookies, testOKHandler), http.StatusOK)
+
+	// The token is bound to the session id
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.RotateSession(c)
+	})
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, false), cookies, testOKHandler), http.StatusForbidden)
+	if rotated := getTestCSRFToken(t, m, config, cookies); rotated == token {
+		t.Fatal("expected the token to change with the session id")
+	}
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	m := newTestCSRFManager(t, &SessionConfig{})
+	config := &CSRFConfig{}
+
+	// Safe methods don't require a token
+	cookies := map[string]*http.Cookie{}
+	token := getTestCSRFToken(t, m, config, cookies)
+	if cookies["csrf_token"] == nil || cookies["csrf_token"].Value != token {
+		t.Fatal("expected the token to be set as double-submit cookie")
+	}
+	if again := getTestCSRFToken(t, m, config, cookies); again != token {
+		t.Fatal("expected the token of the cookie to be reused")
+	}
+
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, false), cookies, testOKHandler), http.StatusOK)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, true), cookies, testOKHandler), http.StatusOK)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest("", false), cookies, testOKHandler), http.StatusForbidden)
+
+	// The cookie is required as well
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(token, false), map[string]*http.Cookie{}, testOKHandler), http.StatusForbidden)
+
+	// Cookies not signed with the secret, e.g. set by a sibling domain, are rejected
+	forged := "nonce.signature"
+	forgedCookies := map[string]*http.Cookie{"csrf_token": {Name: "csrf_token", Value: forged}}
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest(forged, false), forgedCookies, testOKHandler), http.StatusForbidden)
+	other := &CSRFConfig{}
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, other, newTestCSRFRequest(token, false), cookies, testOKHandler), http.StatusForbidden)
+}
+
+func TestCSRFAPITokenExempt(t *testing.T) {
+	m := newTestCSRFManager(t, &SessionConfig{AllowAPITokens: true})
+	alice := createTestUser(t, m.db, "alice")
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(m.db))
+	token, _ := createTestAPIToken(t, m.db, alice, nil, nil)
+	config := &CSRFConfig{}
+
+	req := newTestCSRFRequest("", false)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, req, map[string]*http.Cookie{}, testOKHandler), http.StatusOK)
+
+	// An invalid bearer token doesn't exempt the request
+	req = newTestCSRFRequest("", false)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer et_unknown")
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, req, map[string]*http.Cookie{}, testOKHandler), http.StatusForbidden)
+}
+
+func TestCSRFErrorHandler(t *testing.T) {
+	m := newTestCSRFManager(t, &SessionConfig{})
+
+	var handled error
+	config := &CSRFConfig{
+		ErrorHandler: func(c echo.Context, err error) error {
+			handled = err
+			return c.NoContent(http.StatusTeapot)
+		},
+	}
+
+	assertTestCSRFStatus(t, serveTestCSRF(t, m, config, newTestCSRFRequest("", false), map[string]*http.Cookie{}, testOKHandler), http.StatusTeapot)
+	if !errors.Is(handled, ErrCSRFTokenInvalid) {
+		t.Fatalf("expected %v, got %v", ErrCSRFTokenInvalid, handled)
+	}
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// flashKey is the reserved key of the flash messages in the values of a session
+const flashKey = "_flash"
+
+// Flash is a message, which is shown to the user once, e.g. after a redirect
+type Flash struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// GetValue decodes the value stored under key into value, which must be a pointer.
+// Returns false if there is no value with that key.
+func (s *s) GetValue(key string, value any) (bool, error) {
+	raw, exists := s.data[key]
+	if !exists {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetValue stores value under key. The value must be encodable as JSON.
+// The values are saved with the session before the response is written. If the request has no session,
+// e.g. for anonymous visitors, a new session is created. Requests authenticated by an API token can't store values.
+func (s *s) SetValue(key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if s.data == nil {
+		s.data = map[string]json.RawMessage{}
+	}
+	s.data[key] = raw
+	s.dataChanged = true
+	return nil
+}
+
+// DeleteValue removes the value stored under key
+func (s *s) DeleteValue(key string) {
+	if _, exists := s.data[key]; !exists {
+		return
+	}
+	delete(s.data, key)
+	s.dataChanged = true
+}
+
+func (s *s) loadData(data []byte) {
+	s.data = nil
+	s.dataChanged = false
+	if len(data) == 0 {
+		return
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		// Broken values shouldn't break the session
+		s.data = nil
+	}
+}
+
+func (s *s) encodeData() ([]byte, error) {
+	if len(s.data) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s.data)
+}
+
+// GetSessionValue Returns the value stored under key in the session of the current request.
+// Returns false if there is no value with that key.
+func GetSessionValue[T any](c echo.Context, key string) (T, bool, error) {
+	var value T
+
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return value, false, err
+	}
+
+	exists, err := sessionContext.GetValue(key, &value)
+	return value, exists, err
+}
+
+// AddFlash adds a message to the session, which is returned by the next call of GetFlashes
+func AddFlash(c echo.Context, category string, message string) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	var flashes []Flash
+	if _, err := sessionContext.GetValue(flashKey, &flashes); err != nil {
+		return err
+	}
+	flashes = append(flashes, Flash{Category: category, Message: message})
+	return sessionContext.SetValue(flashKey, flashes)
+}
+
+// GetFlashes Returns the flash messages of the session and removes them
+func GetFlashes(c echo.Context) ([]Flash, error) {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var flashes []Flash
+	if _, err := sessionContext.GetValue(flashKey, &flashes); err != nil {
+		return nil, err
+	}
+	sessionContext.DeleteValue(flashKey)
+	return flashes, nil
+}
+
+// saveSessionData saves changed values with the session of the request. Errors are only logged, as the response
+// is about to be written.
+func saveSessionData(c echo.Context, sessionContext *s) {
+	if !sessionContext.dataChanged || sessionContext.apiToken != nil {
+		return
+	}
+	sessionContext.dataChanged = false
+
+	config := sessionContext.sessionConfig
+	data, err := sessionContext.encodeData()
+	if err != nil {
+		c.Logger().Errorf("Error encoding session values: %s", err.Error())
+		return
+	}
+
+	if p := sessionContext.stateless; p != nil {
+		p.Data = data
+		if err := issueStatelessSession(c, config, p); err != nil {
+			c.Logger().Errorf("Error saving session values: %s", err.Error())
+		}
+		return
+	}
+
+	if sessionContext.sessionID == nil {
+		if data == nil {
+			return
+		}
+		createAnonymousSession(c, sessionContext, data)
+		return
+	}
+
+	session, err := config.Store.Get(*sessionContext.sessionID)
+	if err != nil {
+		c.Logger().Errorf("Error retrieving session: %s", err.Error())
+		return
+	}
+	session.Data = data
+	if err := config.Store.Update(session, "Data"); err != nil {
+		c.Logger().Errorf("Error saving session values: %s", err.Error())
+	}
+}
+
+// createAnonymousSession creates a session without user, which only carries values
+func createAnonymousSession(c echo.Context, sessionContext *s, data []byte) {
+	config := sessionContext.sessionConfig
+	now := time.Now().UTC()
+	session := utilitymodels.Session{
+		ValidUntil: sessionValidUntil(config, now, now),
+		Data:       data,
+		LastSeenAt: now,
+	}
+
+	if config.Stateless != nil {
+		session.CreatedAt = now
+		p, err := newStatelessSession(&session, 0)
+		if err != nil {
+			c.Logger().Errorf("Error saving session values: %s", err.Error())
+			return
+		}
+		if err := issueStatelessSession(c, config, p); err != nil {
+			c.Logger().Errorf("Error saving session values: %s", err.Error())
+			return
+		}
+		sessionContext.setStatelessSession(p)
+		return
+	}
+
+	rawSessionID, err := storeSession(c, config, &session, config.Store.Create)
+	if err != nil {
+		c.Logger().Errorf("Error saving session to database: %s", err.Error())
+		return
+	}
+	setSessionCookie(c, config, rawSessionID, &session)
+	sessionContext.setSession(&session)
+}
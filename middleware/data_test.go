@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+type testCart struct {
+	Items []string `json:"items"`
+}
+
+func newTestDataManager(t *testing.T) (*SessionManager, *gorm.DB) {
+	t.Helper()
+
+	db := testutil.OpenTestDB(t)
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	return m, db
+}
+
+// setTestSessionValue stores the value in a request with the cookies. The response has to be written for the
+// values to be saved.
+func setTestSessionValue(t *testing.T, m *SessionManager, cookies map[string]*http.Cookie, key string, value any) {
+	t.Helper()
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		sessionContext, _ := GetSessionContext(c)
+		if err := sessionContext.SetValue(key, value); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+func TestSessionValues(t *testing.T) {
+	m, _ := newTestDataManager(t)
+
+	// Anonymous visitors get a session carrying the values
+	cookies := map[string]*http.Cookie{}
+	setTestSessionValue(t, m, cookies, "cart", testCart{Items: []string{"apple"}})
+	if cookies["session_id"] == nil {
+		t.Fatal("expected a session cookie for the values")
+	}
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		cart, exists, err := GetSessionValue[testCart](c, "cart")
+		if err != nil || !exists || len(cart.Items) != 1 || cart.Items[0] != "apple" {
+			t.Fatalf("expected the stored cart, got %v, %t, %v", cart, exists, err)
+		}
+
+		if _, exists, err := GetSessionValue[string](c, "missing"); err != nil || exists {
+			t.Fatalf("expected no value, got %t, %v", exists, err)
+		}
+		if _, _, err := GetSessionValue[int](c, "cart"); err == nil {
+			t.Fatal("expected an error decoding the value into another type")
+		}
+
+		sessionContext, _ := GetSessionContext(c)
+		sessionContext.DeleteValue("cart")
+		return c.NoContent(http.StatusOK)
+	})
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if _, exists, err := GetSessionValue[testCart](c, "cart"); err != nil || exists {
+			t.Fatalf("expected the value to be deleted, got %t, %v", exists, err)
+		}
+		return nil
+	})
+}
+
+func TestSessionValuesNotSavedWithoutChange(t *testing.T) {
+	m, _ := newTestDataManager(t)
+
+	// Reading values doesn't create a session
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if _, exists, err := GetSessionValue[testCart](c, "cart"); err != nil || exists {
+			t.Fatalf("expected no value, got %t, %v", exists, err)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	if len(cookies) != 0 {
+		t.Fatalf("expected no cookies, got %v", cookies)
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	m, _ := newTestDataManager(t)
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := AddFlash(c, "info", "Saved"); err != nil {
+			return err
+		}
+		if err := AddFlash(c, "error", "Not sent"); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	// Flashes are returned once
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		flashes, err := GetFlashes(c)
+		if err != nil {
+			return err
+		}
+		if len(flashes) != 2 || flashes[0] != (Flash{Category: "info", Message: "Saved"}) ||
+			flashes[1] != (Flash{Category: "error", Message: "Not sent"}) {
+			t.Fatalf("unexpected flashes %v", flashes)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		flashes, err := GetFlashes(c)
+		if err != nil {
+			return err
+		}
+		if len(flashes) != 0 {
+			t.Fatalf("expected the flashes to be removed, got %v", flashes)
+		}
+		return nil
+	})
+}
+
+func TestSessionValuesCarriedIntoLogin(t *testing.T) {
+	m, db := newTestDataManager(t)
+	alice := createTestUser(t, db, "alice")
+
+	cookies := map[string]*http.Cookie{}
+	setTestSessionValue(t, m, cookies, "cart", testCart{Items: []string{"apple"}})
+	anonymousCookie := cookies["session_id"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := m.Login(alice, c, true); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	if cookies["session_id"].Value == anonymousCookie.Value {
+		t.Fatal("expected a new session id after the login")
+	}
+
+	assertTestUser(t, m, cookies, alice, nil)
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		cart, exists, err := GetSessionValue[testCart](c, "cart")
+		if err != nil || !exists || len(cart.Items) != 1 || cart.Items[0] != "apple" {
+			t.Fatalf("expected the cart to be carried into the login, got %v, %t, %v", cart, exists, err)
+		}
+		return nil
+	})
+
+	// The anonymous session was replaced
+	serveTestSession(t, m, map[string]*http.Cookie{"session_id": anonymousCookie}, func(c echo.Context) error {
+		if _, exists, err := GetSessionValue[testCart](c, "cart"); err != nil || exists {
+			t.Fatalf("expected the anonymous session to be deleted, got %t, %v", exists, err)
+		}
+		return nil
+	})
+}
+
+func TestSessionValuesMissingMiddleware(t *testing.T) {
+	c := echo.New().NewContext(nil, nil)
+	if _, _, err := GetSessionValue[string](c, "key"); !errors.Is(err, ErrSessionContextMissing) {
+		t.Fatalf("expected %v, got %v", ErrSessionContextMissing, err)
+	}
+}
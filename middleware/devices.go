@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// SessionInfo describes a session of the current user. The session id itself is never exposed,
+// the session is referenced by its PublicID instead.
+type SessionInfo struct {
+	PublicID    string    `json:"id"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	DeviceLabel string    `json:"device_label"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ValidUntil  time.Time `json:"valid_until"`
+	Current     bool      `json:"current"`
+	// Impersonated is true if the session was started by an admin with StartImpersonation
+	Impersonated bool `json:"impersonated"`
+}
+
+// GetSessions Returns all valid sessions of the current user.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func GetSessions(db *gorm.DB, c echo.Context) ([]SessionInfo, error) {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return nil, err
+	}
+	return sessionContext.getManager().GetSessions(c)
+}
+
+// GetSessions returns the sessions of the current user, see the package function GetSessions
+func (m *SessionManager) GetSessions(c echo.Context) ([]SessionInfo, error) {
+	sessionContext, sessions, err := m.getOwnSessions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{
+			PublicID:     session.PublicID,
+			IP:           session.IP,
+			UserAgent:    session.UserAgent,
+			DeviceLabel:  session.DeviceLabel,
+			CreatedAt:    session.CreatedAt,
+			LastSeenAt:   session.LastSeenAt,
+			ValidUntil:   session.ValidUntil,
+			Current:      isCurrentSession(sessionContext, &session),
+			Impersonated: session.ImpersonatorKey != "",
+		})
+	}
+	return infos, nil
+}
+
+// RevokeSession deletes the session of the current user with the given public id.
+// Revoking the current session is equivalent to Logout, but the cookie is not removed.
+// Returns ErrSessionNotFound if the user has no such session.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func RevokeSession(db *gorm.DB, c echo.Context, publicID string) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().RevokeSession(c, publicID)
+}
+
+// RevokeSession deletes a session of the current user, see the package function RevokeSession
+func (m *SessionManager) RevokeSession(c echo.Context, publicID string) error {
+	sessionContext, session, err := m.getOwnSession(c, publicID)
+	if err != nil {
+		return err
+	}
+
+	if err := sessionContext.GetSessionConfig().Store.Delete(session.SessionID); err != nil {
+		c.Logger().Error(err.Error())
+		return ErrDatabaseError
+	}
+
+	if isCurrentSession(sessionContext, session) {
+		sessionContext.flush()
+	}
+	return nil
+}
+
+// LogoutOtherSessions deletes all sessions of the current user except the current one.
+// For requests authenticated by an API token, all sessions are deleted. For stateless sessions, all sessions of the
+// user are revoked and the current one is sealed again with the new revision.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func LogoutOtherSessions(db *gorm.DB, c echo.Context) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().LogoutOtherSessions(c)
+}
+
+// LogoutOtherSessions deletes the other sessions of the current user, see the package function LogoutOtherSessions
+func (m *SessionManager) LogoutOtherSessions(c echo.Context) error {
+	sessionContext, sessions, err := m.getOwnSessions(c)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if isCurrentSession(sessionContext, &session) {
+			continue
+		}
+		if err := sessionContext.GetSessionConfig().Store.Delete(session.SessionID); err != nil {
+			c.Logger().Error(err.Error())
+			return ErrDatabaseError
+		}
+	}
+
+	if p := sessionContext.getStatelessSession(); p != nil {
+		config := sessionContext.GetSessionConfig()
+		revision, err := config.Stateless.Revocations.Revoke(p.AuthKey, p.AuthID)
+		if err != nil {
+			c.Logger().Error(err.Error())
+			return ErrDatabaseError
+		}
+
+		current := *p
+		current.Revision = revision
+		if err := issueStatelessSession(c, config, &current); err != nil {
+			return err
+		}
+		sessionContext.setStatelessSession(&current)
+	}
+	return nil
+}
+
+// SetSessionDeviceLabel sets a label chosen by the user, e.g. "Work laptop", for the session with the given public id.
+// Returns ErrSessionNotFound if the user has no such session.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func SetSessionDeviceLabel(db *gorm.DB, c echo.Context, publicID string, label string) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().SetSessionDeviceLabel(c, publicID, label)
+}
+
+// SetSessionDeviceLabel labels a session of the current user, see the package function SetSessionDeviceLabel
+func (m *SessionManager) SetSessionDeviceLabel(c echo.Context, publicID string, label string) error {
+	sessionContext, session, err := m.getOwnSession(c, publicID)
+	if err != nil {
+		return err
+	}
+
+	session.DeviceLabel = label
+	if err := sessionContext.GetSessionConfig().Store.Update(session, "DeviceLabel"); err != nil {
+		c.Logger().Error(err.Error())
+		return ErrDatabaseError
+	}
+	return nil
+}
+
+// getOwnSessions returns the valid sessions of the user of the current request
+func (m *SessionManager) getOwnSessions(c echo.Context) (SessionContext, []utilitymodels.Session, error) {
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sessionContext.IsAuthenticated() {
+		return nil, nil, ErrNotAuthenticated
+	}
+
+	authKey, authID := sessionContext.getAuthIdentifier()
+	sessions, err := sessionContext.GetSessionConfig().Store.GetByAuth(authKey, authID)
+	if err != nil {
+		c.Logger().Error(err.Error())
+		return nil, nil, ErrDatabaseError
+	}
+
+	now := time.Now().UTC()
+	valid := make([]utilitymodels.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if !now.After(session.ValidUntil) {
+			valid = append(valid, session)
+		}
+	}
+	return sessionContext, valid, nil
+}
+
+// getOwnSession returns the valid session of the user of the current request with the given public id
+func (m *SessionManager) getOwnSession(c echo.Context, publicID string) (SessionContext, *utilitymodels.Session, error) {
+	sessionContext, sessions, err := m.getOwnSessions(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Sessions created before public ids were introduced have none and can't be referenced
+	if publicID == "" {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	for _, session := range sessions {
+		if session.PublicID == publicID {
+			return sessionContext, &session, nil
+		}
+	}
+	return nil, nil, ErrSessionNotFound
+}
+
+func isCurrentSession(sessionContext SessionContext, session *utilitymodels.Session) bool {
+	return sessionContext.GetSessionID() != nil && *sessionContext.GetSessionID() == session.SessionID
+}
+
+func generatePublicSessionID() (string, error) {
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return "", ErrRandomFailed
+	}
+	return fmt.Sprintf("%x", r), nil
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// sessionValidUntil returns the expiry of a session created at createdAt, if a request arrives at now
+func sessionValidUntil(config *SessionConfig, createdAt time.Time, now time.Time) time.Time {
+	validUntil := now.Add(*config.CookieAge)
+	if config.IdleTimeout != nil {
+		validUntil = now.Add(*config.IdleTimeout)
+	}
+
+	if config.AbsoluteTimeout != nil {
+		if absolute := createdAt.Add(*config.AbsoluteTimeout); absolute.Before(validUntil) {
+			validUntil = absolute
+		}
+	}
+
+	return validUntil
+}
+
+// renewSession extends ValidUntil of the session if IdleTimeout is set and RenewalThreshold has passed since the
+// last extension. The cookie is refreshed for persistent sessions. LastSeenAt is updated with every extension and
+// at most every LastSeenInterval, if it is set. Only these fields are written, so concurrent changes of e.g. the
+// device label are kept. Errors are only logged, the session stays valid until its current expiry.
+func renewSession(c echo.Context, config *SessionConfig, session *utilitymodels.Session, rawSessionID string) {
+	now := time.Now().UTC()
+
+	extend := false
+	var validUntil time.Time
+	if config.IdleTimeout != nil {
+		validUntil = sessionValidUntil(config, session.CreatedAt, now)
+
+		// Time since the last extension, which had set ValidUntil to now + IdleTimeout
+		elapsed := *config.IdleTimeout - session.ValidUntil.Sub(now)
+		extend = elapsed >= *config.RenewalThreshold && validUntil.After(session.ValidUntil)
+	}
+	touch := config.LastSeenInterval != nil && now.Sub(session.LastSeenAt) >= *config.LastSeenInterval
+
+	if !extend && !touch {
+		return
+	}
+
+	previous := *session
+	fields := []string{"LastSeenAt"}
+	if extend {
+		session.ValidUntil = validUntil
+		fields = append(fields, "ValidUntil")
+	}
+	session.LastSeenAt = now
+	if err := config.Store.Update(session, fields...); err != nil {
+		*session = previous
+		c.Logger().Errorf("Error renewing session: %s", err.Error())
+		return
+	}
+
+	if extend && session.Persistent {
+		setSessionCookie(c, config, rawSessionID, session)
+	}
+}
+
+// setSessionCookie sets the cookie of the session. Persistent sessions get a cookie which expires with the session.
+func setSessionCookie(c echo.Context, config *SessionConfig, rawSessionID string, session *utilitymodels.Session) {
+	cookie := &http.Cookie{
+		Name:     config.CookieName,
+		Value:    rawSessionID,
+		Path:     config.CookiePath,
+		Domain:   "", // Only allow current site
+		Secure:   *config.Secure,
+		SameSite: http.SameSiteDefaultMode,
+	}
+
+	if session.Persistent {
+		cookie.MaxAge = int(time.Until(session.ValidUntil).Seconds())
+	}
+
+	c.SetCookie(cookie)
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func TestRenewSessionWrites(t *testing.T) {
+	idleTimeout := time.Hour
+	lastSeenInterval := time.Minute
+
+	tests := []struct {
+		name             string
+		config           SessionConfig
+		lastSeen         time.Duration // Time since LastSeenAt
+		validFor         time.Duration // Remaining time until ValidUntil
+		expectLastSeen   bool
+		expectValidUntil bool
+	}{
+		{
+			name:     "no idle timeout",
+			config:   SessionConfig{},
+			lastSeen: time.Hour,
+			validFor: time.Minute,
+		},
+		{
+			name:     "below renewal threshold",
+			config:   SessionConfig{IdleTimeout: &idleTimeout},
+			lastSeen: 5 * time.Minute,
+			validFor: 55 * time.Minute,
+		},
+		{
+			name:             "extension",
+			config:           SessionConfig{IdleTimeout: &idleTimeout},
+			lastSeen:         20 * time.Minute,
+			validFor:         40 * time.Minute,
+			expectLastSeen:   true,
+			expectValidUntil: true,
+		},
+		{
+			name:           "last seen interval",
+			config:         SessionConfig{LastSeenInterval: &lastSeenInterval},
+			lastSeen:       2 * time.Minute,
+			validFor:       time.Minute,
+			expectLastSeen: true,
+		},
+		{
+			name:     "within last seen interval",
+			config:   SessionConfig{LastSeenInterval: &lastSeenInterval},
+			lastSeen: 30 * time.Second,
+			validFor: time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.Store = NewMemorySessionStore()
+			config.FixSessionConfig()
+
+			now := time.Now().UTC()
+			session := newTestSession("first", 1, test.validFor)
+			session.CreatedAt = now.Add(-time.Hour)
+			session.LastSeenAt = now.Add(-test.lastSeen)
+			if err := config.Store.Create(session); err != nil {
+				t.Fatal(err)
+			}
+			previous, _ := config.Store.Get("first")
+
+			c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+			renewSession(c, &config, previous, "raw")
+
+			stored, err := config.Store.Get("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lastSeen := stored.LastSeenAt.After(session.LastSeenAt); lastSeen != test.expectLastSeen {
+				t.Fatalf("expected LastSeenAt to be written: %t, got %v", test.expectLastSeen, stored.LastSeenAt)
+			}
+			if validUntil := stored.ValidUntil.After(session.ValidUntil); validUntil != test.expectValidUntil {
+				t.Fatalf("expected ValidUntil to be extended: %t, got %v", test.expectValidUntil, stored.ValidUntil)
+			}
+		})
+	}
+}
+
+func TestSessionValidUntil(t *testing.T) {
+	cookieAge, idleTimeout, absoluteTimeout := 30*time.Minute, time.Hour, 90*time.Minute
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		config   SessionConfig
+		created  time.Duration // Time since the login
+		expected time.Duration // Expected expiry relative to now
+	}{
+		{name: "cookie age", config: SessionConfig{CookieAge: &cookieAge}, expected: cookieAge},
+		{name: "idle timeout", config: SessionConfig{CookieAge: &cookieAge, IdleTimeout: &idleTimeout}, expected: idleTimeout},
+		{
+			name:     "below absolute timeout",
+			config:   SessionConfig{IdleTimeout: &idleTimeout, AbsoluteTimeout: &absoluteTimeout},
+			created:  10 * time.Minute,
+			expected: idleTimeout,
+		},
+		{
+			name:     "capped by absolute timeout",
+			config:   SessionConfig{IdleTimeout: &idleTimeout, AbsoluteTimeout: &absoluteTimeout},
+			created:  time.Hour,
+			expected: 30 * time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.FixSessionConfig()
+			if validUntil := sessionValidUntil(&config, now.Add(-test.created), now); !validUntil.Equal(now.Add(test.expected)) {
+				t.Fatalf("expected %v, got %v", now.Add(test.expected), validUntil)
+			}
+		})
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	idleTimeout := time.Hour
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore(), IdleTimeout: &idleTimeout})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	store := m.GetSessionConfig().Store
+
+	// A persistent session, its cookie expires with the session
+	cookies := map[string]*http.Cookie{}
+	var sessionID string
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := m.Login(alice, c, false); err != nil {
+			return err
+		}
+		sessionContext, _ := GetSessionContext(c)
+		sessionID = *sessionContext.GetSessionID()
+		return nil
+	})
+
+	setValidUntil := func(validFor time.Duration) {
+		t.Helper()
+		session, err := store.Get(sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.ValidUntil = time.Now().UTC().Add(validFor)
+		if err := store.Update(session, "ValidUntil"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Requests within the renewal threshold don't extend the session
+	setValidUntil(55 * time.Minute)
+	rec := serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatal("expected the cookie not to be refreshed")
+	}
+	if session, _ := store.Get(sessionID); time.Until(session.ValidUntil) > 55*time.Minute {
+		t.Fatalf("expected the session not to be extended, got %v", session.ValidUntil)
+	}
+
+	// An active session is extended by IdleTimeout and its cookie is refreshed
+	setValidUntil(30 * time.Minute)
+	rec = serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	if session, _ := store.Get(sessionID); time.Until(session.ValidUntil) < 59*time.Minute {
+		t.Fatalf("expected the session to be extended, got %v", session.ValidUntil)
+	}
+	if refreshed := rec.Result().Cookies(); len(refreshed) != 1 || refreshed[0].MaxAge < 3500 {
+		t.Fatalf("expected the cookie to be refreshed, got %v", refreshed)
+	}
+	assertTestUser(t, m, cookies, alice, nil)
+
+	// An idle session expires
+	setValidUntil(-time.Second)
+	assertTestUser(t, m, cookies, nil, nil)
+}
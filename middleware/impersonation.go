@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+var (
+	ErrAlreadyImpersonating   = errors.New("session is already impersonating a user")
+	ErrNotImpersonating       = errors.New("session is not impersonating a user")
+	ErrImpersonationStateless = errors.New("impersonation is not supported with stateless sessions")
+)
+
+const (
+	impersonationStart = "start"
+	impersonationStop  = "stop"
+)
+
+// StartImpersonation replaces the session of the current user by a session of target, which records the current user
+// as impersonator, see SessionContext.IsImpersonated. The caller is responsible for checking that the current user is
+// allowed to impersonate target. The start is written to utilitymodels.ImpersonationLog and logged.
+// Revoking the sessions of the impersonator with InvalidateSessions ends the impersonation as well.
+// Returns ErrImpersonationStateless if the middleware uses stateless sessions, as a single stateless session can't
+// be revoked when the impersonation stops.
+// The SessionManager of the Session middleware, which handled the request, is used, including its database.
+func StartImpersonation(c echo.Context, target IdentifiedAuthModel) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().StartImpersonation(c, target)
+}
+
+// StopImpersonation ends the impersonation of the current session and starts a new session for the impersonator.
+// The stop is written to utilitymodels.ImpersonationLog and logged.
+// The SessionManager of the Session middleware, which handled the request, is used, including its database.
+func StopImpersonation(c echo.Context) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().StopImpersonation(c)
+}
+
+// StartImpersonation starts impersonating target, see the package function StartImpersonation
+func (m *SessionManager) StartImpersonation(c echo.Context, target IdentifiedAuthModel) error {
+	if m.config.Stateless != nil {
+		return ErrImpersonationStateless
+	}
+
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	// The impersonator must be logged in with a session, API tokens can't impersonate
+	if !sessionContext.IsAuthenticated() || sessionContext.IsTokenAuthenticated() {
+		return ErrNotAuthenticated
+	}
+	if sessionContext.IsImpersonated() {
+		return ErrAlreadyImpersonating
+	}
+
+	actorKey, actorID := sessionContext.getAuthIdentifier()
+	targetKey, targetID := target.GetAuthModelIdentifier()
+
+	// The audit trail is written first, an impersonation must not happen without it
+	if err := m.recordImpersonation(c, impersonationStart, actorKey, actorID, targetKey, targetID); err != nil {
+		return err
+	}
+
+	// Impersonation sessions always use a session cookie
+	session, err := newSession(c, m.config, targetKey, targetID, false)
+	if err != nil {
+		return err
+	}
+	session.ImpersonatorKey = actorKey
+	session.ImpersonatorID = actorID
+
+	return m.startSession(c, sessionContext, session, false)
+}
+
+// StopImpersonation stops the impersonation, see the package function StopImpersonation
+func (m *SessionManager) StopImpersonation(c echo.Context) error {
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
+	if !sessionContext.IsImpersonated() {
+		return ErrNotImpersonating
+	}
+
+	actorKey, actorID := sessionContext.getImpersonatorIdentifier()
+	targetKey, targetID := sessionContext.getAuthIdentifier()
+
+	if err := m.recordImpersonation(c, impersonationStop, actorKey, actorID, targetKey, targetID); err != nil {
+		return err
+	}
+
+	// The impersonation session is replaced, so it can't be used anymore
+	session, err := newSession(c, m.config, actorKey, actorID, false)
+	if err != nil {
+		return err
+	}
+	return m.startSession(c, sessionContext, session, false)
+}
+
+// recordImpersonation logs the action and writes it to the database of the manager, if there is one
+func (m *SessionManager) recordImpersonation(c echo.Context, action string, actorKey string, actorID uint, targetKey string, targetID uint) error {
+	c.Logger().Infof("Impersonation %s: %s %d as %s %d from %s", action, actorKey, actorID, targetKey, targetID, c.RealIP())
+
+	if m.db == nil {
+		return nil
+	}
+
+	if err := m.db.Create(&utilitymodels.ImpersonationLog{
+		Action:    action,
+		ActorKey:  actorKey,
+		ActorID:   actorID,
+		TargetKey: targetKey,
+		TargetID:  targetID,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}).Error; err != nil {
+		c.Logger().Errorf("Error writing impersonation log: %s", err.Error())
+		return ErrDatabaseError
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// serveTestSession handles a request with the session middleware of m and returns the response.
+// The cookies of the response are added to cookies.
+func serveTestSession(t *testing.T, m *SessionManager, cookies map[string]*http.Cookie, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if err := m.Middleware()(handler)(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(cookies, cookie.Name)
+		} else {
+			cookies[cookie.Name] = cookie
+		}
+	}
+	return rec
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, username string) *utilitymodels.LocalUser {
+	t.Helper()
+
+	u := utilitymodels.LocalUser{Username: username, Password: "unused"}
+	if err := db.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+// newTestImpersonation returns a manager, in which admin has started to impersonate alice. The cookies of the
+// impersonation session and of the admin session before are returned.
+func newTestImpersonation(t *testing.T) (*SessionManager, *gorm.DB, *utilitymodels.LocalUser, *utilitymodels.LocalUser, map[string]*http.Cookie, *http.Cookie) {
+	t.Helper()
+
+	db := testutil.OpenTestDB(t)
+	admin := createTestUser(t, db, "admin")
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(admin, c, true)
+	})
+	adminCookie := cookies["session_id"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return StartImpersonation(c, alice)
+	})
+	return m, db, admin, alice, cookies, adminCookie
+}
+
+// assertTestUser checks the user and the impersonator of the session of the cookies, nil means unauthenticated
+func assertTestUser(t *testing.T, m *SessionManager, cookies map[string]*http.Cookie, user *utilitymodels.LocalUser, impersonator *utilitymodels.LocalUser) {
+	t.Helper()
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		sessionContext, _ := GetSessionContext(c)
+		if user == nil {
+			if sessionContext.IsAuthenticated() {
+				t.Fatal("expected the session to be unauthenticated")
+			}
+			return nil
+		}
+
+		if u, ok := sessionContext.GetUser().(*utilitymodels.LocalUser); !sessionContext.IsAuthenticated() || !ok || u.ID != user.ID {
+			t.Fatalf("expected %s to be logged in, got %v", user.Username, sessionContext.GetUser())
+		}
+		if sessionContext.IsImpersonated() != (impersonator != nil) {
+			t.Fatalf("expected the session to be impersonated: %t", impersonator != nil)
+		}
+		if impersonator == nil {
+			if sessionContext.GetImpersonator() != nil {
+				t.Fatal("expected no impersonator")
+			}
+		} else if u, ok := sessionContext.GetImpersonator().(*utilitymodels.LocalUser); !ok || u.ID != impersonator.ID {
+			t.Fatalf("expected %s to impersonate, got %v", impersonator.Username, sessionContext.GetImpersonator())
+		}
+		return nil
+	})
+}
+
+func TestImpersonation(t *testing.T) {
+	m, db, admin, alice, cookies, adminCookie := newTestImpersonation(t)
+
+	assertTestUser(t, m, cookies, alice, admin)
+	// The session of the admin was replaced
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": adminCookie}, nil, nil)
+	impersonationCookie := cookies["session_id"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := StartImpersonation(c, admin); !errors.Is(err, ErrAlreadyImpersonating) {
+			t.Fatalf("expected %v, got %v", ErrAlreadyImpersonating, err)
+		}
+		return StopImpersonation(c)
+	})
+
+	assertTestUser(t, m, cookies, admin, nil)
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": impersonationCookie}, nil, nil)
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := StopImpersonation(c); !errors.Is(err, ErrNotImpersonating) {
+			t.Fatalf("expected %v, got %v", ErrNotImpersonating, err)
+		}
+		return nil
+	})
+
+	var logs []utilitymodels.ImpersonationLog
+	db.Order("id").Find(&logs)
+	if len(logs) != 2 {
+		t.Fatalf("expected two audit rows, got %d", len(logs))
+	}
+	for i, action := range []string{impersonationStart, impersonationStop} {
+		log := logs[i]
+		if log.Action != action || log.ActorKey != "local" || log.ActorID != admin.ID || log.TargetKey != "local" || log.TargetID != alice.ID {
+			t.Fatalf("unexpected audit row %+v", log)
+		}
+	}
+}
+
+func TestImpersonationRequiresLogin(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	serveTestSession(t, m, map[string]*http.Cookie{}, func(c echo.Context) error {
+		if err := StartImpersonation(c, alice); !errors.Is(err, ErrNotAuthenticated) {
+			t.Fatalf("expected %v, got %v", ErrNotAuthenticated, err)
+		}
+		return nil
+	})
+
+	var count int64
+	db.Model(&utilitymodels.ImpersonationLog{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no audit row, got %d", count)
+	}
+}
+
+func TestImpersonationEndsWithRevocation(t *testing.T) {
+	// Revoking the sessions of the impersonator ends the impersonation
+	m, _, admin, _, cookies, _ := newTestImpersonation(t)
+	if err := m.InvalidateSessions(admin.ID, "local"); err != nil {
+		t.Fatal(err)
+	}
+	assertTestUser(t, m, cookies, nil, nil)
+
+	// So does revoking the sessions of the impersonated user
+	m, _, _, alice, cookies, _ := newTestImpersonation(t)
+	if err := m.InvalidateSessions(alice.ID, "local"); err != nil {
+		t.Fatal(err)
+	}
+	assertTestUser(t, m, cookies, nil, nil)
+}
+
+func TestImpersonationStateless(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	admin := createTestUser(t, db, "admin")
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Stateless: &StatelessConfig{Keys: [][]byte{make([]byte, 32)}}})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(admin, c, true)
+	})
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := StartImpersonation(c, alice); !errors.Is(err, ErrImpersonationStateless) {
+			t.Fatalf("expected %v, got %v", ErrImpersonationStateless, err)
+		}
+		return nil
+	})
+	assertTestUser(t, m, cookies, admin, nil)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// SessionManager owns the database, the config and the auth providers of a session middleware.
+// Multiple managers can be used in one process, e.g. for a public and an admin app, without affecting each other.
+// Session creates the default manager, which is used by the package functions RegisterAuthProvider and
+// InvalidateSessions. Package functions working on a request, e.g. Login or Logout, use the manager which handled it.
+type SessionManager struct {
+	db       *gorm.DB
+	config   *SessionConfig
+	registry *providerRegistry
+}
+
+// NewSessionManager creates a SessionManager with its own auth providers. Register them with RegisterAuthProvider
+// and use Middleware as middleware.
+func NewSessionManager(db *gorm.DB, config *SessionConfig) *SessionManager {
+	if config == nil {
+		config = &SessionConfig{}
+	}
+	config.FixSessionConfig()
+	if config.Store == nil {
+		config.Store = NewGormSessionStore(db)
+	}
+	// The config may be passed to Session again, the store must not be wrapped twice
+	if _, cached := config.Store.(*cachedSessionStore); config.Cache != nil && !cached {
+		config.Store = NewCachedSessionStore(config.Store, config.Cache)
+	}
+	if config.Stateless != nil {
+		if config.MaxSessions > 0 {
+			panic("session limits are not supported with stateless sessions")
+		}
+		config.Stateless.FixStatelessConfig(db)
+	}
+
+	return &SessionManager{
+		db:       db,
+		config:   config,
+		registry: newProviderRegistry(),
+	}
+}
+
+// RegisterAuthProvider registers an auth provider for this manager, see the package function RegisterAuthProvider
+func (m *SessionManager) RegisterAuthProvider(getProviderInformation func() (string, func(uint) any)) {
+	m.registry.register(getProviderInformation)
+}
+
+// GetSessionConfig Returns the config of this manager
+func (m *SessionManager) GetSessionConfig() *SessionConfig {
+	return m.config
+}
+
+// getUserModel returns the user of the given provider or nil
+func (m *SessionManager) getUserModel(authKey string, authID uint) any {
+	getUserModel, exists := m.registry.get(authKey)
+	if !exists {
+		return nil
+	}
+	return getUserModel(authID)
+}
+
+// getSessionContext returns the SessionContext of the request, if it was created by this manager
+func (m *SessionManager) getSessionContext(c echo.Context) (SessionContext, error) {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return nil, err
+	}
+	if sessionContext.getManager() != m {
+		return nil, ErrSessionContextMissing
+	}
+	return sessionContext, nil
+}
+
+var (
+	defaultLock     sync.RWMutex
+	defaultManager  *SessionManager
+	defaultRegistry = newProviderRegistry()
+)
+
+// getDefaultManager returns the manager of the last constructed Session middleware or nil
+func getDefaultManager() *SessionManager {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultManager
+}
+
+func setDefaultManager(m *SessionManager) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultManager = m
+}
+
+type providerRegistry struct {
+	lock      sync.RWMutex
+	providers map[string]func(uint) any
+}
+
+func newProviderRegistry() *providerRegistry {
+	return &providerRegistry{
+		providers: map[string]func(uint) any{},
+	}
+}
+
+func (r *providerRegistry) register(getProviderInformation func() (string, func(uint) any)) {
+	authIdentifier, getUserModel := getProviderInformation()
+
+	if authIdentifier == "" {
+		panic("invalid auth provider identifier")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.providers[authIdentifier]; exists {
+		panic("auth provider with that key already exists")
+	}
+
+	r.providers[authIdentifier] = getUserModel
+}
+
+func (r *providerRegistry) get(authIdentifier string) (func(uint) any, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	getUserModel, exists := r.providers[authIdentifier]
+	return getUserModel, exists
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func TestInvalidateSessionsDefaultManager(t *testing.T) {
+	previous := getDefaultManager()
+	t.Cleanup(func() {
+		setDefaultManager(previous)
+	})
+
+	Session(nil, &SessionConfig{Store: NewMemorySessionStore()})
+	other := NewSessionManager(nil, &SessionConfig{Store: NewMemorySessionStore()})
+
+	for _, m := range []*SessionManager{getDefaultManager(), other} {
+		if err := m.GetSessionConfig().Store.Create(newTestSession("alice", 1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.GetSessionConfig().Store.Create(newTestSession("bob", 2, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := InvalidateSessions(nil, 1, "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	store := getDefaultManager().GetSessionConfig().Store
+	if _, err := store.Get("alice"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+	if _, err := store.Get("bob"); err != nil {
+		t.Fatalf("expected the sessions of other users to be kept, got %v", err)
+	}
+
+	// Managers created with NewSessionManager have to be invalidated explicitly
+	if _, err := other.GetSessionConfig().Store.Get("alice"); err != nil {
+		t.Fatalf("expected the session of the other manager to be kept, got %v", err)
+	}
+	if err := other.InvalidateSessions(1, "local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetSessionConfig().Store.Get("alice"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+}
+
+func TestLoginRefusedKeepsPreviousSession(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{
+		Secure:             &secure,
+		Store:              NewMemorySessionStore(),
+		MaxSessions:        1,
+		SessionLimitPolicy: RefuseNewSession,
+	})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	serveTestSession(t, m, map[string]*http.Cookie{}, func(c echo.Context) error {
+		return m.Login(alice, c, true)
+	})
+
+	// A client logged in as bob fails to log in as alice, as she has reached the limit
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(bob, c, true)
+	})
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := m.Login(alice, c, true); !errors.Is(err, ErrSessionLimitReached) {
+			t.Fatalf("expected %v, got %v", ErrSessionLimitReached, err)
+		}
+		return nil
+	})
+	assertTestUser(t, m, cookies, bob, nil)
+}
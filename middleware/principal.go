@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+var (
+	ErrUserTypeMismatch = errors.New("user has an unexpected type")
+)
+
+// Principal is implemented by the user models of all auth providers, e.g. utilitymodels.LocalUser,
+// utilitymodels.LDAPUser and utilitymodels.OIDCUser, so handlers can work with the user regardless of its provider.
+// GetProviderKey returns the key the provider was registered with. GetEmail returns an empty string if the user
+// has no email.
+type Principal interface {
+	GetID() uint
+	GetDisplayName() string
+	GetProviderKey() string
+	GetEmail() string
+}
+
+// The user models of the providers in utilitymodels implement Principal
+var (
+	_ Principal = (*utilitymodels.LocalUser)(nil)
+	_ Principal = (*utilitymodels.LDAPUser)(nil)
+	_ Principal = (*utilitymodels.OIDCUser)(nil)
+)
+
+// User Returns the user of the current request as T, which may be a model like *utilitymodels.LocalUser or an
+// interface like Principal.
+// Returns ErrNotAuthenticated if the request is not authenticated and ErrUserTypeMismatch if the user is no T.
+// While a second factor is pending, the request is not authenticated, use SessionContext.GetUser instead.
+func User[T any](c echo.Context) (T, error) {
+	var user T
+
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return user, err
+	}
+	if !sessionContext.IsAuthenticated() {
+		return user, ErrNotAuthenticated
+	}
+
+	model := sessionContext.GetUser()
+	if model == nil {
+		return user, ErrNotAuthenticated
+	}
+	user, ok := model.(T)
+	if !ok {
+		return user, ErrUserTypeMismatch
+	}
+	return user, nil
+}
+
+// GetPrincipal Returns the user of the current request as Principal, see User
+func GetPrincipal(c echo.Context) (Principal, error) {
+	return User[Principal](c)
+}
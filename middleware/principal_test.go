@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func TestUserAndPrincipal(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	m.RegisterAuthProvider(utilitymodels.GetLDAPUser(db))
+	m.RegisterAuthProvider(utilitymodels.GetOIDCUser(db))
+
+	localEmail, oidcEmail := "alice@example.org", "carol@example.org"
+	local := &utilitymodels.LocalUser{Username: "alice", Password: "unused", Email: &localEmail}
+	ldap := &utilitymodels.LDAPUser{
+		LDAPProvider: utilitymodels.LDAPProvider{Name: "ldap"},
+		Username:     "bob",
+		DN:           "uid=bob,ou=people,dc=example,dc=org",
+		DisplayName:  "Bob Builder",
+	}
+	oidc := &utilitymodels.OIDCUser{
+		OIDCProvider: utilitymodels.OIDCProvider{Name: "oidc"},
+		Subject:      "carol-subject",
+		Username:     "carol",
+		Email:        &oidcEmail,
+	}
+	for _, model := range []any{local, ldap, oidc} {
+		if err := db.Create(model).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		model       IdentifiedAuthModel
+		providerKey string
+		displayName string
+		email       string
+	}{
+		{model: local, providerKey: utilitymodels.LocalAuthKey, displayName: "alice", email: localEmail},
+		{model: ldap, providerKey: utilitymodels.LDAPAuthKey, displayName: "Bob Builder", email: ""},
+		{model: oidc, providerKey: utilitymodels.OIDCAuthKey, displayName: "carol", email: oidcEmail},
+	}
+	for _, test := range tests {
+		t.Run(test.providerKey, func(t *testing.T) {
+			cookies := map[string]*http.Cookie{}
+			serveTestSession(t, m, cookies, func(c echo.Context) error {
+				return m.Login(test.model, c, true)
+			})
+
+			serveTestSession(t, m, cookies, func(c echo.Context) error {
+				principal, err := GetPrincipal(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, id := test.model.GetAuthModelIdentifier()
+				if principal.GetID() != id || principal.GetProviderKey() != test.providerKey ||
+					principal.GetDisplayName() != test.displayName || principal.GetEmail() != test.email {
+					t.Fatalf("unexpected principal %+v", principal)
+				}
+
+				// The concrete model of the provider can be requested as well
+				switch test.providerKey {
+				case utilitymodels.LocalAuthKey:
+					if u, err := User[*utilitymodels.LocalUser](c); err != nil || u.Username != "alice" {
+						t.Fatalf("expected alice, got %v, %v", u, err)
+					}
+				case utilitymodels.LDAPAuthKey:
+					if u, err := User[*utilitymodels.LDAPUser](c); err != nil || u.DN != ldap.DN {
+						t.Fatalf("expected bob, got %v, %v", u, err)
+					}
+				case utilitymodels.OIDCAuthKey:
+					if u, err := User[*utilitymodels.OIDCUser](c); err != nil || u.Subject != oidc.Subject {
+						t.Fatalf("expected carol, got %v, %v", u, err)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestUserTypeMismatch(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore()})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if _, err := GetPrincipal(c); !errors.Is(err, ErrNotAuthenticated) {
+			t.Fatalf("expected %v, got %v", ErrNotAuthenticated, err)
+		}
+		return m.Login(alice, c, true)
+	})
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if _, err := User[*utilitymodels.LDAPUser](c); !errors.Is(err, ErrUserTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrUserTypeMismatch, err)
+		}
+		if _, err := User[utilitymodels.LocalUser](c); !errors.Is(err, ErrUserTypeMismatch) {
+			t.Fatalf("expected %v for a non-pointer type, got %v", ErrUserTypeMismatch, err)
+		}
+		return nil
+	})
+}
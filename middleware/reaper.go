@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"github.com/obaraelijah/echo-tools/worker"
+	"gorm.io/gorm"
+)
+
+// ReaperConfig Set the parameters of the session reaper.
+// Parameter Interval defaults to time.Hour. Time between two runs.
+// Parameter BatchSize defaults to 1000. Maximum number of sessions deleted per statement, which keeps locks short.
+// Parameter OnRun is optional. Called after every run with the number of deleted sessions and the error, if any.
+// Parameter Store defaults to nil, which deletes the expired sessions stored with utilitymodels.Session. Set it to
+// SessionConfig.Store to delete the expired sessions of that store, e.g. of NewMemorySessionStore.
+type ReaperConfig struct {
+	Interval  *time.Duration
+	BatchSize int
+	OnRun     func(removed int64, err error)
+	Store     SessionStore
+}
+
+func (config *ReaperConfig) FixReaperConfig() {
+	if config.Interval == nil {
+		interval := time.Hour
+		config.Interval = &interval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+}
+
+// SessionReaper periodically deletes expired sessions stored with utilitymodels.Session, or those of
+// ReaperConfig.Store. The Redis store expires sessions on its own and doesn't need it.
+type SessionReaper struct {
+	db      *gorm.DB
+	pool    worker.Pool
+	config  ReaperConfig
+	running atomic.Bool
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewSessionReaper creates a reaper, which enqueues its runs on the given pool. The pool must be started by the caller.
+// Start the reaper with Start, its Stop method can be used as execution.Config.StopFunc.
+// db may be nil if ReaperConfig.Store is set.
+func NewSessionReaper(db *gorm.DB, pool worker.Pool, config *ReaperConfig) *SessionReaper {
+	c := ReaperConfig{}
+	if config != nil {
+		c = *config
+	}
+	c.FixReaperConfig()
+
+	return &SessionReaper{
+		db:     db,
+		pool:   pool,
+		config: c,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Start schedules a run immediately and then every Interval until Stop is called. Doesn't block.
+func (r *SessionReaper) Start() {
+	go func() {
+		ticker := time.NewTicker(*r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			r.schedule()
+
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling new runs. A run which is already executing is finished, a run which is still queued is
+// skipped. Can be called multiple times.
+func (r *SessionReaper) Stop() {
+	r.once.Do(func() {
+		close(r.quit)
+	})
+}
+
+// schedule enqueues a run, unless the previous one has not finished yet
+func (r *SessionReaper) schedule() {
+	if !r.running.CompareAndSwap(false, true) {
+		return
+	}
+
+	task := worker.NewTask(func() error {
+		defer r.running.Store(false)
+
+		// The run may have been queued before Stop was called
+		select {
+		case <-r.quit:
+			return nil
+		default:
+		}
+
+		var removed int64
+		var err error
+		if r.config.Store != nil {
+			removed, err = reapExpiredSessions(r.config.Store, r.config.BatchSize)
+		} else {
+			removed, err = ReapExpiredSessions(r.db, r.config.BatchSize)
+		}
+		if r.config.OnRun != nil {
+			r.config.OnRun(removed, err)
+		}
+		return err
+	})
+
+	// AddTask blocks while the queue of the pool is full or the pool is stopped, which must not block Stop
+	added := make(chan struct{})
+	go func() {
+		r.pool.AddTask(task)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-r.quit:
+	}
+}
+
+// expiringSessionStore is implemented by stores, which keep expired sessions until they are deleted
+type expiringSessionStore interface {
+	deleteExpired(batchSize int) (int64, error)
+}
+
+// reapExpiredSessions deletes the expired sessions of the store, if it doesn't expire them on its own
+func reapExpiredSessions(store SessionStore, batchSize int) (int64, error) {
+	if expiring, ok := store.(expiringSessionStore); ok {
+		return expiring.deleteExpired(batchSize)
+	}
+	return 0, nil
+}
+
+// ReapExpiredSessions deletes all expired sessions in batches of batchSize and returns the number of deleted sessions.
+func ReapExpiredSessions(db *gorm.DB, batchSize int) (int64, error) {
+	var removed int64
+	now := time.Now().UTC()
+
+	for {
+		var ids []uint
+		if err := db.Model(&utilitymodels.Session{}).
+			Where("valid_until < ?", now).
+			Limit(batchSize).
+			Pluck("id", &ids).Error; err != nil {
+			return removed, ErrDatabaseError
+		}
+		if len(ids) == 0 {
+			return removed, nil
+		}
+
+		res := db.Where("id IN ?", ids).Delete(&utilitymodels.Session{})
+		if res.Error != nil {
+			return removed, ErrDatabaseError
+		}
+		removed += res.RowsAffected
+
+		if len(ids) < batchSize {
+			return removed, nil
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"github.com/obaraelijah/echo-tools/worker"
+)
+
+// runTestReaper runs the reaper once and returns the number of removed sessions
+func runTestReaper(t *testing.T, config *ReaperConfig, newReaper func(config *ReaperConfig, pool worker.Pool) *SessionReaper) int64 {
+	t.Helper()
+
+	pool := worker.NewPool(nil)
+	pool.Start()
+	t.Cleanup(pool.Stop)
+
+	type run struct {
+		removed int64
+		err     error
+	}
+	runs := make(chan run, 1)
+	config.OnRun = func(removed int64, err error) {
+		runs <- run{removed: removed, err: err}
+	}
+
+	reaper := newReaper(config, pool)
+	reaper.Start()
+	defer reaper.Stop()
+
+	select {
+	case r := <-runs:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.removed
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper didn't run")
+	}
+	return 0
+}
+
+func TestSessionReaper(t *testing.T) {
+	db := testutil.OpenTestDB(t)
+	store := NewGormSessionStore(db)
+	for _, session := range []*utilitymodels.Session{
+		newTestSession("expired", 1, -time.Minute),
+		newTestSession("also-expired", 2, -time.Hour),
+		newTestSession("valid", 1, time.Hour),
+	} {
+		if err := store.Create(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed := runTestReaper(t, &ReaperConfig{BatchSize: 1}, func(config *ReaperConfig, pool worker.Pool) *SessionReaper {
+		return NewSessionReaper(db, pool, config)
+	})
+	if removed != 2 {
+		t.Fatalf("expected 2 removed sessions, got %d", removed)
+	}
+
+	var count int64
+	db.Model(&utilitymodels.Session{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected one remaining session, got %d", count)
+	}
+}
+
+func TestSessionReaperMemoryStore(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		store := NewMemorySessionStore()
+		if cached {
+			store = NewCachedSessionStore(store, nil)
+		}
+		for i := 0; i < 5; i++ {
+			if err := store.Create(newTestSession(fmt.Sprintf("expired-%d", i), uint(i), -time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Create(newTestSession("valid", 1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		removed := runTestReaper(t, &ReaperConfig{BatchSize: 2, Store: store}, func(config *ReaperConfig, pool worker.Pool) *SessionReaper {
+			return NewSessionReaper(nil, pool, config)
+		})
+		if removed != 5 {
+			t.Fatalf("expected 5 removed sessions, got %d", removed)
+		}
+
+		memory := store
+		if cache, ok := store.(*cachedSessionStore); ok {
+			memory = cache.store
+		}
+		if sessions := memory.(*memorySessionStore).sessions; len(sessions) != 1 {
+			t.Fatalf("expected one remaining session, got %d", len(sessions))
+		}
+		if byAuth := memory.(*memorySessionStore).byAuth; len(byAuth) != 1 {
+			t.Fatalf("expected the index of the valid session only, got %v", byAuth)
+		}
+	}
+}
+
+func TestSessionReaperRedisStore(t *testing.T) {
+	// Redis expires sessions on its own, the reaper has nothing to do
+	store := NewRedisSessionStore(&RedisConfig{Address: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+	removed := runTestReaper(t, &ReaperConfig{Store: store}, func(config *ReaperConfig, pool worker.Pool) *SessionReaper {
+		return NewSessionReaper(nil, pool, config)
+	})
+	if removed != 0 {
+		t.Fatalf("expected no removed sessions, got %d", removed)
+	}
+}
+
+func TestSessionReaperStopWhileQueued(t *testing.T) {
+	// The pool isn't started yet and its queue is full, so the run can't be enqueued
+	pool := worker.NewPool(&worker.PoolConfig{NumWorker: 1, QueueSize: 1})
+	pool.AddTask(worker.NewTask(func() error { return nil }))
+	t.Cleanup(pool.Stop)
+
+	var runs atomic.Int64
+	interval := 10 * time.Millisecond
+	reaper := NewSessionReaper(nil, pool, &ReaperConfig{
+		Interval: &interval,
+		Store:    NewMemorySessionStore(),
+		OnRun: func(int64, error) {
+			runs.Add(1)
+		},
+	})
+	reaper.Start()
+	time.Sleep(5 * interval)
+
+	stopped := make(chan struct{})
+	go func() {
+		reaper.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked")
+	}
+
+	// The run, which is enqueued once the pool works, is skipped and the reaper isn't running anymore
+	pool.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for reaper.running.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the queued run to finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if runs.Load() != 0 {
+		t.Fatalf("expected the queued run to be skipped, got %d runs", runs.Load())
+	}
+}
+
+func TestSessionReaperSkipsOverlappingRuns(t *testing.T) {
+	pool := worker.NewPool(nil)
+	pool.Start()
+	t.Cleanup(pool.Stop)
+
+	release := make(chan struct{})
+	var runs atomic.Int64
+	interval := 5 * time.Millisecond
+	reaper := NewSessionReaper(nil, pool, &ReaperConfig{
+		Interval: &interval,
+		Store:    NewMemorySessionStore(),
+		OnRun: func(int64, error) {
+			runs.Add(1)
+			<-release
+		},
+	})
+	reaper.Start()
+	t.Cleanup(reaper.Stop)
+
+	// Ticks while a run is executing don't enqueue further runs
+	time.Sleep(20 * interval)
+	defer close(release)
+	if runs.Load() != 1 {
+		t.Fatalf("expected one run, got %d", runs.Load())
+	}
+}
@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRememberMeDisabled    = errors.New("remember me is not enabled in the session config")
+	ErrRememberTokenNotFound = errors.New("remember token not found")
+)
+
+var (
+	errRememberTokenMalformed = errors.New("remember token is malformed")
+	errRememberTokenReused    = errors.New("remember token was reused")
+	errRememberTokenUnusable  = errors.New("user of remember token can't be logged in")
+	errRememberTokenRotated   = errors.New("remember token was rotated concurrently")
+)
+
+// rememberMeGracePeriod is the time the previous validator is still accepted after a rotation, so concurrent
+// requests of the same browser are not mistaken for a theft
+const rememberMeGracePeriod = 30 * time.Second
+
+// RememberMeConfig Set the parameters of remember me tokens.
+// Parameter CookieName defaults to "remember_me".
+// Parameter Validity defaults to 30 * 24 * time.Hour. The token expires this long after RememberLogin, regardless of use.
+type RememberMeConfig struct {
+	CookieName string
+	Validity   *time.Duration
+}
+
+func (config *RememberMeConfig) FixRememberMeConfig() {
+	if config.CookieName == "" {
+		config.CookieName = "remember_me"
+	}
+	if config.Validity == nil {
+		validity := 30 * 24 * time.Hour
+		config.Validity = &validity
+	}
+}
+
+// RememberLogin issues a remember me token for the current device. Call it after Login, if the user asked to be
+// remembered. Once the session has expired, the Session middleware logs the user in again with a session cookie.
+// Returns ErrRememberMeDisabled if SessionConfig.RememberMe is not set.
+func RememberLogin(db *gorm.DB, model IdentifiedAuthModel, c echo.Context) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	config := sessionContext.GetSessionConfig()
+	if config.RememberMe == nil {
+		return ErrRememberMeDisabled
+	}
+
+	selector, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	validator, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+
+	authKey, authID := model.GetAuthModelIdentifier()
+	token := utilitymodels.RememberToken{
+		AuthKey:       authKey,
+		AuthID:        authID,
+		Selector:      selector,
+		ValidatorHash: hashRememberValidator(validator),
+		ExpiresAt:     time.Now().UTC().Add(*config.RememberMe.Validity),
+		IP:            c.RealIP(),
+		UserAgent:     c.Request().UserAgent(),
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return ErrDatabaseError
+	}
+
+	setRememberCookie(c, config, selector+":"+validator, token.ExpiresAt)
+	return nil
+}
+
+// GetRememberTokens Returns the remember me tokens of the given user model, one per remembered device
+func GetRememberTokens(db *gorm.DB, model IdentifiedAuthModel) ([]utilitymodels.RememberToken, error) {
+	authKey, authID := model.GetAuthModelIdentifier()
+
+	var tokens []utilitymodels.RememberToken
+	if err := db.Find(&tokens, "auth_key = ? AND auth_id = ?", authKey, authID).Error; err != nil {
+		return nil, ErrDatabaseError
+	}
+	return tokens, nil
+}
+
+// RevokeRememberToken deletes a remember me token of the given user model, so its device isn't remembered anymore
+func RevokeRememberToken(db *gorm.DB, model IdentifiedAuthModel, tokenID uint) error {
+	authKey, authID := model.GetAuthModelIdentifier()
+
+	res := db.Where("id = ? AND auth_key = ? AND auth_id = ?", tokenID, authKey, authID).Delete(&utilitymodels.RememberToken{})
+	if res.Error != nil {
+		return ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return ErrRememberTokenNotFound
+	}
+	return nil
+}
+
+// restoreRememberedLogin logs the user of a valid remember me cookie in. Errors are only logged, the request
+// stays unauthenticated.
+func (m *SessionManager) restoreRememberedLogin(c echo.Context) {
+	config := m.config
+	cookie, err := c.Cookie(config.RememberMe.CookieName)
+	if err != nil {
+		return
+	}
+
+	err = m.useRememberToken(c, cookie.Value)
+	switch {
+	case err == nil:
+	case errors.Is(err, errRememberTokenRotated):
+		// A concurrent request has rotated the token and set the new cookie
+	case errors.Is(err, ErrSessionLimitReached):
+		// The token stays usable, once the user has logged out elsewhere
+		if !config.DisableLogging {
+			c.Logger().Debugf("Remembered login was refused: %s", err.Error())
+		}
+	case errors.Is(err, errRememberTokenReused):
+		c.Logger().Warnf("Remember token reused, all sessions of the user were revoked")
+		clearRememberCookie(c, config)
+	case errors.Is(err, ErrDatabaseError):
+		c.Logger().Errorf("Error using remember token: %s", err.Error())
+	default:
+		if !config.DisableLogging {
+			c.Logger().Debugf("Remember token was rejected: %s", err.Error())
+		}
+		clearRememberCookie(c, config)
+	}
+}
+
+func (m *SessionManager) useRememberToken(c echo.Context, value string) error {
+	db, config := m.db, m.config
+	selector, validator, found := strings.Cut(value, ":")
+	if !found {
+		return errRememberTokenMalformed
+	}
+
+	var token utilitymodels.RememberToken
+	var count int64
+	if err := db.Find(&token, "selector = ?", selector).Count(&count).Error; err != nil {
+		return ErrDatabaseError
+	}
+	if count != 1 {
+		return ErrRememberTokenNotFound
+	}
+
+	now := time.Now().UTC()
+	if now.After(token.ExpiresAt) {
+		db.Delete(&token)
+		return ErrRememberTokenNotFound
+	}
+
+	validatorHash := hashRememberValidator(validator)
+	rotate := true
+	if subtle.ConstantTimeCompare([]byte(validatorHash), []byte(token.ValidatorHash)) != 1 {
+		inGracePeriod := token.RotatedAt.Valid && now.Sub(token.RotatedAt.Time) < rememberMeGracePeriod
+		if !inGracePeriod || subtle.ConstantTimeCompare([]byte(validatorHash), []byte(token.PreviousValidatorHash)) != 1 {
+			// The validator was already used, either by an attacker or by the owner of a stolen token
+			if err := m.InvalidateSessions(token.AuthID, token.AuthKey); err != nil {
+				return err
+			}
+			return errRememberTokenReused
+		}
+		rotate = false
+	}
+
+	model, ok := m.getUserModel(token.AuthKey, token.AuthID).(IdentifiedAuthModel)
+	if !ok {
+		return errRememberTokenUnusable
+	}
+
+	if rotate {
+		newValidator, err := randomHex(32)
+		if err != nil {
+			return err
+		}
+
+		// The condition on the validator prevents two concurrent rotations
+		res := db.Model(&utilitymodels.RememberToken{}).
+			Where("id = ? AND validator_hash = ?", token.ID, token.ValidatorHash).
+			Updates(map[string]any{
+				"validator_hash":          hashRememberValidator(newValidator),
+				"previous_validator_hash": token.ValidatorHash,
+				"rotated_at":              now,
+				"last_used_at":            sql.NullTime{Time: now, Valid: true},
+			})
+		if res.Error != nil {
+			return ErrDatabaseError
+		}
+		if res.RowsAffected != 1 {
+			return errRememberTokenRotated
+		}
+
+		setRememberCookie(c, config, selector+":"+newValidator, token.ExpiresAt)
+	}
+
+	return m.Login(model, c, true)
+}
+
+// forgetRememberedDevice deletes the remember me token of the current request and its cookie
+func forgetRememberedDevice(db *gorm.DB, c echo.Context, config *SessionConfig) error {
+	if config.RememberMe == nil {
+		return nil
+	}
+	cookie, err := c.Cookie(config.RememberMe.CookieName)
+	if err != nil {
+		return nil
+	}
+
+	selector, _, _ := strings.Cut(cookie.Value, ":")
+	if err := db.Where("selector = ?", selector).Delete(&utilitymodels.RememberToken{}).Error; err != nil {
+		return ErrDatabaseError
+	}
+	clearRememberCookie(c, config)
+	return nil
+}
+
+func setRememberCookie(c echo.Context, config *SessionConfig, value string, expiresAt time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     config.RememberMe.CookieName,
+		Value:    value,
+		Path:     config.CookiePath,
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+		Secure:   *config.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearRememberCookie(c echo.Context, config *SessionConfig) {
+	c.SetCookie(&http.Cookie{
+		Name:     config.RememberMe.CookieName,
+		Value:    "",
+		Path:     config.CookiePath,
+		MaxAge:   -1,
+		Secure:   *config.Secure,
+		HttpOnly: true,
+	})
+}
+
+func hashRememberValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(length int) (string, error) {
+	r := make([]byte, length)
+	if _, err := rand.Read(r); err != nil {
+		return "", ErrRandomFailed
+	}
+	return fmt.Sprintf("%x", r), nil
+}
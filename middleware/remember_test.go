@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// newTestRememberLogin returns a manager, in which alice has logged in and asked to be remembered.
+// The cookies only contain the remember me cookie, as if the session had expired.
+func newTestRememberLogin(t *testing.T) (*SessionManager, *gorm.DB, *utilitymodels.LocalUser, map[string]*http.Cookie) {
+	t.Helper()
+
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{
+		Secure:     &secure,
+		Store:      NewMemorySessionStore(),
+		RememberMe: &RememberMeConfig{},
+	})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		if err := m.Login(alice, c, true); err != nil {
+			return err
+		}
+		return RememberLogin(db, alice, c)
+	})
+	if cookies["remember_me"] == nil {
+		t.Fatal("expected a remember me cookie")
+	}
+	delete(cookies, "session_id")
+	return m, db, alice, cookies
+}
+
+func getTestRememberToken(t *testing.T, db *gorm.DB, cookie *http.Cookie) *utilitymodels.RememberToken {
+	t.Helper()
+
+	selector, _, _ := strings.Cut(cookie.Value, ":")
+	var token utilitymodels.RememberToken
+	if err := db.First(&token, "selector = ?", selector).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &token
+}
+
+func TestRememberMeRotation(t *testing.T) {
+	m, db, alice, cookies := newTestRememberLogin(t)
+	previous := cookies["remember_me"]
+	before := getTestRememberToken(t, db, previous)
+
+	assertTestUser(t, m, cookies, alice, nil)
+	if cookies["session_id"] == nil {
+		t.Fatal("expected a new session cookie")
+	}
+	if cookies["remember_me"].Value == previous.Value {
+		t.Fatal("expected the remember me cookie to be rotated")
+	}
+
+	after := getTestRememberToken(t, db, cookies["remember_me"])
+	if after.ID != before.ID || after.ValidatorHash == before.ValidatorHash ||
+		after.PreviousValidatorHash != before.ValidatorHash || !after.RotatedAt.Valid || !after.LastUsedAt.Valid {
+		t.Fatalf("unexpected token after rotation %+v", after)
+	}
+	if !after.ExpiresAt.Equal(before.ExpiresAt) {
+		t.Fatal("expected the rotation to keep the expiry")
+	}
+}
+
+func TestRememberMeGracePeriod(t *testing.T) {
+	m, db, alice, cookies := newTestRememberLogin(t)
+	previous := cookies["remember_me"]
+	assertTestUser(t, m, cookies, alice, nil)
+	rotated := getTestRememberToken(t, db, cookies["remember_me"])
+
+	// A concurrent request of the same browser still sends the previous validator
+	concurrent := map[string]*http.Cookie{"remember_me": previous}
+	assertTestUser(t, m, concurrent, alice, nil)
+	if concurrent["remember_me"].Value != previous.Value {
+		t.Fatal("expected the previous validator not to be rotated again")
+	}
+	if token := getTestRememberToken(t, db, previous); token.ValidatorHash != rotated.ValidatorHash {
+		t.Fatal("expected the token to be unchanged")
+	}
+
+	// No theft is assumed, the sessions of the login and of both requests are kept
+	sessions, err := m.GetSessionConfig().Store.GetByAuth(utilitymodels.LocalAuthKey, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %v", sessionIDs(sessions))
+	}
+}
+
+func TestRememberMeTheftDetection(t *testing.T) {
+	m, db, alice, cookies := newTestRememberLogin(t)
+	stolen := cookies["remember_me"]
+	assertTestUser(t, m, cookies, alice, nil)
+
+	// After the grace period, the previous validator is only known to an attacker or the victim
+	if err := db.Model(&utilitymodels.RememberToken{}).Where("id = ?", getTestRememberToken(t, db, stolen).ID).
+		Update("rotated_at", time.Now().UTC().Add(-2*rememberMeGracePeriod)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := map[string]*http.Cookie{"remember_me": stolen}
+	assertTestUser(t, m, attacker, nil, nil)
+	if attacker["remember_me"] != nil {
+		t.Fatal("expected the remember me cookie to be cleared")
+	}
+
+	// All sessions and remember me tokens of the user are revoked
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": cookies["session_id"]}, nil, nil)
+	tokens, err := GetRememberTokens(db, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("expected the remember me tokens to be deleted, got %d", len(tokens))
+	}
+	assertTestUser(t, m, map[string]*http.Cookie{"remember_me": cookies["remember_me"]}, nil, nil)
+}
+
+func TestRememberMeLogout(t *testing.T) {
+	m, db, alice, cookies := newTestRememberLogin(t)
+	assertTestUser(t, m, cookies, alice, nil)
+	remembered := cookies["remember_me"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Logout(c)
+	})
+	if cookies["remember_me"] != nil {
+		t.Fatal("expected the remember me cookie to be cleared")
+	}
+
+	tokens, err := GetRememberTokens(db, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("expected the remember me token to be deleted, got %d", len(tokens))
+	}
+
+	// The device isn't logged in again by its previous cookie
+	assertTestUser(t, m, map[string]*http.Cookie{"remember_me": remembered}, nil, nil)
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// RotateSession issues a new id for the current session, deletes the old one and sets the new cookie.
+// Use it whenever the privileges of a session change, e.g. after an elevation, to prevent session fixation.
+// Stateless sessions get a new cookie, but the previous cookie stays valid until it expires, use
+// InvalidateSessions to revoke it along with all other sessions of the user.
+// Returns ErrCookieNotFound if the request has no session.
+// The SessionManager of the Session middleware, which handled the request, is used. Parameter db is unused, it is
+// kept for compatibility.
+func RotateSession(db *gorm.DB, c echo.Context) error {
+	sessionContext, err := GetSessionContext(c)
+	if err != nil {
+		return err
+	}
+	return sessionContext.getManager().RotateSession(c)
+}
+
+// RotateSession rotates the current session, see the package function RotateSession
+func (m *SessionManager) RotateSession(c echo.Context) error {
+	sessionContext, err := m.getSessionContext(c)
+	if err != nil {
+		return err
+	}
+
+	// Stateless sessions have no id, sealing them again with a new nonce is the equivalent
+	if p := sessionContext.getStatelessSession(); p != nil {
+		rotated, err := p.rotated()
+		if err != nil {
+			return err
+		}
+		if err := issueStatelessSession(c, sessionContext.GetSessionConfig(), rotated); err != nil {
+			return err
+		}
+		sessionContext.setStatelessSession(rotated)
+		return nil
+	}
+
+	// Requests authenticated by an API token have no session
+	if sessionContext.GetSessionID() == nil {
+		return ErrCookieNotFound
+	}
+
+	session, err := sessionContext.GetSessionConfig().Store.Get(*sessionContext.GetSessionID())
+	if errors.Is(err, ErrSessionNotFound) {
+		return ErrCookieNotFound
+	} else if err != nil {
+		c.Logger().Error(err.Error())
+		return ErrDatabaseError
+	}
+
+	return rotateSession(c, sessionContext, session)
+}
+
+// rotateSession replaces the stored session by the given one with a new id
+func rotateSession(c echo.Context, sessionContext SessionContext, session *utilitymodels.Session) error {
+	config := sessionContext.GetSessionConfig()
+	oldSessionID := session.SessionID
+
+	rawSessionID, err := storeSession(c, config, session, func(s *utilitymodels.Session) error {
+		return config.Store.Rotate(oldSessionID, s)
+	})
+	if errors.Is(err, ErrSessionNotFound) {
+		// A concurrent request has rotated or deleted the session
+		return ErrCookieNotFound
+	} else if err != nil {
+		c.Logger().Errorf("Error rotating session: %s", err.Error())
+		return ErrDatabaseError
+	}
+
+	setSessionCookie(c, config, rawSessionID, session)
+	sessionContext.setSession(session)
+	return nil
+}
+
+// storeSession generates a new session id for the session and passes it to save until the id is not in use.
+// Returns the raw session id for the cookie, only its hash is stored.
+func storeSession(c echo.Context, config *SessionConfig, session *utilitymodels.Session, save func(*utilitymodels.Session) error) (string, error) {
+	r := make([]byte, 64)
+	for {
+		if _, err := rand.Read(r); err != nil {
+			c.Logger().Error("Error while generating random numbers")
+			continue
+		}
+		rawSessionID := fmt.Sprintf("%x", r)
+		session.SessionID = hashSessionID(config, rawSessionID)
+
+		if err := save(session); !errors.Is(err, ErrSessionExists) {
+			return rawSessionID, err
+		}
+		c.Logger().Debugf("Generated session_id already in database, regenerating ..")
+	}
+}
@@ -1,6 +1,11 @@
 package middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -10,10 +15,25 @@ import (
 
 type SessionContext interface {
 	GetUser() any
-	GetSessionID() *string
+	GetSessionID() *string // The hashed session id as stored in the SessionStore
 	IsAuthenticated() bool
+	IsSecondFactorPending() bool
+	IsTokenAuthenticated() bool
+	IsImpersonated() bool
+	GetImpersonator() any
+	HasScope(scope string) bool
 	GetSessionConfig() *SessionConfig
+	GetValue(key string, value any) (bool, error)
+	SetValue(key string, value any) error
+	DeleteValue(key string)
 	flush()
+	setSession(session *utilitymodels.Session)
+	getAuthIdentifier() (string, uint)
+	getStatelessSession() *statelessSession
+	setStatelessSession(p *statelessSession)
+	encodeData() ([]byte, error)
+	getManager() *SessionManager
+	getImpersonatorIdentifier() (string, uint)
 }
 
 // SessionConfig Set the parameters for the Session.
@@ -22,36 +42,134 @@ type SessionContext interface {
 // Parameter Secure defaults to true. If set, the cookie can only be sent through an HTTPS connection.
 // Parameter CookiePath defaults to "". Can be used to restrict the path the cookie can be sent to.
 // Parameter DisableLogging defaults to false. If set, no debug logs are sent. Error logs are still sent.
+// Parameter RequireVerifiedEmail defaults to false. If set, Login and LoginRequired refuse users implementing
+// EmailVerifiableAuthModel whose email is not verified.
+// Parameter AllowAPITokens defaults to false. If set, requests can authenticate with an "Authorization: Bearer <token>"
+// header instead of the cookie, see CreateAPIToken.
+// Parameter Store defaults to NewGormSessionStore with the database passed to Session.
+// Parameter IdleTimeout defaults to nil. If set, sessions expire after this duration without requests instead of
+// after CookieAge. The middleware extends ValidUntil and refreshes persistent cookies.
+// Parameter AbsoluteTimeout defaults to nil. If set, sessions expire this long after the login regardless of activity.
+// Parameter RenewalThreshold defaults to a quarter of IdleTimeout. ValidUntil is only extended if at least this much
+// time has passed since the last extension, which limits the writes to the SessionStore.
+// Parameter LastSeenInterval defaults to nil. LastSeenAt of the sessions, see GetSessions, is updated whenever
+// ValidUntil is extended. If set, it is additionally updated at most this often, e.g. time.Minute for a device list.
+// Every update is a write to the SessionStore. If neither IdleTimeout nor LastSeenInterval is set, LastSeenAt stays
+// at the time of the login.
+// Parameter SessionIDKey defaults to nil. Session ids are only stored hashed. If set, HMAC-SHA256 with this key is
+// used, else SHA-256.
+// Parameter Stateless defaults to nil. If set, sessions are sealed into the cookie instead of being stored in Store,
+// see StatelessConfig. Logout revokes all sessions of the user in this mode.
+// Parameter RememberMe defaults to nil. If set, RememberLogin can be used to issue long-lived tokens, which restore
+// a session once it has expired, see RememberMeConfig. Requires the database passed to Session.
+// Parameter Cache defaults to nil. If set, Store is wrapped with NewCachedSessionStore, see SessionCacheConfig.
+// Parameter MaxSessions defaults to 0, which allows any number of sessions per user. If set, Login enforces the limit
+// according to SessionLimitPolicy. Not supported with Stateless.
+// Parameter SessionLimitPolicy defaults to EvictOldestSession.
 type SessionConfig struct {
-	CookieName     string
-	CookieAge      *time.Duration
-	Secure         *bool
-	CookiePath     string
-	DisableLogging bool
+	CookieName           string
+	CookieAge            *time.Duration
+	Secure               *bool
+	CookiePath           string
+	DisableLogging       bool
+	RequireVerifiedEmail bool
+	AllowAPITokens       bool
+	Store                SessionStore
+	IdleTimeout          *time.Duration
+	AbsoluteTimeout      *time.Duration
+	RenewalThreshold     *time.Duration
+	LastSeenInterval     *time.Duration
+	SessionIDKey         []byte
+	Stateless            *StatelessConfig
+	RememberMe           *RememberMeConfig
+	Cache                *SessionCacheConfig
+	MaxSessions          int
+	SessionLimitPolicy   SessionLimitPolicy
 }
 
+// SessionLimitPolicy decides what Login does, if a user has reached SessionConfig.MaxSessions
+type SessionLimitPolicy int
+
+const (
+	// EvictOldestSession deletes the oldest sessions of the user to make room for the new one
+	EvictOldestSession SessionLimitPolicy = iota
+	// RefuseNewSession lets Login return ErrSessionLimitReached
+	RefuseNewSession
+)
+
 type s struct {
-	authModelID   uint
-	authModelKey  string
-	authenticated bool
-	sessionConfig *SessionConfig
-	sessionID     *string
+	authModelID         uint
+	authModelKey        string
+	authenticated       bool
+	secondFactorPending bool
+	sessionConfig       *SessionConfig
+	sessionID           *string
+	apiToken            *utilitymodels.APIToken
+	stateless           *statelessSession
+	data                map[string]json.RawMessage
+	dataChanged         bool
+	user                any
+	userIdentifier      *authIdentifier // Identifies the user the field user was loaded for
+	manager             *SessionManager
+	impersonatorKey     string
+	impersonatorID      uint
 }
 
-// GetUser Returns the pointer to a user model or nil if the request was unauthenticated
+// GetUser Returns the pointer to a user model or nil if the request was unauthenticated.
+// The user is loaded once per request.
 func (s *s) GetUser() any {
-	if f, exists := authMap[s.authModelKey]; !exists {
-		return nil
-	} else {
-		return f(s.authModelID)
+	identifier := authIdentifier{key: s.authModelKey, id: s.authModelID}
+	if s.userIdentifier != nil && *s.userIdentifier == identifier {
+		return s.user
 	}
+
+	s.user = s.manager.getUserModel(s.authModelKey, s.authModelID)
+	s.userIdentifier = &identifier
+	return s.user
 }
 
-// IsAuthenticated Returns true if the session of this request is valid
+// IsAuthenticated Returns true if the session of this request is valid and no second factor is pending
 func (s *s) IsAuthenticated() bool {
 	return s.authenticated
 }
 
+// IsSecondFactorPending Returns true if the user has logged in, but has not verified the second factor yet.
+// GetUser returns the user in this state, while IsAuthenticated returns false.
+func (s *s) IsSecondFactorPending() bool {
+	return s.secondFactorPending
+}
+
+// IsTokenAuthenticated Returns true if the request was authenticated by an API token instead of a cookie
+func (s *s) IsTokenAuthenticated() bool {
+	return s.apiToken != nil
+}
+
+// IsImpersonated Returns true if an admin has started the session with StartImpersonation
+func (s *s) IsImpersonated() bool {
+	return s.impersonatorKey != ""
+}
+
+// GetImpersonator Returns the pointer to the user model of the admin impersonating the user or nil.
+// GetUser returns the impersonated user.
+func (s *s) GetImpersonator() any {
+	if s.impersonatorKey == "" {
+		return nil
+	}
+	return s.manager.getUserModel(s.impersonatorKey, s.impersonatorID)
+}
+
+// HasScope Returns true if the request is authenticated and, in case of an API token, the token has the scope.
+// Requests authenticated by cookie have every scope.
+func (s *s) HasScope(scope string) bool {
+	if !s.authenticated {
+		return false
+	}
+	if s.apiToken != nil {
+		return s.apiToken.HasScope(scope)
+	}
+	return true
+}
+
 // GetSessionConfig Returns the config of the session middleware. Mostly for internal use of session.Login
 func (s *s) GetSessionConfig() *SessionConfig {
 	return s.sessionConfig
@@ -65,7 +183,52 @@ func (s *s) flush() {
 	s.authModelKey = ""
 	s.authModelID = 0
 	s.authenticated = false
+	s.secondFactorPending = false
+	s.sessionID = nil
+	s.apiToken = nil
+	s.stateless = nil
+	s.data = nil
+	s.dataChanged = false
+	s.impersonatorKey = ""
+	s.impersonatorID = 0
+}
+
+func (s *s) getImpersonatorIdentifier() (string, uint) {
+	return s.impersonatorKey, s.impersonatorID
+}
+
+func (s *s) getManager() *SessionManager {
+	return s.manager
+}
+
+func (s *s) getAuthIdentifier() (string, uint) {
+	return s.authModelKey, s.authModelID
+}
+
+// setSession replaces the session of the current request, e.g. after a login
+func (s *s) setSession(session *utilitymodels.Session) {
+	s.authModelKey = session.AuthKey
+	s.authModelID = session.AuthID
+	s.sessionID = &session.SessionID
+	s.apiToken = nil
+	s.stateless = nil
+	s.impersonatorKey = session.ImpersonatorKey
+	s.impersonatorID = session.ImpersonatorID
+	// Sessions of anonymous visitors have no auth key, they only carry data
+	s.authenticated = session.AuthKey != "" && !session.SecondFactorPending
+	s.secondFactorPending = session.AuthKey != "" && session.SecondFactorPending
+	s.loadData(session.Data)
+}
+
+func (s *s) getStatelessSession() *statelessSession {
+	return s.stateless
+}
+
+// setStatelessSession replaces the session of the current request by a stateless one
+func (s *s) setStatelessSession(p *statelessSession) {
+	s.setSession(p.toSession())
 	s.sessionID = nil
+	s.stateless = p
 }
 
 func (config *SessionConfig) FixSessionConfig() {
@@ -83,37 +246,104 @@ func (config *SessionConfig) FixSessionConfig() {
 	if config.CookiePath == "" {
 		config.CookiePath = "/"
 	}
+	if config.RememberMe != nil {
+		config.RememberMe.FixRememberMeConfig()
+	}
+	if config.IdleTimeout != nil && config.RenewalThreshold == nil {
+		threshold := *config.IdleTimeout / 4
+		config.RenewalThreshold = &threshold
+	}
 	return
 }
 
-var authMap map[string]func(uint) any
+// legacySessionIDLength is the length of session ids, which were stored before they were hashed
+const legacySessionIDLength = 128
 
-// RegisterAuthProvider is used to register a new auth provider besides the already existing ones.
-// The authIdentifier must be unique and is used to retrieve the correct UserModel with getUserModel which
-// should return its own user struct
-func RegisterAuthProvider(getProviderInformation func() (string, func(uint) any)) {
-	authIdentifier, getUserModel := getProviderInformation()
+// hashSessionID returns the value used to store the session of the given cookie value
+func hashSessionID(config *SessionConfig, rawSessionID string) string {
+	var sum []byte
+	if config.SessionIDKey != nil {
+		mac := hmac.New(sha256.New, config.SessionIDKey)
+		mac.Write([]byte(rawSessionID))
+		sum = mac.Sum(nil)
+	} else {
+		hash := sha256.Sum256([]byte(rawSessionID))
+		sum = hash[:]
+	}
+	return hex.EncodeToString(sum)
+}
+
+// storedSessionIDs returns the ids the session of the given cookie value may be stored with, including the
+// plaintext id of sessions stored before the ids were hashed
+func storedSessionIDs(config *SessionConfig, rawSessionID string) []string {
+	sessionIDs := []string{hashSessionID(config, rawSessionID)}
+	if len(rawSessionID) == legacySessionIDLength {
+		sessionIDs = append(sessionIDs, rawSessionID)
+	}
+	return sessionIDs
+}
+
+// deleteSession deletes the session of the given cookie value, including a session still stored with the plaintext id
+func deleteSession(config *SessionConfig, rawSessionID string) error {
+	for _, sessionID := range storedSessionIDs(config, rawSessionID) {
+		if err := config.Store.Delete(sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if authIdentifier == "" {
-		panic("invalid auth provider identifier")
+// lookupSession retrieves the session of the given cookie value. Sessions stored with their plaintext id are
+// migrated to the hashed id on first use.
+func lookupSession(config *SessionConfig, rawSessionID string) (*utilitymodels.Session, error) {
+	session, err := config.Store.Get(hashSessionID(config, rawSessionID))
+	if !errors.Is(err, ErrSessionNotFound) || len(rawSessionID) != legacySessionIDLength {
+		return session, err
 	}
 
-	if _, exists := authMap[authIdentifier]; exists {
-		panic("auth provider with that key already exists")
+	session, err = config.Store.Get(rawSessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	authMap[authIdentifier] = getUserModel
+	migrated := *session
+	migrated.ID = 0
+	migrated.SessionID = hashSessionID(config, rawSessionID)
+	if err := config.Store.Create(&migrated); errors.Is(err, ErrSessionExists) {
+		// A concurrent request has migrated the session already
+		return config.Store.Get(migrated.SessionID)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := config.Store.Delete(rawSessionID); err != nil {
+		return nil, err
+	}
+
+	return &migrated, nil
+}
+
+// RegisterAuthProvider is used to register a new auth provider besides the already existing ones.
+// The authIdentifier must be unique and is used to retrieve the correct UserModel with getUserModel which
+// should return its own user struct. The provider is available to every Session middleware, regardless of the order.
+// Use SessionManager.RegisterAuthProvider for providers of a single SessionManager.
+func RegisterAuthProvider(getProviderInformation func() (string, func(uint) any)) {
+	defaultRegistry.register(getProviderInformation)
 }
 
 // Session Use as middleware. Requires CustomContext to be set with a corresponding struct that embeds SessionContext
 // or has a field named SessionContext. If SessionContext is not found, the middleware is skipped.
+// A SessionManager sharing the providers of RegisterAuthProvider is created, which is used by the package functions.
 func Session(db *gorm.DB, config *SessionConfig) echo.MiddlewareFunc {
-	if config == nil {
-		config = &SessionConfig{}
-	}
-	config.FixSessionConfig()
+	m := NewSessionManager(db, config)
+	m.registry = defaultRegistry
+	setDefaultManager(m)
+
+	return m.Middleware()
+}
 
-	authMap = map[string]func(foreign uint) any{}
+// Middleware Returns the session middleware of this manager, see Session
+func (m *SessionManager) Middleware() echo.MiddlewareFunc {
+	db, config := m.db, m.config
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -123,46 +353,85 @@ func Session(db *gorm.DB, config *SessionConfig) echo.MiddlewareFunc {
 				authModelKey:  "",
 				authenticated: false,
 				sessionConfig: config,
+				manager:       m,
 			}
 
-			// Check if cookie is present
-			if cookie, err := c.Cookie(config.CookieName); err != nil {
+			// Check if an API token is present, it takes precedence over the cookie
+			if token, ok := getBearerToken(c); config.AllowAPITokens && ok {
+				if apiToken := lookupAPIToken(db, c, config, token); apiToken != nil {
+					sessionContext.authModelKey = apiToken.AuthKey
+					sessionContext.authModelID = apiToken.AuthID
+					sessionContext.apiToken = apiToken
+
+					if sessionContext.GetUser() != nil {
+						sessionContext.authenticated = true
+					}
+				}
+			} else if cookie, err := c.Cookie(config.CookieName); err != nil {
 				// No need to do something, default values of sessionContext are fine
 				if !config.DisableLogging {
 					c.Logger().Debugf("Cookie \"%s\" is not present in request", config.CookieName)
 				}
+			} else if config.Stateless != nil {
+				// The session is sealed into the cookie, there is nothing to look up besides the revision
+				if p := lookupStatelessSession(c, config, cookie.Value); p != nil {
+					renewStatelessSession(c, config, p)
+					sessionContext.setStatelessSession(p)
+
+					if sessionContext.GetUser() == nil {
+						sessionContext.authenticated = false
+						sessionContext.secondFactorPending = false
+					}
+				}
 			} else {
 
-				var sessionCount int64
-				var session utilitymodels.Session
-				db.Find(&session, "session_id = ?", cookie.Value).Count(&sessionCount)
-				switch sessionCount {
-				case 0:
+				session, err := lookupSession(config, cookie.Value)
+				switch {
+				case errors.Is(err, ErrSessionNotFound):
 					// No session with that id was found
 					if !config.DisableLogging {
 						c.Logger().Debugf("Cookie with SessionID %s was not found in DB", cookie.Value)
 					}
-				case 1:
+				case err != nil:
+					c.Logger().Errorf("Error retrieving session: %s", err.Error())
+				default:
 					// Session was found
 
 					// Check if session is not expired
 					if !time.Now().UTC().After(session.ValidUntil) {
+						renewSession(c, config, session, cookie.Value)
+
 						sessionContext.authModelKey = session.AuthKey
 						sessionContext.authModelID = session.AuthID
 						sessionContext.sessionID = &session.SessionID
+						sessionContext.loadData(session.Data)
+						sessionContext.impersonatorKey = session.ImpersonatorKey
+						sessionContext.impersonatorID = session.ImpersonatorID
 
 						if sessionContext.GetUser() != nil {
-							sessionContext.authenticated = true
+							if session.SecondFactorPending {
+								sessionContext.secondFactorPending = true
+							} else {
+								sessionContext.authenticated = true
+							}
 						}
 					}
-
-				default:
-					// This is broken!1!!1elf!
 				}
 			}
 
 			// Set SessionContext
 			c.Set("SessionContext", sessionContext)
+
+			// A remembered device gets a new session, if it has none
+			if config.RememberMe != nil && !sessionContext.IsAuthenticated() && !sessionContext.IsSecondFactorPending() &&
+				!sessionContext.IsTokenAuthenticated() {
+				m.restoreRememberedLogin(c)
+			}
+
+			// Changed values are saved before the response is written, so a new cookie can still be set
+			c.Response().Before(func() {
+				saveSessionData(c, sessionContext)
+			})
 			return next(c)
 		}
 	}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func TestDeleteSessionDeletesLegacySession(t *testing.T) {
+	config := &SessionConfig{Store: NewMemorySessionStore()}
+
+	legacyID := strings.Repeat("a", legacySessionIDLength)
+	if err := config.Store.Create(newTestSession(legacyID, 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Store.Create(newTestSession(hashSessionID(config, "current"), 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions stored with their plaintext id before the ids were hashed are deleted as well
+	if err := deleteSession(config, legacyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Store.Get(legacyID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+
+	if err := deleteSession(config, "current"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Store.Get(hashSessionID(config, "current")); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+}
+
+func TestLegacySessionIDMigration(t *testing.T) {
+	for name, key := range map[string][]byte{"sha256": nil, "hmac": []byte("0123456789abcdef0123456789abcdef")} {
+		t.Run(name, func(t *testing.T) {
+			db := testutil.OpenTestDB(t)
+			alice := createTestUser(t, db, "alice")
+			secure := false
+			m := NewSessionManager(db, &SessionConfig{Secure: &secure, Store: NewMemorySessionStore(), SessionIDKey: key})
+			m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+			store := m.GetSessionConfig().Store
+
+			// A session stored with its plaintext id, before the ids were hashed
+			legacyID := strings.Repeat("a", legacySessionIDLength)
+			legacy := newTestSession(legacyID, alice.ID, time.Hour)
+			legacy.Data = []byte(`{"theme":"dark"}`)
+			if err := store.Create(legacy); err != nil {
+				t.Fatal(err)
+			}
+
+			cookies := map[string]*http.Cookie{"session_id": {Name: "session_id", Value: legacyID}}
+			assertTestUser(t, m, cookies, alice, nil)
+
+			if _, err := store.Get(legacyID); !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected the plaintext id to be removed, got %v", err)
+			}
+			migrated, err := store.Get(hashSessionID(m.GetSessionConfig(), legacyID))
+			if err != nil {
+				t.Fatalf("expected the session to be stored with the hashed id, got %v", err)
+			}
+			if migrated.AuthID != alice.ID || migrated.PublicID != legacy.PublicID || string(migrated.Data) != `{"theme":"dark"}` {
+				t.Fatalf("unexpected migrated session %+v", migrated)
+			}
+
+			// The cookie keeps working with the migrated session
+			assertTestUser(t, m, cookies, alice, nil)
+			if cookies["session_id"].Value != legacyID {
+				t.Fatal("expected the cookie to be unchanged")
+			}
+		})
+	}
+}
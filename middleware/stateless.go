@@ -0,0 +1,406 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidStatelessCookie = errors.New("stateless session cookie is invalid")
+)
+
+// StatelessConfig Set the parameters of stateless sessions, which are sealed into the cookie instead of being stored.
+// Parameter Keys is required. AES keys of 16, 24 or 32 bytes. The first key seals new cookies, all keys are used to
+// open cookies. Rotate keys by prepending a new key and removing the last one once its cookies have expired.
+// Parameter Revocations defaults to NewGormRevocationStore with the database passed to Session, or to
+// NewMemoryRevocationStore if that is nil. It is queried on every request, unless RevocationCacheTTL is set.
+// Parameter RevocationCacheTTL defaults to nil. If set, Revocations is wrapped with NewCachedRevocationStore, so it is
+// queried at most once per user within this duration. Revocations of other instances take up to this long to apply.
+type StatelessConfig struct {
+	Keys               [][]byte
+	Revocations        RevocationStore
+	RevocationCacheTTL *time.Duration
+}
+
+func (config *StatelessConfig) FixStatelessConfig(db *gorm.DB) {
+	if len(config.Keys) == 0 {
+		panic("stateless sessions require at least one key")
+	}
+	for _, key := range config.Keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			panic("invalid stateless session key: " + err.Error())
+		}
+	}
+	if config.Revocations == nil {
+		if db != nil {
+			config.Revocations = NewGormRevocationStore(db)
+		} else {
+			config.Revocations = NewMemoryRevocationStore()
+		}
+	}
+	// The config may be passed to Session again, the store must not be wrapped twice
+	if _, cached := config.Revocations.(*cachedRevocationStore); config.RevocationCacheTTL != nil && !cached {
+		config.Revocations = NewCachedRevocationStore(config.Revocations, *config.RevocationCacheTTL)
+	}
+}
+
+// RevocationStore keeps a revision per user. Stateless sessions are sealed with the current revision of their user,
+// incrementing it with Revoke invalidates all of them. Implementations must be safe for concurrent use.
+type RevocationStore interface {
+	GetRevision(authKey string, authID uint) (uint64, error)
+	Revoke(authKey string, authID uint) (uint64, error)
+}
+
+type gormRevocationStore struct {
+	db *gorm.DB
+}
+
+// NewGormRevocationStore creates a RevocationStore using utilitymodels.SessionRevocation
+func NewGormRevocationStore(db *gorm.DB) RevocationStore {
+	return &gormRevocationStore{db: db}
+}
+
+func (g *gormRevocationStore) GetRevision(authKey string, authID uint) (uint64, error) {
+	var revocation utilitymodels.SessionRevocation
+	var count int64
+
+	if err := g.db.Find(&revocation, "auth_key = ? AND auth_id = ?", authKey, authID).Count(&count).Error; err != nil {
+		return 0, ErrDatabaseError
+	}
+	if count != 1 {
+		return 0, nil
+	}
+	return revocation.Revision, nil
+}
+
+func (g *gormRevocationStore) Revoke(authKey string, authID uint) (uint64, error) {
+	var revision uint64
+
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&utilitymodels.SessionRevocation{
+			AuthKey: authKey,
+			AuthID:  authID,
+		}).Error; err != nil {
+			return err
+		}
+
+		var revocation utilitymodels.SessionRevocation
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			First(&revocation, "auth_key = ? AND auth_id = ?", authKey, authID).Error; err != nil {
+			return err
+		}
+
+		revocation.Revision++
+		revision = revocation.Revision
+		return tx.Save(&revocation).Error
+	})
+	if err != nil {
+		return 0, ErrDatabaseError
+	}
+
+	return revision, nil
+}
+
+type memoryRevocationStore struct {
+	lock      sync.Mutex
+	revisions map[authIdentifier]uint64
+}
+
+// NewMemoryRevocationStore creates a RevocationStore keeping the revisions in memory. Revocations are lost on restart
+// and are not shared between instances.
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{
+		revisions: map[authIdentifier]uint64{},
+	}
+}
+
+func (m *memoryRevocationStore) GetRevision(authKey string, authID uint) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.revisions[authIdentifier{key: authKey, id: authID}], nil
+}
+
+func (m *memoryRevocationStore) Revoke(authKey string, authID uint) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	identifier := authIdentifier{key: authKey, id: authID}
+	m.revisions[identifier]++
+	return m.revisions[identifier], nil
+}
+
+// cachedRevision is a revision read from the wrapped store
+type cachedRevision struct {
+	revision  uint64
+	expiresAt time.Time
+}
+
+type cachedRevocationStore struct {
+	store     RevocationStore
+	ttl       time.Duration
+	lock      sync.Mutex
+	revisions map[authIdentifier]cachedRevision
+	pruneAt   time.Time
+}
+
+// NewCachedRevocationStore wraps a RevocationStore and caches the revisions for ttl. Revocations of this instance
+// apply immediately, revocations of other instances sharing the store apply once the cached revision has expired.
+func NewCachedRevocationStore(store RevocationStore, ttl time.Duration) RevocationStore {
+	return &cachedRevocationStore{
+		store:     store,
+		ttl:       ttl,
+		revisions: map[authIdentifier]cachedRevision{},
+	}
+}
+
+func (r *cachedRevocationStore) GetRevision(authKey string, authID uint) (uint64, error) {
+	identifier := authIdentifier{key: authKey, id: authID}
+	now := time.Now()
+
+	r.lock.Lock()
+	cached, exists := r.revisions[identifier]
+	r.lock.Unlock()
+	if exists && now.Before(cached.expiresAt) {
+		return cached.revision, nil
+	}
+
+	revision, err := r.store.GetRevision(authKey, authID)
+	if err != nil {
+		return 0, err
+	}
+	r.cache(identifier, revision, now)
+	return revision, nil
+}
+
+func (r *cachedRevocationStore) Revoke(authKey string, authID uint) (uint64, error) {
+	revision, err := r.store.Revoke(authKey, authID)
+	if err != nil {
+		return 0, err
+	}
+	r.cache(authIdentifier{key: authKey, id: authID}, revision, time.Now())
+	return revision, nil
+}
+
+// cache stores the revision, unless a newer one is cached already. Expired revisions are removed once per ttl, so
+// the cache only holds the users of the last two ttl.
+func (r *cachedRevocationStore) cache(identifier authIdentifier, revision uint64, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !now.Before(r.pruneAt) {
+		for cachedIdentifier, cached := range r.revisions {
+			if !now.Before(cached.expiresAt) {
+				delete(r.revisions, cachedIdentifier)
+			}
+		}
+		r.pruneAt = now.Add(r.ttl)
+	}
+	if cached, exists := r.revisions[identifier]; exists && cached.revision > revision {
+		return
+	}
+	r.revisions[identifier] = cachedRevision{revision: revision, expiresAt: now.Add(r.ttl)}
+}
+
+// statelessSession is the content of a stateless session cookie
+type statelessSession struct {
+	AuthKey             string          `json:"k"`
+	AuthID              uint            `json:"i"`
+	CreatedAt           int64           `json:"c"`
+	ValidUntil          int64           `json:"v"`
+	SecondFactorPending bool            `json:"p,omitempty"`
+	Persistent          bool            `json:"s,omitempty"`
+	Revision            uint64          `json:"r"`
+	Data                json.RawMessage `json:"d,omitempty"`
+	// Nonce is random and identifies the session, e.g. for the CSRF binding. It is replaced when the session is
+	// rotated. Cookies sealed before it was introduced have none.
+	Nonce string `json:"n,omitempty"`
+}
+
+func newStatelessSession(session *utilitymodels.Session, revision uint64) (*statelessSession, error) {
+	nonce, err := generateStatelessNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return &statelessSession{
+		AuthKey:             session.AuthKey,
+		AuthID:              session.AuthID,
+		CreatedAt:           session.CreatedAt.Unix(),
+		ValidUntil:          session.ValidUntil.Unix(),
+		SecondFactorPending: session.SecondFactorPending,
+		Persistent:          session.Persistent,
+		Revision:            revision,
+		Data:                session.Data,
+		Nonce:               nonce,
+	}, nil
+}
+
+// rotated returns a copy of the session with a new nonce, the equivalent of a new session id.
+// Unlike a stored session, the previous cookie can't be deleted. It stays valid with its previous content, e.g. a
+// pending second factor, until it expires or the sessions of the user are revoked.
+func (p *statelessSession) rotated() (*statelessSession, error) {
+	nonce, err := generateStatelessNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := *p
+	rotated.Nonce = nonce
+	return &rotated, nil
+}
+
+func generateStatelessNonce() (string, error) {
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return "", ErrRandomFailed
+	}
+	return base64.RawURLEncoding.EncodeToString(r), nil
+}
+
+func (p *statelessSession) toSession() *utilitymodels.Session {
+	session := &utilitymodels.Session{
+		AuthKey:             p.AuthKey,
+		AuthID:              p.AuthID,
+		ValidUntil:          time.Unix(p.ValidUntil, 0).UTC(),
+		SecondFactorPending: p.SecondFactorPending,
+		Persistent:          p.Persistent,
+		Data:                p.Data,
+	}
+	session.CreatedAt = time.Unix(p.CreatedAt, 0).UTC()
+	return session
+}
+
+// sealStatelessSession encrypts the session with the first key. The cookie name is authenticated as well,
+// so a cookie can't be replayed under a different name.
+func sealStatelessSession(config *SessionConfig, p *statelessSession) (string, error) {
+	plaintext, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newStatelessAEAD(config.Stateless.Keys[0])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", ErrRandomFailed
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(config.CookieName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openStatelessSession decrypts the cookie with any key of the key ring
+func openStatelessSession(config *SessionConfig, value string) (*statelessSession, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidStatelessCookie
+	}
+
+	for _, key := range config.Stateless.Keys {
+		aead, err := newStatelessAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrInvalidStatelessCookie
+		}
+
+		plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(config.CookieName))
+		if err != nil {
+			continue
+		}
+
+		var p statelessSession
+		if err := json.Unmarshal(plaintext, &p); err != nil {
+			return nil, ErrInvalidStatelessCookie
+		}
+		return &p, nil
+	}
+
+	return nil, ErrInvalidStatelessCookie
+}
+
+func newStatelessAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// lookupStatelessSession returns the session of the cookie, if it is valid, not expired and not revoked
+func lookupStatelessSession(c echo.Context, config *SessionConfig, value string) *statelessSession {
+	p, err := openStatelessSession(config, value)
+	if err != nil {
+		if !config.DisableLogging {
+			c.Logger().Debugf("Stateless session cookie could not be opened")
+		}
+		return nil
+	}
+
+	if time.Now().UTC().After(time.Unix(p.ValidUntil, 0)) {
+		return nil
+	}
+
+	revision, err := config.Stateless.Revocations.GetRevision(p.AuthKey, p.AuthID)
+	if err != nil {
+		c.Logger().Errorf("Error retrieving session revision: %s", err.Error())
+		return nil
+	}
+	if p.Revision < revision {
+		if !config.DisableLogging {
+			c.Logger().Debugf("Stateless session of %s %d was revoked", p.AuthKey, p.AuthID)
+		}
+		return nil
+	}
+
+	return p
+}
+
+// issueStatelessSession seals the session into the cookie
+func issueStatelessSession(c echo.Context, config *SessionConfig, p *statelessSession) error {
+	value, err := sealStatelessSession(config, p)
+	if err != nil {
+		c.Logger().Errorf("Error sealing session: %s", err.Error())
+		return err
+	}
+
+	setSessionCookie(c, config, value, p.toSession())
+	return nil
+}
+
+// renewStatelessSession extends the session like renewSession does for stored sessions by issuing a new cookie
+func renewStatelessSession(c echo.Context, config *SessionConfig, p *statelessSession) {
+	if config.IdleTimeout == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	session := p.toSession()
+	validUntil := sessionValidUntil(config, session.CreatedAt, now)
+
+	elapsed := *config.IdleTimeout - session.ValidUntil.Sub(now)
+	if elapsed < *config.RenewalThreshold || !validUntil.After(session.ValidUntil) {
+		return
+	}
+
+	renewed := *p
+	renewed.ValidUntil = validUntil.Unix()
+	if err := issueStatelessSession(c, config, &renewed); err == nil {
+		*p = renewed
+	}
+}
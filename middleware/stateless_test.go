@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+func TestStatelessCSRFBinding(t *testing.T) {
+	config := &SessionConfig{Stateless: &StatelessConfig{Keys: [][]byte{make([]byte, 32)}}}
+	config.FixSessionConfig()
+	config.Stateless.FixStatelessConfig(nil)
+
+	binding := func(p *statelessSession) string {
+		t.Helper()
+
+		value, ok := csrfSessionBinding(&s{sessionConfig: config, stateless: p})
+		if !ok {
+			t.Fatal("expected a binding")
+		}
+		return value
+	}
+
+	// Two logins of the same user within the same second get different bindings
+	now := time.Now().UTC()
+	session := &utilitymodels.Session{AuthKey: "local", AuthID: 1, ValidUntil: now.Add(time.Hour)}
+	session.CreatedAt = now
+	first, err := newStatelessSession(session, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newStatelessSession(session, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding(first) == binding(second) {
+		t.Fatal("expected different bindings for different sessions")
+	}
+
+	// The nonce is sealed into the cookie
+	value, err := sealStatelessSession(config, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	opened := lookupStatelessSession(c, config, value)
+	if opened == nil || binding(opened) != binding(first) {
+		t.Fatalf("expected the binding to survive sealing, got %+v", opened)
+	}
+
+	rotated, err := first.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding(rotated) == binding(first) || rotated.AuthID != first.AuthID || rotated.CreatedAt != first.CreatedAt {
+		t.Fatalf("expected only the nonce to change, got %+v", rotated)
+	}
+}
+
+func newTestStatelessManager(t *testing.T, stateless *StatelessConfig) (*SessionManager, *utilitymodels.LocalUser) {
+	t.Helper()
+
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	stateless.Keys = [][]byte{make([]byte, 32)}
+	m := NewSessionManager(db, &SessionConfig{Secure: &secure, Stateless: stateless})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	return m, alice
+}
+
+func TestStatelessSessions(t *testing.T) {
+	m, alice := newTestStatelessManager(t, &StatelessConfig{})
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(alice, c, true)
+	})
+	assertTestUser(t, m, cookies, alice, nil)
+	if sessions, _ := m.GetSessionConfig().Store.GetByAuth(utilitymodels.LocalAuthKey, alice.ID); len(sessions) != 0 {
+		t.Fatalf("expected no stored sessions, got %v", sessionIDs(sessions))
+	}
+
+	// The previous cookie stays valid after a rotation, as it can't be deleted
+	previous := cookies["session_id"]
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.RotateSession(c)
+	})
+	if cookies["session_id"].Value == previous.Value {
+		t.Fatal("expected a new cookie")
+	}
+	assertTestUser(t, m, cookies, alice, nil)
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": previous}, alice, nil)
+
+	// Logout revokes every cookie of the user
+	loggedIn := cookies["session_id"]
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Logout(c)
+	})
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": loggedIn}, nil, nil)
+	assertTestUser(t, m, map[string]*http.Cookie{"session_id": previous}, nil, nil)
+
+	// A new login gets the current revision
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(alice, c, true)
+	})
+	assertTestUser(t, m, cookies, alice, nil)
+}
+
+func TestStatelessSecondFactor(t *testing.T) {
+	m, alice := newTestStatelessManager(t, &StatelessConfig{})
+	if err := m.db.Model(alice).Update("totp_enabled", true).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := map[string]*http.Cookie{}
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		return m.Login(alice, c, true)
+	})
+	pending := cookies["session_id"]
+
+	serveTestSession(t, m, cookies, func(c echo.Context) error {
+		sessionContext, _ := GetSessionContext(c)
+		if sessionContext.IsAuthenticated() || !sessionContext.IsSecondFactorPending() {
+			t.Fatal("expected the second factor to be pending")
+		}
+		return m.CompleteSecondFactor(c)
+	})
+	assertTestUser(t, m, cookies, alice, nil)
+
+	// The previous cookie still has the second factor pending
+	serveTestSession(t, m, map[string]*http.Cookie{"session_id": pending}, func(c echo.Context) error {
+		sessionContext, _ := GetSessionContext(c)
+		if sessionContext.IsAuthenticated() || !sessionContext.IsSecondFactorPending() {
+			t.Fatal("expected the previous cookie to keep the pending second factor")
+		}
+		return nil
+	})
+}
+
+func TestCachedRevocationStore(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	shared := NewMemoryRevocationStore()
+	cached := NewCachedRevocationStore(shared, ttl)
+
+	if revision, err := cached.GetRevision("local", 1); err != nil || revision != 0 {
+		t.Fatalf("expected revision 0, got %d, %v", revision, err)
+	}
+
+	// Revocations of another instance apply once the cached revision has expired
+	if _, err := shared.Revoke("local", 1); err != nil {
+		t.Fatal(err)
+	}
+	if revision, _ := cached.GetRevision("local", 1); revision != 0 {
+		t.Fatalf("expected the cached revision 0, got %d", revision)
+	}
+	time.Sleep(ttl)
+	if revision, _ := cached.GetRevision("local", 1); revision != 1 {
+		t.Fatalf("expected revision 1 after the ttl, got %d", revision)
+	}
+
+	// Revocations of this instance apply immediately
+	if revision, err := cached.Revoke("local", 1); err != nil || revision != 2 {
+		t.Fatalf("expected revision 2, got %d, %v", revision, err)
+	}
+	if revision, _ := cached.GetRevision("local", 1); revision != 2 {
+		t.Fatalf("expected revision 2, got %d", revision)
+	}
+	if revision, _ := cached.GetRevision("local", 2); revision != 0 {
+		t.Fatalf("expected other users to be unaffected, got %d", revision)
+	}
+}
+
+func TestStatelessRevocationCacheTTL(t *testing.T) {
+	ttl := time.Minute
+	m, _ := newTestStatelessManager(t, &StatelessConfig{RevocationCacheTTL: &ttl})
+
+	revocations := m.GetSessionConfig().Stateless.Revocations
+	cached, ok := revocations.(*cachedRevocationStore)
+	if !ok || cached.ttl != ttl {
+		t.Fatalf("expected the revocations to be cached, got %T", revocations)
+	}
+	if _, ok := cached.store.(*gormRevocationStore); !ok {
+		t.Fatalf("expected the gorm store to be wrapped, got %T", cached.store)
+	}
+
+	// Passing the config again doesn't wrap the store twice
+	m.GetSessionConfig().Stateless.FixStatelessConfig(m.db)
+	if m.GetSessionConfig().Stateless.Revocations != revocations {
+		t.Fatal("expected the store not to be wrapped again")
+	}
+}
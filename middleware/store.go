@@ -0,0 +1,508 @@
+package middleware
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionExists       = errors.New("session with that id already exists")
+	ErrSessionLimitReached = errors.New("maximum number of sessions reached")
+	ErrInvalidSessionField = errors.New("invalid session field")
+)
+
+// SessionStore persists the sessions of the Session middleware. Implementations must be safe for concurrent use.
+// Get returns ErrSessionNotFound if there is no session with that id. Expired sessions may be returned,
+// the middleware checks ValidUntil itself. Create returns ErrSessionExists if the session id is already in use.
+// Rotate atomically replaces the session with oldSessionID by the given session, which has a new id. It returns
+// ErrSessionNotFound if the old session doesn't exist and ErrSessionExists if the new id is already in use.
+// GetByAuth returns all sessions of a user, expired sessions may be included. DeleteByAuth deletes all sessions of
+// a user, including the sessions in which the user impersonates another user, see StartImpersonation.
+// Update writes the given fields of the session, e.g. "ValidUntil", and UpdatedAt. Other fields keep their stored
+// value, so concurrent updates of different fields don't overwrite each other. All fields except the ids, CreatedAt
+// and the users of the session are written if no field is given. Returns ErrInvalidSessionField for unknown or
+// immutable fields.
+// CreateLimited creates the session like Create, if its user has less than limit valid sessions. Else the oldest
+// sessions are deleted if evictOldest is set, or ErrSessionLimitReached is returned. Concurrent calls for the same
+// user must not exceed the limit. The sessions with the replaced ids, e.g. the previous session of the client, don't
+// count toward the limit and are deleted together with the creation, so they are kept if the limit is reached.
+type SessionStore interface {
+	Get(sessionID string) (*utilitymodels.Session, error)
+	GetByAuth(authKey string, authID uint) ([]utilitymodels.Session, error)
+	Create(session *utilitymodels.Session) error
+	CreateLimited(session *utilitymodels.Session, limit int, evictOldest bool, replaced ...string) error
+	Rotate(oldSessionID string, session *utilitymodels.Session) error
+	Update(session *utilitymodels.Session, fields ...string) error
+	Delete(sessionID string) error
+	DeleteByAuth(authKey string, authID uint) error
+}
+
+type gormSessionStore struct {
+	db *gorm.DB
+}
+
+// NewGormSessionStore creates a SessionStore using utilitymodels.Session. This is the default store.
+func NewGormSessionStore(db *gorm.DB) SessionStore {
+	return &gormSessionStore{db: db}
+}
+
+func (g *gormSessionStore) Get(sessionID string) (*utilitymodels.Session, error) {
+	var session utilitymodels.Session
+	var count int64
+
+	if err := g.db.Find(&session, "session_id = ?", sessionID).Count(&count).Error; err != nil {
+		return nil, ErrDatabaseError
+	}
+	if count != 1 {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+func (g *gormSessionStore) GetByAuth(authKey string, authID uint) ([]utilitymodels.Session, error) {
+	var sessions []utilitymodels.Session
+	if err := g.db.Find(&sessions, "auth_id = ? AND auth_key = ?", authID, authKey).Error; err != nil {
+		return nil, ErrDatabaseError
+	}
+	return sessions, nil
+}
+
+func (g *gormSessionStore) Create(session *utilitymodels.Session) error {
+	if _, err := g.Get(session.SessionID); err == nil {
+		return ErrSessionExists
+	} else if !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+
+	if err := g.db.Create(session).Error; err != nil {
+		return ErrDatabaseError
+	}
+	return nil
+}
+
+func (g *gormSessionStore) CreateLimited(session *utilitymodels.Session, limit int, evictOldest bool, replaced ...string) error {
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		// Concurrent logins of the user wait for the lock
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&utilitymodels.SessionLock{
+			AuthKey: session.AuthKey,
+			AuthID:  session.AuthID,
+		}).Error; err != nil {
+			return err
+		}
+		var lock utilitymodels.SessionLock
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			First(&lock, "auth_key = ? AND auth_id = ?", session.AuthKey, session.AuthID).Error; err != nil {
+			return err
+		}
+
+		store := &gormSessionStore{db: tx}
+		sessions, err := store.GetByAuth(session.AuthKey, session.AuthID)
+		if err != nil {
+			return err
+		}
+		if err := enforceSessionLimit(store, withoutSessions(sessions, replaced), limit, evictOldest); err != nil {
+			return err
+		}
+		if len(replaced) > 0 {
+			if err := tx.Where("session_id IN ?", replaced).Delete(&utilitymodels.Session{}).Error; err != nil {
+				return err
+			}
+		}
+		return store.Create(session)
+	})
+	if err != nil && !errors.Is(err, ErrSessionExists) && !errors.Is(err, ErrSessionLimitReached) {
+		return ErrDatabaseError
+	}
+	return err
+}
+
+func (g *gormSessionStore) Rotate(oldSessionID string, session *utilitymodels.Session) error {
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("session_id = ?", oldSessionID).Delete(&utilitymodels.Session{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrSessionNotFound
+		}
+
+		var count int64
+		if err := tx.Model(&utilitymodels.Session{}).Where("session_id = ?", session.SessionID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 0 {
+			return ErrSessionExists
+		}
+
+		session.ID = 0
+		return tx.Create(session).Error
+	})
+	if err != nil && !errors.Is(err, ErrSessionNotFound) && !errors.Is(err, ErrSessionExists) {
+		return ErrDatabaseError
+	}
+	return err
+}
+
+func (g *gormSessionStore) Update(session *utilitymodels.Session, fields ...string) error {
+	if err := checkSessionFields(fields); err != nil {
+		return err
+	}
+
+	query := g.db.Model(&utilitymodels.Session{}).Where("session_id = ?", session.SessionID)
+	if len(fields) == 0 {
+		query = query.Select("*").Omit("id", "created_at", "session_id", "auth_key", "auth_id", "impersonator_key", "impersonator_id")
+	} else {
+		query = query.Select(append(fields, "UpdatedAt"))
+	}
+	if err := query.Updates(session).Error; err != nil {
+		return ErrDatabaseError
+	}
+	return nil
+}
+
+func (g *gormSessionStore) Delete(sessionID string) error {
+	if err := g.db.Where("session_id = ?", sessionID).Delete(&utilitymodels.Session{}).Error; err != nil {
+		return ErrDatabaseError
+	}
+	return nil
+}
+
+func (g *gormSessionStore) DeleteByAuth(authKey string, authID uint) error {
+	if err := g.db.Where("(auth_id = ? AND auth_key = ?) OR (impersonator_id = ? AND impersonator_key = ?)", authID, authKey, authID, authKey).
+		Delete(&utilitymodels.Session{}).Error; err != nil {
+		return ErrDatabaseError
+	}
+	return nil
+}
+
+func (g *gormSessionStore) deleteExpired(batchSize int) (int64, error) {
+	return ReapExpiredSessions(g.db, batchSize)
+}
+
+type memorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]utilitymodels.Session
+	// byAuth references the sessions of a user and the sessions in which the user impersonates another user
+	byAuth map[authIdentifier]map[string]struct{}
+}
+
+type authIdentifier struct {
+	key string
+	id  uint
+}
+
+// NewMemorySessionStore creates a SessionStore keeping all sessions in memory. Sessions are lost on restart
+// and are not shared between instances. Expired sessions are removed when they are accessed. Sessions which are
+// never accessed again are only removed by a SessionReaper with this store as ReaperConfig.Store.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		sessions: map[string]utilitymodels.Session{},
+		byAuth:   map[authIdentifier]map[string]struct{}{},
+	}
+}
+
+func (m *memorySessionStore) Get(sessionID string) (*utilitymodels.Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+	if time.Now().UTC().After(session.ValidUntil) {
+		m.delete(sessionID)
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+func (m *memorySessionStore) GetByAuth(authKey string, authID uint) ([]utilitymodels.Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.getByAuth(authIdentifier{key: authKey, id: authID}), nil
+}
+
+// getByAuth returns the sessions of a user without those the user impersonates with, the lock must be held
+func (m *memorySessionStore) getByAuth(identifier authIdentifier) []utilitymodels.Session {
+	sessions := make([]utilitymodels.Session, 0, len(m.byAuth[identifier]))
+	for sessionID := range m.byAuth[identifier] {
+		session := m.sessions[sessionID]
+		if session.AuthKey == identifier.key && session.AuthID == identifier.id {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (m *memorySessionStore) Create(session *utilitymodels.Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.sessions[session.SessionID]; exists {
+		return ErrSessionExists
+	}
+
+	now := time.Now().UTC()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	m.add(session)
+
+	return nil
+}
+
+func (m *memorySessionStore) CreateLimited(session *utilitymodels.Session, limit int, evictOldest bool, replaced ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.sessions[session.SessionID]; exists {
+		return ErrSessionExists
+	}
+
+	sessions := m.getByAuth(authIdentifier{key: session.AuthKey, id: session.AuthID})
+
+	// The lock is held, so the sessions are deleted with the unlocked variant
+	if err := enforceSessionLimit(deleteFunc(func(sessionID string) error {
+		m.delete(sessionID)
+		return nil
+	}), withoutSessions(sessions, replaced), limit, evictOldest); err != nil {
+		return err
+	}
+	for _, sessionID := range replaced {
+		m.delete(sessionID)
+	}
+
+	now := time.Now().UTC()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	m.add(session)
+
+	return nil
+}
+
+func (m *memorySessionStore) Rotate(oldSessionID string, session *utilitymodels.Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.sessions[oldSessionID]; !exists {
+		return ErrSessionNotFound
+	}
+	if _, exists := m.sessions[session.SessionID]; exists {
+		return ErrSessionExists
+	}
+
+	m.delete(oldSessionID)
+
+	session.UpdatedAt = time.Now().UTC()
+	m.add(session)
+
+	return nil
+}
+
+func (m *memorySessionStore) Update(session *utilitymodels.Session, fields ...string) error {
+	if err := checkSessionFields(fields); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	updated, exists := m.sessions[session.SessionID]
+	if !exists {
+		return ErrSessionNotFound
+	}
+
+	copySessionFields(&updated, session, fields)
+	updated.UpdatedAt = time.Now().UTC()
+	m.sessions[session.SessionID] = updated
+
+	return nil
+}
+
+func (m *memorySessionStore) Delete(sessionID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.delete(sessionID)
+	return nil
+}
+
+func (m *memorySessionStore) DeleteByAuth(authKey string, authID uint) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for sessionID := range m.byAuth[authIdentifier{key: authKey, id: authID}] {
+		m.delete(sessionID)
+	}
+
+	return nil
+}
+
+// deleteExpired deletes expired sessions in batches of batchSize, the lock is released between the batches
+func (m *memorySessionStore) deleteExpired(batchSize int) (int64, error) {
+	var removed int64
+	for {
+		now := time.Now().UTC()
+		m.lock.Lock()
+		batch := 0
+		for sessionID, session := range m.sessions {
+			if batch == batchSize {
+				break
+			}
+			if now.After(session.ValidUntil) {
+				m.delete(sessionID)
+				batch++
+			}
+		}
+		m.lock.Unlock()
+
+		removed += int64(batch)
+		if batch < batchSize {
+			return removed, nil
+		}
+	}
+}
+
+// add stores a session and references it by its user and its impersonator, the lock must be held
+func (m *memorySessionStore) add(session *utilitymodels.Session) {
+	m.sessions[session.SessionID] = *session
+
+	for _, identifier := range sessionAuthIdentifiers(session) {
+		if _, exists := m.byAuth[identifier]; !exists {
+			m.byAuth[identifier] = map[string]struct{}{}
+		}
+		m.byAuth[identifier][session.SessionID] = struct{}{}
+	}
+}
+
+// delete removes a session, the lock must be held
+func (m *memorySessionStore) delete(sessionID string) {
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return
+	}
+	delete(m.sessions, sessionID)
+
+	for _, identifier := range sessionAuthIdentifiers(&session) {
+		delete(m.byAuth[identifier], sessionID)
+		if len(m.byAuth[identifier]) == 0 {
+			delete(m.byAuth, identifier)
+		}
+	}
+}
+
+// sessionAuthIdentifiers returns the user of the session and its impersonator, if it is impersonated
+func sessionAuthIdentifiers(session *utilitymodels.Session) []authIdentifier {
+	identifiers := []authIdentifier{{key: session.AuthKey, id: session.AuthID}}
+	if session.ImpersonatorKey != "" {
+		identifiers = append(identifiers, authIdentifier{key: session.ImpersonatorKey, id: session.ImpersonatorID})
+	}
+	return identifiers
+}
+
+// sessionDeleter is the part of SessionStore needed by enforceSessionLimit
+type sessionDeleter interface {
+	Delete(sessionID string) error
+}
+
+type deleteFunc func(sessionID string) error
+
+func (f deleteFunc) Delete(sessionID string) error {
+	return f(sessionID)
+}
+
+// withoutSessions returns the sessions except those with the given ids
+func withoutSessions(sessions []utilitymodels.Session, sessionIDs []string) []utilitymodels.Session {
+	if len(sessionIDs) == 0 {
+		return sessions
+	}
+
+	remaining := make([]utilitymodels.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if !slices.Contains(sessionIDs, session.SessionID) {
+			remaining = append(remaining, session)
+		}
+	}
+	return remaining
+}
+
+// enforceSessionLimit makes room for one more session among the given sessions of a user, either by deleting the
+// oldest ones or by returning ErrSessionLimitReached. The caller must prevent concurrent logins of the user.
+func enforceSessionLimit(store sessionDeleter, sessions []utilitymodels.Session, limit int, evictOldest bool) error {
+	now := time.Now().UTC()
+	valid := make([]utilitymodels.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if !now.After(session.ValidUntil) {
+			valid = append(valid, session)
+		}
+	}
+
+	if len(valid) < limit {
+		return nil
+	}
+	if !evictOldest {
+		return ErrSessionLimitReached
+	}
+
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].CreatedAt.Before(valid[j].CreatedAt)
+	})
+	for _, session := range valid[:len(valid)-limit+1] {
+		if err := store.Delete(session.SessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// immutableSessionFields can't be written by Update. The stores index sessions by their users.
+var immutableSessionFields = map[string]bool{
+	"Common":          true,
+	"ID":              true,
+	"SessionID":       true,
+	"CreatedAt":       true,
+	"AuthKey":         true,
+	"AuthID":          true,
+	"ImpersonatorKey": true,
+	"ImpersonatorID":  true,
+}
+
+// checkSessionFields returns ErrInvalidSessionField if a field can't be written by Update
+func checkSessionFields(fields []string) error {
+	sessionType := reflect.TypeOf(utilitymodels.Session{})
+	for _, field := range fields {
+		if _, exists := sessionType.FieldByName(field); !exists || immutableSessionFields[field] {
+			return ErrInvalidSessionField
+		}
+	}
+	return nil
+}
+
+// copySessionFields copies the given fields, which have been checked with checkSessionFields, from src to dst.
+// All fields except the immutable ones are copied if no field is given.
+func copySessionFields(dst *utilitymodels.Session, src *utilitymodels.Session, fields []string) {
+	dstValue, srcValue := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	if len(fields) == 0 {
+		for _, field := range reflect.VisibleFields(dstValue.Type()) {
+			if !immutableSessionFields[field.Name] && !field.Anonymous {
+				dstValue.FieldByIndex(field.Index).Set(srcValue.FieldByIndex(field.Index))
+			}
+		}
+		return
+	}
+
+	for _, field := range fields {
+		dstValue.FieldByName(field).Set(srcValue.FieldByName(field))
+	}
+}
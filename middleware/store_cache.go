@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// SessionCacheConfig Set the parameters of the session lookup cache.
+// Parameter Size defaults to 1000. Maximum number of cached sessions, the least recently used one is evicted first.
+// Parameter TTL defaults to 30 * time.Second. Changes made by other instances sharing the store are visible after
+// this duration at the latest.
+type SessionCacheConfig struct {
+	Size int
+	TTL  *time.Duration
+}
+
+func (config *SessionCacheConfig) FixSessionCacheConfig() {
+	if config.Size <= 0 {
+		config.Size = 1000
+	}
+	if config.TTL == nil {
+		ttl := 30 * time.Second
+		config.TTL = &ttl
+	}
+}
+
+type cachedSessionStore struct {
+	store   SessionStore
+	size    int
+	ttl     time.Duration
+	lock    sync.Mutex
+	lru     *list.List // Front is the most recently used entry
+	entries map[string]*list.Element
+	// generation is incremented by every eviction. A session read from store is only added, if no eviction happened
+	// since the read began, as it may be the state before a concurrent write.
+	generation uint64
+}
+
+type cacheEntry struct {
+	session  utilitymodels.Session
+	cachedAt time.Time
+}
+
+// NewCachedSessionStore wraps store with a bounded LRU cache for Get. Writes go to store and evict the cache entry,
+// so Logout and InvalidateSessions take effect immediately on this instance.
+func NewCachedSessionStore(store SessionStore, config *SessionCacheConfig) SessionStore {
+	c := SessionCacheConfig{}
+	if config != nil {
+		c = *config
+	}
+	c.FixSessionCacheConfig()
+
+	return &cachedSessionStore{
+		store:   store,
+		size:    c.Size,
+		ttl:     *c.TTL,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (cache *cachedSessionStore) Get(sessionID string) (*utilitymodels.Session, error) {
+	session, generation, ok := cache.lookup(sessionID)
+	if ok {
+		return session, nil
+	}
+
+	session, err := cache.store.Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(session, generation)
+	return session, nil
+}
+
+func (cache *cachedSessionStore) GetByAuth(authKey string, authID uint) ([]utilitymodels.Session, error) {
+	return cache.store.GetByAuth(authKey, authID)
+}
+
+func (cache *cachedSessionStore) Create(session *utilitymodels.Session) error {
+	return cache.store.Create(session)
+}
+
+func (cache *cachedSessionStore) CreateLimited(session *utilitymodels.Session, limit int, evictOldest bool, replaced ...string) error {
+	err := cache.store.CreateLimited(session, limit, evictOldest, replaced...)
+	// Any session of the user may have been evicted
+	cache.evictByAuth(session.AuthKey, session.AuthID)
+	for _, sessionID := range replaced {
+		cache.evict(sessionID)
+	}
+	return err
+}
+
+// Writes evict the entry after writing, else a concurrent Get could cache the old session again
+func (cache *cachedSessionStore) Rotate(oldSessionID string, session *utilitymodels.Session) error {
+	err := cache.store.Rotate(oldSessionID, session)
+	cache.evict(oldSessionID)
+	return err
+}
+
+func (cache *cachedSessionStore) Update(session *utilitymodels.Session, fields ...string) error {
+	err := cache.store.Update(session, fields...)
+	cache.evict(session.SessionID)
+	return err
+}
+
+func (cache *cachedSessionStore) Delete(sessionID string) error {
+	err := cache.store.Delete(sessionID)
+	cache.evict(sessionID)
+	return err
+}
+
+func (cache *cachedSessionStore) DeleteByAuth(authKey string, authID uint) error {
+	err := cache.store.DeleteByAuth(authKey, authID)
+	cache.evictByAuth(authKey, authID)
+	return err
+}
+
+// deleteExpired forwards to the wrapped store. Expired sessions don't need to be evicted, as the middleware checks
+// ValidUntil itself.
+func (cache *cachedSessionStore) deleteExpired(batchSize int) (int64, error) {
+	return reapExpiredSessions(cache.store, batchSize)
+}
+
+// lookup returns a copy of the cached session, if it is cached and not older than the TTL. The current generation
+// is returned for add.
+func (cache *cachedSessionStore) lookup(sessionID string) (*utilitymodels.Session, uint64, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, exists := cache.entries[sessionID]
+	if !exists {
+		return nil, cache.generation, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Since(entry.cachedAt) > cache.ttl {
+		cache.lru.Remove(element)
+		delete(cache.entries, sessionID)
+		return nil, cache.generation, false
+	}
+
+	cache.lru.MoveToFront(element)
+	session := entry.session
+	return &session, cache.generation, true
+}
+
+// add caches the session, unless an eviction happened since generation was returned by lookup
+func (cache *cachedSessionStore) add(session *utilitymodels.Session, generation uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.generation != generation {
+		return
+	}
+
+	entry := &cacheEntry{session: *session, cachedAt: time.Now()}
+	if element, exists := cache.entries[session.SessionID]; exists {
+		element.Value = entry
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[session.SessionID] = cache.lru.PushFront(entry)
+	if cache.lru.Len() > cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).session.SessionID)
+	}
+}
+
+func (cache *cachedSessionStore) evictByAuth(authKey string, authID uint) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	for sessionID, element := range cache.entries {
+		session := element.Value.(*cacheEntry).session
+		if (session.AuthKey == authKey && session.AuthID == authID) ||
+			(session.ImpersonatorKey == authKey && session.ImpersonatorID == authID) {
+			cache.lru.Remove(element)
+			delete(cache.entries, sessionID)
+		}
+	}
+}
+
+func (cache *cachedSessionStore) evict(sessionID string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	if element, exists := cache.entries[sessionID]; exists {
+		cache.lru.Remove(element)
+		delete(cache.entries, sessionID)
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// pausingSessionStore pauses Get after reading the session, until resume is closed
+type pausingSessionStore struct {
+	SessionStore
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (store *pausingSessionStore) Get(sessionID string) (*utilitymodels.Session, error) {
+	session, err := store.SessionStore.Get(sessionID)
+	if store.read != nil {
+		close(store.read)
+		<-store.resume
+		store.read = nil
+	}
+	return session, err
+}
+
+func TestCachedSessionStoreConcurrentDelete(t *testing.T) {
+	pausing := &pausingSessionStore{
+		SessionStore: NewMemorySessionStore(),
+		read:         make(chan struct{}),
+		resume:       make(chan struct{}),
+	}
+	cache := NewCachedSessionStore(pausing, nil)
+	if err := cache.Create(newTestSession("first", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is deleted while a Get has read it, but not cached it yet
+	got := make(chan error, 1)
+	go func() {
+		_, err := cache.Get("first")
+		got <- err
+	}()
+	<-pausing.read
+	if err := cache.Delete("first"); err != nil {
+		t.Fatal(err)
+	}
+	close(pausing.resume)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale session must not have been cached
+	if _, err := cache.Get("first"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+
+	// Without concurrent writes, sessions are cached
+	if err := cache.Create(newTestSession("second", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get("second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.(*cachedSessionStore).entries["second"]; !ok {
+		t.Fatal("expected the session to be cached")
+	}
+}
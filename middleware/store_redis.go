@@ -0,0 +1,714 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+var (
+	ErrRedisError = errors.New("there was a problem communicating with redis")
+)
+
+// RedisConfig Set the parameters of the Redis session store.
+// Parameter Address defaults to "localhost:6379".
+// Parameter Password is optional. If set, AUTH is sent after connecting.
+// Parameter DB defaults to 0.
+// Parameter KeyPrefix defaults to "echotools:". Prepended to every key.
+// Parameter PoolSize defaults to 10. Maximum number of idle connections.
+// Parameter Timeout defaults to 5 * time.Second. Used for dialing and every command.
+type RedisConfig struct {
+	Address   string
+	Password  string
+	DB        int
+	KeyPrefix string
+	PoolSize  int
+	Timeout   time.Duration
+}
+
+func (config *RedisConfig) FixRedisConfig() {
+	if config.Address == "" {
+		config.Address = "localhost:6379"
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "echotools:"
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 10
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+}
+
+type redisSessionStore struct {
+	config RedisConfig
+	idle   chan *redisConn
+}
+
+// NewRedisSessionStore creates a SessionStore using any server speaking the Redis protocol (RESP).
+// Every session is stored with an expiry matching its ValidUntil. A set per user references its sessions.
+func NewRedisSessionStore(config *RedisConfig) SessionStore {
+	c := RedisConfig{}
+	if config != nil {
+		c = *config
+	}
+	c.FixRedisConfig()
+
+	return &redisSessionStore{
+		config: c,
+		idle:   make(chan *redisConn, c.PoolSize),
+	}
+}
+
+func (r *redisSessionStore) sessionKey(sessionID string) string {
+	return r.config.KeyPrefix + "session:" + sessionID
+}
+
+func (r *redisSessionStore) authKey(authKey string, authID uint) string {
+	return fmt.Sprintf("%sauth:%s:%d", r.config.KeyPrefix, authKey, authID)
+}
+
+func (r *redisSessionStore) Get(sessionID string) (*utilitymodels.Session, error) {
+	return r.getSession(r.do, sessionID)
+}
+
+func (r *redisSessionStore) getSession(do redisDoFunc, sessionID string) (*utilitymodels.Session, error) {
+	reply, err := do("GET", r.sessionKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRedisSession(sessionID, reply)
+}
+
+func (r *redisSessionStore) GetByAuth(authKey string, authID uint) ([]utilitymodels.Session, error) {
+	sessions, expired, err := r.getByAuth(r.do, authKey, authID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sessions have expired, the set still references them
+	for _, sessionID := range expired {
+		if _, err := r.do("SREM", r.authKey(authKey, authID), sessionID); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+// getByAuth returns the sessions of a user and the ids of expired sessions, which are still referenced by the set of
+// the user. It doesn't modify the set, so it can be used for a watched set.
+func (r *redisSessionStore) getByAuth(do redisDoFunc, authKey string, authID uint) ([]utilitymodels.Session, []string, error) {
+	reply, err := do("SMEMBERS", r.authKey(authKey, authID))
+	if err != nil {
+		return nil, nil, err
+	}
+	members, _ := reply.([]any)
+
+	sessions := make([]utilitymodels.Session, 0, len(members))
+	var expired []string
+	for _, member := range members {
+		sessionID, ok := member.([]byte)
+		if !ok {
+			continue
+		}
+
+		session, err := r.getSession(do, string(sessionID))
+		if errors.Is(err, ErrSessionNotFound) {
+			expired = append(expired, string(sessionID))
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		// The set references the sessions in which the user impersonates another user as well
+		if session.AuthKey != authKey || session.AuthID != authID {
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, expired, nil
+}
+
+func (r *redisSessionStore) Create(session *utilitymodels.Session) error {
+	now := time.Now().UTC()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+
+	ttl, data, err := encodeRedisSession(session)
+	if err != nil {
+		return err
+	}
+
+	// NX only sets the key if it doesn't exist
+	reply, err := r.do("SET", r.sessionKey(session.SessionID), data, "PX", strconv.FormatInt(ttl, 10), "NX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrSessionExists
+	}
+
+	for _, setKey := range r.authSetKeys(session) {
+		if _, err := r.do("SADD", setKey, session.SessionID); err != nil {
+			return err
+		}
+
+		expire, err := r.extendAuthSet(r.do, setKey, ttl)
+		if err != nil {
+			return err
+		}
+		if expire != nil {
+			if _, err := r.do(expire...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// authSetKeys returns the sets referencing the session: the set of its user and, if the session is impersonated,
+// the set of the impersonator, so DeleteByAuth of the impersonator deletes the session as well
+func (r *redisSessionStore) authSetKeys(session *utilitymodels.Session) []string {
+	setKeys := []string{r.authKey(session.AuthKey, session.AuthID)}
+	if session.ImpersonatorKey != "" {
+		setKeys = append(setKeys, r.authKey(session.ImpersonatorKey, session.ImpersonatorID))
+	}
+	return setKeys
+}
+
+// extendAuthSet returns the command extending the expiry of the set of a user to ttl milliseconds, or nil if it
+// lives long enough already. The set has to live as long as its longest session.
+func (r *redisSessionStore) extendAuthSet(do redisDoFunc, setKey string, ttl int64) ([]string, error) {
+	reply, err := do("PTTL", setKey)
+	if err != nil {
+		return nil, err
+	}
+	if remaining, ok := reply.(int64); ok && remaining >= ttl {
+		return nil, nil
+	}
+	return []string{"PEXPIRE", setKey, strconv.FormatInt(ttl, 10)}, nil
+}
+
+// CreateLimited checks the limit and creates the session in one transaction. Concurrent logins of the user modify
+// the watched set of the user, so all but one transaction are discarded and retried.
+func (r *redisSessionStore) CreateLimited(session *utilitymodels.Session, limit int, evictOldest bool, replaced ...string) error {
+	now := time.Now().UTC()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+
+	ttl, data, err := encodeRedisSession(session)
+	if err != nil {
+		return err
+	}
+
+	key := r.sessionKey(session.SessionID)
+	setKey := r.authKey(session.AuthKey, session.AuthID)
+	watch := []string{"WATCH", key, setKey}
+	for _, sessionID := range replaced {
+		watch = append(watch, r.sessionKey(sessionID))
+	}
+
+	for attempt := 0; attempt < redisTransactionAttempts; attempt++ {
+		committed := false
+		err := r.withConn(func(do redisDoFunc) error {
+			if _, err := do(watch...); err != nil {
+				return err
+			}
+
+			reply, err := do("EXISTS", key)
+			if err != nil {
+				return err
+			}
+			if exists, _ := reply.(int64); exists != 0 {
+				return ErrSessionExists
+			}
+
+			var commands [][]string
+			deleteSession := func(deleted *utilitymodels.Session) {
+				commands = append(commands, []string{"DEL", r.sessionKey(deleted.SessionID)})
+				for _, deletedSetKey := range r.authSetKeys(deleted) {
+					commands = append(commands, []string{"SREM", deletedSetKey, deleted.SessionID})
+				}
+			}
+
+			sessions, expired, err := r.getByAuth(do, session.AuthKey, session.AuthID)
+			if err != nil {
+				return err
+			}
+			for _, sessionID := range expired {
+				commands = append(commands, []string{"SREM", setKey, sessionID})
+			}
+
+			counted := withoutSessions(sessions, replaced)
+			if err := enforceSessionLimit(deleteFunc(func(sessionID string) error {
+				for i := range counted {
+					if counted[i].SessionID == sessionID {
+						deleteSession(&counted[i])
+					}
+				}
+				return nil
+			}), counted, limit, evictOldest); err != nil {
+				return err
+			}
+
+			for _, sessionID := range replaced {
+				replacedSession, err := r.getSession(do, sessionID)
+				if errors.Is(err, ErrSessionNotFound) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				deleteSession(replacedSession)
+			}
+
+			commands = append(commands, []string{"SET", key, data, "PX", strconv.FormatInt(ttl, 10)})
+			for _, sessionSetKey := range r.authSetKeys(session) {
+				commands = append(commands, []string{"SADD", sessionSetKey, session.SessionID})
+				expire, err := r.extendAuthSet(do, sessionSetKey, ttl)
+				if err != nil {
+					return err
+				}
+				if expire != nil {
+					commands = append(commands, expire)
+				}
+			}
+
+			committed, err = execRedisTransaction(do, commands)
+			return err
+		})
+		if err != nil || committed {
+			return err
+		}
+	}
+	return ErrRedisError
+}
+
+func (r *redisSessionStore) Rotate(oldSessionID string, session *utilitymodels.Session) error {
+	session.UpdatedAt = time.Now().UTC()
+	ttl, data, err := encodeRedisSession(session)
+	if err != nil {
+		return err
+	}
+
+	oldKey, newKey := r.sessionKey(oldSessionID), r.sessionKey(session.SessionID)
+	setKeys := r.authSetKeys(session)
+	for attempt := 0; attempt < redisTransactionAttempts; attempt++ {
+		committed := false
+		err := r.withConn(func(do redisDoFunc) error {
+			// EXEC discards the transaction, if another client has modified a watched key in the meantime
+			if _, err := do(append([]string{"WATCH", oldKey, newKey}, setKeys...)...); err != nil {
+				return err
+			}
+
+			reply, err := do("EXISTS", oldKey)
+			if err != nil {
+				return err
+			}
+			if exists, _ := reply.(int64); exists != 1 {
+				return ErrSessionNotFound
+			}
+			reply, err = do("EXISTS", newKey)
+			if err != nil {
+				return err
+			}
+			if exists, _ := reply.(int64); exists != 0 {
+				return ErrSessionExists
+			}
+
+			commands := [][]string{
+				{"DEL", oldKey},
+				{"SET", newKey, data, "PX", strconv.FormatInt(ttl, 10)},
+			}
+			for _, setKey := range setKeys {
+				commands = append(commands, []string{"SREM", setKey, oldSessionID}, []string{"SADD", setKey, session.SessionID})
+				expire, err := r.extendAuthSet(do, setKey, ttl)
+				if err != nil {
+					return err
+				}
+				if expire != nil {
+					commands = append(commands, expire)
+				}
+			}
+
+			committed, err = execRedisTransaction(do, commands)
+			return err
+		})
+		if err != nil || committed {
+			return err
+		}
+	}
+	return ErrRedisError
+}
+
+func (r *redisSessionStore) Update(session *utilitymodels.Session, fields ...string) error {
+	if err := checkSessionFields(fields); err != nil {
+		return err
+	}
+
+	key := r.sessionKey(session.SessionID)
+	setKeys := r.authSetKeys(session)
+	for attempt := 0; attempt < redisTransactionAttempts; attempt++ {
+		committed := false
+		err := r.withConn(func(do redisDoFunc) error {
+			// The fields are merged into the stored session, which must not change until EXEC
+			if _, err := do(append([]string{"WATCH", key}, setKeys...)...); err != nil {
+				return err
+			}
+
+			reply, err := do("GET", key)
+			if err != nil {
+				return err
+			}
+			updated, err := decodeRedisSession(session.SessionID, reply)
+			if err != nil {
+				return err
+			}
+			copySessionFields(updated, session, fields)
+			updated.UpdatedAt = time.Now().UTC()
+
+			ttl, data, err := encodeRedisSession(updated)
+			if err != nil {
+				return err
+			}
+			commands := [][]string{{"SET", key, data, "PX", strconv.FormatInt(ttl, 10)}}
+			for _, setKey := range setKeys {
+				expire, err := r.extendAuthSet(do, setKey, ttl)
+				if err != nil {
+					return err
+				}
+				if expire != nil {
+					commands = append(commands, expire)
+				}
+			}
+
+			committed, err = execRedisTransaction(do, commands)
+			return err
+		})
+		if err != nil || committed {
+			return err
+		}
+	}
+	return ErrRedisError
+}
+
+func (r *redisSessionStore) Delete(sessionID string) error {
+	session, err := r.Get(sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := r.do("DEL", r.sessionKey(sessionID)); err != nil {
+		return err
+	}
+	for _, setKey := range r.authSetKeys(session) {
+		if _, err := r.do("SREM", setKey, sessionID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *redisSessionStore) DeleteByAuth(authKey string, authID uint) error {
+	setKey := r.authKey(authKey, authID)
+
+	for attempt := 0; attempt < redisTransactionAttempts; attempt++ {
+		committed := false
+		err := r.withConn(func(do redisDoFunc) error {
+			// A session added concurrently discards the transaction, so the set can be deleted as a whole
+			if _, err := do("WATCH", setKey); err != nil {
+				return err
+			}
+
+			reply, err := do("SMEMBERS", setKey)
+			if err != nil {
+				return err
+			}
+			members, _ := reply.([]any)
+
+			command := []string{"DEL", setKey}
+			for _, member := range members {
+				if sessionID, ok := member.([]byte); ok {
+					command = append(command, r.sessionKey(string(sessionID)))
+				}
+			}
+
+			committed, err = execRedisTransaction(do, [][]string{command})
+			return err
+		})
+		if err != nil || committed {
+			return err
+		}
+	}
+	return ErrRedisError
+}
+
+// decodeRedisSession decodes the reply of GET, a nil reply means the session doesn't exist
+func decodeRedisSession(sessionID string, reply any) (*utilitymodels.Session, error) {
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	var session utilitymodels.Session
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session); err != nil {
+		return nil, ErrRedisError
+	}
+	session.SessionID = sessionID
+
+	return &session, nil
+}
+
+// encodeRedisSession returns the remaining lifetime in milliseconds and the encoded session
+func encodeRedisSession(session *utilitymodels.Session) (int64, string, error) {
+	ttl := time.Until(session.ValidUntil).Milliseconds()
+	if ttl <= 0 {
+		// Expired sessions are of no use, but the call should succeed anyway
+		ttl = 1
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session); err != nil {
+		return 0, "", ErrRedisError
+	}
+
+	return ttl, buf.String(), nil
+}
+
+// redisTransactionAttempts is the number of times a transaction is retried, if a watched key was modified
+const redisTransactionAttempts = 10
+
+// redisDoFunc executes a command and returns its reply, see redisConn.readReply
+type redisDoFunc func(args ...string) (any, error)
+
+// withConn runs f with a connection, which is used exclusively by f, e.g. for WATCH and MULTI.
+// Errors of commands are returned as ErrRedisError, errors of f are returned unchanged.
+func (r *redisSessionStore) withConn(f func(do redisDoFunc) error) error {
+	conn, err := r.get()
+	if err != nil {
+		return ErrRedisError
+	}
+
+	err = f(func(args ...string) (any, error) {
+		reply, err := conn.do(r.config.Timeout, args...)
+		if err != nil {
+			return nil, ErrRedisError
+		}
+		return reply, nil
+	})
+	if err != nil {
+		// The connection may still watch keys or be in a transaction
+		conn.Close()
+		return err
+	}
+
+	r.put(conn)
+	return nil
+}
+
+// execRedisTransaction runs the commands with MULTI and EXEC. Returns false if the transaction was discarded,
+// because a watched key was modified.
+func execRedisTransaction(do redisDoFunc, commands [][]string) (bool, error) {
+	if _, err := do("MULTI"); err != nil {
+		return false, err
+	}
+	for _, command := range commands {
+		if _, err := do(command...); err != nil {
+			return false, err
+		}
+	}
+
+	reply, err := do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		return false, nil
+	}
+	replies, _ := reply.([]any)
+	for _, reply := range replies {
+		if _, failed := reply.(redisReplyError); failed {
+			return false, ErrRedisError
+		}
+	}
+	return true, nil
+}
+
+// do executes a command on a pooled connection. Error replies are returned as ErrRedisError.
+func (r *redisSessionStore) do(args ...string) (any, error) {
+	conn, err := r.get()
+	if err != nil {
+		return nil, ErrRedisError
+	}
+
+	reply, err := conn.do(r.config.Timeout, args...)
+	if err != nil {
+		var replyErr redisReplyError
+		if errors.As(err, &replyErr) {
+			// The connection is still usable after an error reply
+			r.put(conn)
+		} else {
+			conn.Close()
+		}
+		return nil, ErrRedisError
+	}
+
+	r.put(conn)
+	return reply, nil
+}
+
+func (r *redisSessionStore) get() (*redisConn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", r.config.Address, r.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+
+	if r.config.Password != "" {
+		if _, err := conn.do(r.config.Timeout, "AUTH", r.config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.config.DB != 0 {
+		if _, err := conn.do(r.config.Timeout, "SELECT", strconv.Itoa(r.config.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (r *redisSessionStore) put(conn *redisConn) {
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+type redisReplyError string
+
+func (e redisReplyError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) Close() {
+	c.conn.Close()
+}
+
+// do sends the command as array of bulk strings and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// readReply parses a RESP reply. Simple strings are returned as string, integers as int64, bulk strings as []byte,
+// arrays as []any and null replies as nil.
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisReplyError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		elements := make([]any, 0, length)
+		for i := 0; i < length; i++ {
+			element, err := c.readReply()
+			if err != nil {
+				// Error elements must not abort reading, else the rest of the array would remain on the connection
+				var replyErr redisReplyError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				element = replyErr
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("malformed redis reply")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,796 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// testRedisKey is a string or a set stored by the testRedisServer
+type testRedisKey struct {
+	value     *string
+	members   map[string]struct{}
+	expiresAt time.Time // Zero if the key doesn't expire
+}
+
+// testRedisServer is an in-process server speaking RESP, implementing the commands used by the Redis session store
+type testRedisServer struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	password string
+	// dbs holds the keys per database selected with SELECT
+	dbs map[int]map[string]*testRedisKey
+	// failures maps command names to the error replied instead of executing them
+	failures map[string]string
+	// versions counts the modifications per database and key, which are compared by EXEC with the watched ones
+	versions map[string]int
+}
+
+func newTestRedisServer(t *testing.T) *testRedisServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testRedisServer{
+		listener: listener,
+		dbs:      map[int]map[string]*testRedisKey{},
+		failures: map[string]string{},
+		versions: map[string]int{},
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *testRedisServer) address() string {
+	return server.listener.Addr().String()
+}
+
+// fail makes the server reply to command with an error until it is cleared with an empty message
+func (server *testRedisServer) fail(command string, message string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if message == "" {
+		delete(server.failures, command)
+		return
+	}
+	server.failures[command] = message
+}
+
+// keys returns the names of all keys of the database, which have not expired
+func (server *testRedisServer) keys(db int) []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	var names []string
+	for name := range server.dbs[db] {
+		if server.lookup(db, name) != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// testRedisConnState is the state of a client connection
+type testRedisConnState struct {
+	authenticated bool
+	db            int
+	watched       map[string]int // Versions of the watched keys
+	multi         bool
+	queued        [][]string
+}
+
+func (server *testRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	state := &testRedisConnState{}
+
+	for {
+		args, err := readTestRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, server.execute(state, args)); err != nil {
+			return
+		}
+	}
+}
+
+// readTestRedisCommand reads a command sent as array of bulk strings
+func readTestRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected an array")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+func (server *testRedisServer) execute(state *testRedisConnState, args []string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	command := strings.ToUpper(args[0])
+
+	if message, failing := server.failures[command]; failing {
+		return "-ERR " + message + "\r\n"
+	}
+	if command == "AUTH" {
+		if len(args) != 2 || args[1] != server.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		state.authenticated = true
+		return "+OK\r\n"
+	}
+	if !state.authenticated && server.password != "" {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch command {
+	case "WATCH":
+		if state.multi {
+			return "-ERR WATCH inside MULTI is not allowed\r\n"
+		}
+		if state.watched == nil {
+			state.watched = map[string]int{}
+		}
+		for _, name := range args[1:] {
+			version := server.version(state.db, name)
+			state.watched[version] = server.versions[version]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		state.watched = nil
+		return "+OK\r\n"
+	case "MULTI":
+		if state.multi {
+			return "-ERR MULTI calls can not be nested\r\n"
+		}
+		state.multi = true
+		state.queued = nil
+		return "+OK\r\n"
+	case "DISCARD":
+		state.multi, state.queued, state.watched = false, nil, nil
+		return "+OK\r\n"
+	case "EXEC":
+		if !state.multi {
+			return "-ERR EXEC without MULTI\r\n"
+		}
+		queued, watched := state.queued, state.watched
+		state.multi, state.queued, state.watched = false, nil, nil
+		for version, watchedVersion := range watched {
+			if server.versions[version] != watchedVersion {
+				return "*-1\r\n"
+			}
+		}
+
+		reply := fmt.Sprintf("*%d\r\n", len(queued))
+		for _, queuedArgs := range queued {
+			reply += server.executeCommand(state, strings.ToUpper(queuedArgs[0]), queuedArgs[1:])
+		}
+		return reply
+	}
+
+	if state.multi {
+		state.queued = append(state.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return server.executeCommand(state, command, args[1:])
+}
+
+// version returns the key of the version of a key in server.versions
+func (server *testRedisServer) version(db int, name string) string {
+	return strconv.Itoa(db) + ":" + name
+}
+
+// modified increments the versions of the keys, the lock must be held
+func (server *testRedisServer) modified(db int, names ...string) {
+	for _, name := range names {
+		server.versions[server.version(db, name)]++
+	}
+}
+
+// executeCommand executes a command, the lock must be held
+func (server *testRedisServer) executeCommand(state *testRedisConnState, command string, args []string) string {
+	switch command {
+	case "SELECT":
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "-ERR invalid DB index\r\n"
+		}
+		state.db = db
+		return "+OK\r\n"
+	case "GET":
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			return "$-1\r\n"
+		}
+		if key.value == nil {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		return testRedisBulk(*key.value)
+	case "SET":
+		server.modified(state.db, args[0])
+		return server.set(state.db, args)
+	case "DEL":
+		server.modified(state.db, args...)
+		deleted := 0
+		for _, name := range args {
+			if server.lookup(state.db, name) != nil {
+				deleted++
+			}
+			delete(server.db(state.db), name)
+		}
+		return testRedisInteger(deleted)
+	case "EXISTS":
+		exists := 0
+		for _, name := range args {
+			if server.lookup(state.db, name) != nil {
+				exists++
+			}
+		}
+		return testRedisInteger(exists)
+	case "SADD":
+		server.modified(state.db, args[0])
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			key = &testRedisKey{members: map[string]struct{}{}}
+			server.db(state.db)[args[0]] = key
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if _, exists := key.members[member]; !exists {
+				key.members[member] = struct{}{}
+				added++
+			}
+		}
+		return testRedisInteger(added)
+	case "SREM":
+		server.modified(state.db, args[0])
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			return testRedisInteger(0)
+		}
+		removed := 0
+		for _, member := range args[1:] {
+			if _, exists := key.members[member]; exists {
+				delete(key.members, member)
+				removed++
+			}
+		}
+		if len(key.members) == 0 {
+			delete(server.db(state.db), args[0])
+		}
+		return testRedisInteger(removed)
+	case "SMEMBERS":
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			return "*0\r\n"
+		}
+		members := make([]string, 0, len(key.members))
+		for member := range key.members {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			reply += testRedisBulk(member)
+		}
+		return reply
+	case "PTTL":
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			return testRedisInteger(-2)
+		}
+		if key.expiresAt.IsZero() {
+			return testRedisInteger(-1)
+		}
+		return testRedisInteger(int(time.Until(key.expiresAt).Milliseconds()))
+	case "PEXPIRE":
+		server.modified(state.db, args[0])
+		key := server.lookup(state.db, args[0])
+		if key == nil {
+			return testRedisInteger(0)
+		}
+		milliseconds, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		key.expiresAt = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+		return testRedisInteger(1)
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", command)
+	}
+}
+
+// set implements SET key value [PX milliseconds] [NX|XX]
+func (server *testRedisServer) set(db int, args []string) string {
+	name, value := args[0], args[1]
+	var expiresAt time.Time
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "PX":
+			i++
+			milliseconds, err := strconv.Atoi(args[i])
+			if err != nil || milliseconds <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			expiresAt = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	exists := server.lookup(db, name) != nil
+	if nx && exists || xx && !exists {
+		return "$-1\r\n"
+	}
+	server.db(db)[name] = &testRedisKey{value: &value, expiresAt: expiresAt}
+	return "+OK\r\n"
+}
+
+func (server *testRedisServer) db(db int) map[string]*testRedisKey {
+	if _, exists := server.dbs[db]; !exists {
+		server.dbs[db] = map[string]*testRedisKey{}
+	}
+	return server.dbs[db]
+}
+
+// lookup returns the key, if it exists and has not expired. Expired keys are deleted.
+func (server *testRedisServer) lookup(db int, name string) *testRedisKey {
+	key, exists := server.db(db)[name]
+	if !exists {
+		return nil
+	}
+	if !key.expiresAt.IsZero() && !time.Now().Before(key.expiresAt) {
+		delete(server.db(db), name)
+		return nil
+	}
+	return key
+}
+
+func testRedisBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func testRedisInteger(value int) string {
+	return fmt.Sprintf(":%d\r\n", value)
+}
+
+func newTestRedisStore(t *testing.T, server *testRedisServer) SessionStore {
+	t.Helper()
+	return NewRedisSessionStore(&RedisConfig{Address: server.address(), Timeout: time.Second})
+}
+
+func newTestSession(sessionID string, authID uint, validity time.Duration) *utilitymodels.Session {
+	return &utilitymodels.Session{
+		AuthKey:    "local",
+		AuthID:     authID,
+		SessionID:  sessionID,
+		ValidUntil: time.Now().UTC().Add(validity),
+		PublicID:   "public-" + sessionID,
+		LastSeenAt: time.Now().UTC(),
+	}
+}
+
+func sessionIDs(sessions []utilitymodels.Session) []string {
+	ids := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.SessionID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	session := newTestSession("first", 1, time.Hour)
+	session.Data = []byte(`{"theme":"dark"}`)
+	if err := store.Create(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(newTestSession("first", 2, time.Hour)); !errors.Is(err, ErrSessionExists) {
+		t.Fatalf("expected %v, got %v", ErrSessionExists, err)
+	}
+	if err := store.Create(newTestSession("second", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(newTestSession("other", 2, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.Get("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionID != "first" || stored.AuthID != 1 || stored.PublicID != "public-first" ||
+		string(stored.Data) != `{"theme":"dark"}` || !stored.ValidUntil.Equal(session.ValidUntil) || stored.CreatedAt.IsZero() {
+		t.Fatalf("unexpected session %+v", stored)
+	}
+	if _, err := store.Get("unknown"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+
+	sessions, err := store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[first second]" {
+		t.Fatalf("unexpected sessions %v", ids)
+	}
+
+	// Update
+	stored.DeviceLabel = "Laptop"
+	if err := store.Update(stored); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := store.Get("first"); err != nil || updated.DeviceLabel != "Laptop" {
+		t.Fatalf("expected the update to be stored, got %+v, %v", updated, err)
+	}
+	if err := store.Update(newTestSession("unknown", 1, time.Hour)); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+
+	// Delete
+	if err := store.Delete("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("second"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+	sessions, err = store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[first]" {
+		t.Fatalf("unexpected sessions %v", ids)
+	}
+
+	// DeleteByAuth only deletes the sessions of the user
+	if err := store.DeleteByAuth("local", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("first"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+	if _, err := store.Get("other"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.keys(0); fmt.Sprint(keys) != "[echotools:auth:local:2 echotools:session:other]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisSessionStoreRotate(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	if err := store.Create(newTestSession("old", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(newTestSession("taken", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestSession("new", 1, time.Hour)
+	if err := store.Rotate("unknown", rotated); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+	if err := store.Rotate("old", newTestSession("taken", 1, time.Hour)); !errors.Is(err, ErrSessionExists) {
+		t.Fatalf("expected %v, got %v", ErrSessionExists, err)
+	}
+
+	if err := store.Rotate("old", rotated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("old"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+	if stored, err := store.Get("new"); err != nil || stored.PublicID != "public-new" {
+		t.Fatalf("expected the rotated session, got %+v, %v", stored, err)
+	}
+
+	sessions, err := store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[new taken]" {
+		t.Fatalf("unexpected sessions %v", ids)
+	}
+}
+
+func TestRedisSessionStoreRotateConcurrently(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	for round := 0; round < 20; round++ {
+		old := fmt.Sprintf("old-%d", round)
+		if err := store.Create(newTestSession(old, 1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = store.Rotate(old, newTestSession(fmt.Sprintf("new-%d-%d", round, i), 1, time.Hour))
+			}(i)
+		}
+		wg.Wait()
+
+		// Exactly one rotation wins, the other one doesn't find the old session anymore
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+			} else if !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("expected exactly one rotation to succeed, got %v", errs)
+		}
+	}
+
+	sessions, err := store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 20 {
+		t.Fatalf("expected one session per round, got %v", sessionIDs(sessions))
+	}
+}
+
+func TestRedisSessionStoreDeleteByAuthConcurrently(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	for round := 0; round < 20; round++ {
+		if err := store.Create(newTestSession(fmt.Sprintf("old-%d", round), 1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		created := fmt.Sprintf("new-%d", round)
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs[0] = store.Create(newTestSession(created, 1, time.Hour))
+		}()
+		go func() {
+			defer wg.Done()
+			errs[1] = store.DeleteByAuth("local", 1)
+		}()
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A session created concurrently is either deleted or still listed for its user
+		sessions, err := store.GetByAuth("local", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, getErr := store.Get(created)
+		if listed := fmt.Sprint(sessionIDs(sessions)) == "["+created+"]"; listed != (getErr == nil) {
+			t.Fatalf("session %s exists: %v, listed: %v", created, getErr == nil, sessionIDs(sessions))
+		}
+
+		if err := store.DeleteByAuth("local", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRedisSessionStoreExpiry(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	if err := store.Create(newTestSession("short", 1, 50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(newTestSession("long", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := store.Get("short"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSessionNotFound, err)
+	}
+
+	// The expired session is removed from the set of the user
+	sessions, err := store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[long]" {
+		t.Fatalf("unexpected sessions %v", ids)
+	}
+	if keys := server.keys(0); fmt.Sprint(keys) != "[echotools:auth:local:1 echotools:session:long]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisSessionStoreCreateLimited(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	for _, sessionID := range []string{"first", "second"} {
+		if err := store.CreateLimited(newTestSession(sessionID, 1, time.Hour), 2, false); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.CreateLimited(newTestSession("third", 1, time.Hour), 2, false); !errors.Is(err, ErrSessionLimitReached) {
+		t.Fatalf("expected %v, got %v", ErrSessionLimitReached, err)
+	}
+	if err := store.CreateLimited(newTestSession("third", 1, time.Hour), 2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.GetByAuth("local", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[second third]" {
+		t.Fatalf("expected the oldest session to be evicted, got %v", ids)
+	}
+}
+
+func TestRedisSessionStoreAuth(t *testing.T) {
+	server := newTestRedisServer(t)
+	server.lock.Lock()
+	server.password = "secret"
+	server.lock.Unlock()
+
+	store := NewRedisSessionStore(&RedisConfig{Address: server.address(), Password: "secret", DB: 3, Timeout: time.Second})
+	if err := store.Create(newTestSession("first", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.keys(3); len(keys) != 2 {
+		t.Fatalf("expected the keys in the selected database, got %v", keys)
+	}
+
+	wrongPassword := NewRedisSessionStore(&RedisConfig{Address: server.address(), Password: "wrong", Timeout: time.Second})
+	if _, err := wrongPassword.Get("first"); !errors.Is(err, ErrRedisError) {
+		t.Fatalf("expected %v, got %v", ErrRedisError, err)
+	}
+	noPassword := NewRedisSessionStore(&RedisConfig{Address: server.address(), Timeout: time.Second})
+	if _, err := noPassword.Get("first"); !errors.Is(err, ErrRedisError) {
+		t.Fatalf("expected %v, got %v", ErrRedisError, err)
+	}
+}
+
+func TestRedisSessionStoreErrors(t *testing.T) {
+	server := newTestRedisServer(t)
+	store := newTestRedisStore(t, server)
+
+	if err := store.Create(newTestSession("first", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		call    func() error
+	}{
+		{"GET", func() error {
+			_, err := store.Get("first")
+			return err
+		}},
+		{"SET", func() error {
+			return store.Create(newTestSession("second", 1, time.Hour))
+		}},
+		{"SADD", func() error {
+			return store.Create(newTestSession("third", 1, time.Hour))
+		}},
+		{"SMEMBERS", func() error {
+			_, err := store.GetByAuth("local", 1)
+			return err
+		}},
+		{"SET", func() error {
+			return store.Update(newTestSession("first", 1, time.Hour))
+		}},
+		{"DEL", func() error {
+			return store.Delete("first")
+		}},
+		{"DEL", func() error {
+			return store.DeleteByAuth("local", 1)
+		}},
+		{"EXEC", func() error {
+			return store.Rotate("first", newTestSession("rotated", 1, time.Hour))
+		}},
+	}
+
+	for _, test := range tests {
+		server.fail(test.command, "injected failure")
+		err := test.call()
+		server.fail(test.command, "")
+		if !errors.Is(err, ErrRedisError) {
+			t.Fatalf("expected %v for a failing %s, got %v", ErrRedisError, test.command, err)
+		}
+	}
+
+	// The connection is still usable after error replies
+	if _, err := store.Get("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value which isn't an encoded session is rejected
+	if _, err := store.(*redisSessionStore).do("SET", "echotools:session:garbage", "garbage"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("garbage"); !errors.Is(err, ErrRedisError) {
+		t.Fatalf("expected %v, got %v", ErrRedisError, err)
+	}
+
+	server.listener.Close()
+	unreachable := NewRedisSessionStore(&RedisConfig{Address: server.address(), Timeout: 100 * time.Millisecond})
+	if _, err := unreachable.Get("first"); !errors.Is(err, ErrRedisError) {
+		t.Fatalf("expected %v, got %v", ErrRedisError, err)
+	}
+}
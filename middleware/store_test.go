@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+)
+
+// testSessionStores returns every SessionStore implementation, the Redis store uses a testRedisServer
+func testSessionStores(t *testing.T) map[string]SessionStore {
+	t.Helper()
+
+	return map[string]SessionStore{
+		"gorm":   NewGormSessionStore(testutil.OpenTestDB(t)),
+		"memory": NewMemorySessionStore(),
+		"cached": NewCachedSessionStore(NewMemorySessionStore(), nil),
+		"redis":  newTestRedisStore(t, newTestRedisServer(t)),
+	}
+}
+
+func TestSessionStoreUpdate(t *testing.T) {
+	for name, store := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(newTestSession("first", 1, time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Two requests have loaded the session and change different fields
+			labeling, err := store.Get("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			renewing, err := store.Get("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			labeling.DeviceLabel = "Laptop"
+			if err := store.Update(labeling, "DeviceLabel"); err != nil {
+				t.Fatal(err)
+			}
+			renewing.ValidUntil = renewing.ValidUntil.Add(time.Hour)
+			renewing.LastSeenAt = time.Now().UTC()
+			if err := store.Update(renewing, "ValidUntil", "LastSeenAt"); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := store.Get("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.DeviceLabel != "Laptop" || !stored.ValidUntil.Equal(renewing.ValidUntil) {
+				t.Fatalf("expected both updates to be kept, got %+v", stored)
+			}
+
+			// Without fields, everything except the ids and CreatedAt is written
+			stored.DeviceLabel = "Desktop"
+			stored.Data = []byte(`{"theme":"dark"}`)
+			if err := store.Update(stored); err != nil {
+				t.Fatal(err)
+			}
+			if updated, err := store.Get("first"); err != nil || updated.DeviceLabel != "Desktop" || string(updated.Data) != `{"theme":"dark"}` {
+				t.Fatalf("expected the update to be stored, got %+v, %v", updated, err)
+			}
+
+			for _, field := range []string{"SessionID", "CreatedAt", "AuthID", "Unknown"} {
+				if err := store.Update(stored, field); !errors.Is(err, ErrInvalidSessionField) {
+					t.Fatalf("expected %v for %s, got %v", ErrInvalidSessionField, field, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionStoreDeleteByAuthImpersonator(t *testing.T) {
+	for name, store := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// The admin with id 1 impersonates the user with id 2
+			impersonation := newTestSession("impersonation", 2, time.Hour)
+			impersonation.ImpersonatorKey = "local"
+			impersonation.ImpersonatorID = 1
+			for _, session := range []*utilitymodels.Session{
+				newTestSession("admin", 1, time.Hour),
+				newTestSession("user", 2, time.Hour),
+				impersonation,
+			} {
+				if err := store.Create(session); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := store.Get("impersonation"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The impersonation session belongs to the user only
+			sessions, err := store.GetByAuth("local", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[admin]" {
+				t.Fatalf("unexpected sessions %v", ids)
+			}
+
+			if err := store.DeleteByAuth("local", 1); err != nil {
+				t.Fatal(err)
+			}
+			for _, sessionID := range []string{"admin", "impersonation"} {
+				if _, err := store.Get(sessionID); !errors.Is(err, ErrSessionNotFound) {
+					t.Fatalf("expected %v for %s, got %v", ErrSessionNotFound, sessionID, err)
+				}
+			}
+			sessions, err = store.GetByAuth("local", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[user]" {
+				t.Fatalf("unexpected sessions %v", ids)
+			}
+		})
+	}
+}
+
+func TestSessionStoreCreateLimitedConcurrently(t *testing.T) {
+	const logins, limit = 8, 3
+
+	for name, store := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, evictOldest := range []bool{false, true} {
+				authID := uint(1)
+				if evictOldest {
+					authID = 2
+				}
+
+				var wg sync.WaitGroup
+				errs := make([]error, logins)
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						errs[i] = store.CreateLimited(newTestSession(fmt.Sprintf("%d-%d", authID, i), authID, time.Hour), limit, evictOldest)
+					}(i)
+				}
+				wg.Wait()
+
+				created := 0
+				for _, err := range errs {
+					if err == nil {
+						created++
+					} else if evictOldest || !errors.Is(err, ErrSessionLimitReached) {
+						t.Fatalf("unexpected error %v", err)
+					}
+				}
+				if !evictOldest && created != limit {
+					t.Fatalf("expected %d logins to succeed, got %d", limit, created)
+				}
+
+				sessions, err := store.GetByAuth("local", authID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(sessions) != limit {
+					t.Fatalf("expected %d sessions, got %v", limit, sessionIDs(sessions))
+				}
+			}
+		})
+	}
+}
+
+func TestSessionStoreCreateLimitedReplaced(t *testing.T) {
+	for name, store := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, sessionID := range []string{"first", "second"} {
+				if err := store.CreateLimited(newTestSession(sessionID, 1, time.Hour), 2, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The previous session of another client is kept, if the login is refused
+			if err := store.Create(newTestSession("other", 2, time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateLimited(newTestSession("third", 1, time.Hour), 2, false, "other"); !errors.Is(err, ErrSessionLimitReached) {
+				t.Fatalf("expected %v, got %v", ErrSessionLimitReached, err)
+			}
+			if _, err := store.Get("other"); err != nil {
+				t.Fatalf("expected the previous session to be kept, got %v", err)
+			}
+
+			// The replaced session doesn't count toward the limit
+			if err := store.CreateLimited(newTestSession("third", 1, time.Hour), 2, false, "second", "unknown"); err != nil {
+				t.Fatal(err)
+			}
+			sessions, err := store.GetByAuth("local", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := sessionIDs(sessions); fmt.Sprint(ids) != "[first third]" {
+				t.Fatalf("unexpected sessions %v", ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAPITokenNotFound = errors.New("api token not found")
+	ErrRandomFailed     = errors.New("generating random bytes failed")
+)
+
+const (
+	// apiTokenPrefix makes tokens recognizable, e.g. for secret scanners
+	apiTokenPrefix = "et_"
+
+	// apiTokenLastUsedInterval limits the writes of last_used_at
+	apiTokenLastUsedInterval = time.Minute
+)
+
+// CreateAPIToken creates a personal access token for the given user model, which can be used in an
+// "Authorization: Bearer <token>" header if SessionConfig.AllowAPITokens is set.
+// The token is only returned once, only its hash is stored. A nil validity creates a token which doesn't expire.
+func CreateAPIToken(db *gorm.DB, model IdentifiedAuthModel, name string, scopes []string, validity *time.Duration) (string, *utilitymodels.APIToken, error) {
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return "", nil, ErrRandomFailed
+	}
+	token := apiTokenPrefix + fmt.Sprintf("%x", r)
+
+	authKey, authID := model.GetAuthModelIdentifier()
+	apiToken := utilitymodels.APIToken{
+		AuthKey:   authKey,
+		AuthID:    authID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Scopes:    strings.Join(scopes, " "),
+	}
+	if validity != nil {
+		apiToken.ExpiresAt = sql.NullTime{Time: time.Now().UTC().Add(*validity), Valid: true}
+	}
+
+	if err := db.Create(&apiToken).Error; err != nil {
+		return "", nil, ErrDatabaseError
+	}
+
+	return token, &apiToken, nil
+}
+
+// GetAPITokens Returns all API tokens of the given user model
+func GetAPITokens(db *gorm.DB, model IdentifiedAuthModel) ([]utilitymodels.APIToken, error) {
+	authKey, authID := model.GetAuthModelIdentifier()
+
+	var tokens []utilitymodels.APIToken
+	if err := db.Find(&tokens, "auth_key = ? AND auth_id = ?", authKey, authID).Error; err != nil {
+		return nil, ErrDatabaseError
+	}
+	return tokens, nil
+}
+
+// RevokeAPIToken deletes an API token of the given user model
+func RevokeAPIToken(db *gorm.DB, model IdentifiedAuthModel, tokenID uint) error {
+	authKey, authID := model.GetAuthModelIdentifier()
+
+	res := db.Where("id = ? AND auth_key = ? AND auth_id = ?", tokenID, authKey, authID).Delete(&utilitymodels.APIToken{})
+	if res.Error != nil {
+		return ErrDatabaseError
+	}
+	if res.RowsAffected != 1 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// ScopeRequired Helper function to mark endpoint as login only, which additionally requires the given scope for
+// requests authenticated by an API token. Requires Session as a middleware.
+func ScopeRequired(scope string, f func(echo.Context) error) echo.HandlerFunc {
+	return LoginRequired(func(c echo.Context) error {
+		sessionContext := c.Get("SessionContext").(SessionContext)
+
+		if !sessionContext.HasScope(scope) {
+			return c.JSON(403, struct{ Error string }{Error: "Missing scope " + scope})
+		}
+
+		return f(c)
+	})
+}
+
+func getBearerToken(c echo.Context) (string, bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// lookupAPIToken returns the valid token matching the given secret or nil
+func lookupAPIToken(db *gorm.DB, c echo.Context, config *SessionConfig, token string) *utilitymodels.APIToken {
+	var apiToken utilitymodels.APIToken
+	var count int64
+
+	db.Find(&apiToken, "token_hash = ?", hashAPIToken(token)).Count(&count)
+	if count != 1 {
+		if !config.DisableLogging {
+			c.Logger().Debugf("API token was not found in DB")
+		}
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if apiToken.ExpiresAt.Valid && now.After(apiToken.ExpiresAt.Time) {
+		if !config.DisableLogging {
+			c.Logger().Debugf("API token %d is expired", apiToken.ID)
+		}
+		return nil
+	}
+
+	if !apiToken.LastUsedAt.Valid || now.Sub(apiToken.LastUsedAt.Time) > apiTokenLastUsedInterval {
+		if err := db.Model(&apiToken).Update("last_used_at", now).Error; err != nil {
+			c.Logger().Warnf("Error updating last_used_at of api token %d: %s", apiToken.ID, err.Error())
+		}
+	}
+
+	return &apiToken
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/obaraelijah/echo-tools/internal/testutil"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// serveTestAPIToken handles a request with the given Authorization header and returns the response
+func serveTestAPIToken(t *testing.T, m *SessionManager, authorization string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderAuthorization, authorization)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if err := m.Middleware()(handler)(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func newTestAPITokenManager(t *testing.T, allowAPITokens bool) (*SessionManager, *gorm.DB, *utilitymodels.LocalUser) {
+	t.Helper()
+
+	db := testutil.OpenTestDB(t)
+	alice := createTestUser(t, db, "alice")
+
+	secure := false
+	m := NewSessionManager(db, &SessionConfig{
+		Secure:         &secure,
+		Store:          NewMemorySessionStore(),
+		AllowAPITokens: allowAPITokens,
+	})
+	m.RegisterAuthProvider(utilitymodels.GetLocalUser(db))
+	return m, db, alice
+}
+
+func createTestAPIToken(t *testing.T, db *gorm.DB, model IdentifiedAuthModel, scopes []string, validity *time.Duration) (string, *utilitymodels.APIToken) {
+	t.Helper()
+
+	token, apiToken, err := CreateAPIToken(db, model, "test", scopes, validity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, apiToken
+}
+
+// assertTestAPIToken checks the status of a request with the token to an endpoint requiring the scope
+func assertTestAPIToken(t *testing.T, m *SessionManager, authorization string, scope string, status int) {
+	t.Helper()
+
+	rec := serveTestAPIToken(t, m, authorization, ScopeRequired(scope, func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}))
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, true)
+	token, _ := createTestAPIToken(t, db, alice, []string{"read"}, nil)
+
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusOK)
+	assertTestAPIToken(t, m, "bearer "+token, "read", http.StatusOK)
+	assertTestAPIToken(t, m, "Bearer "+token, "write", http.StatusForbidden)
+	assertTestAPIToken(t, m, "Bearer et_unknown", "read", http.StatusForbidden)
+	assertTestAPIToken(t, m, token, "read", http.StatusForbidden)
+
+	serveTestAPIToken(t, m, "Bearer "+token, func(c echo.Context) error {
+		sessionContext, _ := GetSessionContext(c)
+		if u, ok := sessionContext.GetUser().(*utilitymodels.LocalUser); !ok || u.ID != alice.ID {
+			t.Fatalf("expected alice to be authenticated, got %v", sessionContext.GetUser())
+		}
+		return nil
+	})
+}
+
+func TestAPITokenNotAllowed(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, false)
+	token, _ := createTestAPIToken(t, db, alice, []string{"read"}, nil)
+
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusForbidden)
+}
+
+func TestAPITokenExpiry(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, true)
+
+	valid, expired := time.Hour, -time.Minute
+	validToken, apiToken := createTestAPIToken(t, db, alice, []string{"read"}, &valid)
+	if !apiToken.ExpiresAt.Valid {
+		t.Fatal("expected the token to expire")
+	}
+	expiredToken, _ := createTestAPIToken(t, db, alice, []string{"read"}, &expired)
+
+	assertTestAPIToken(t, m, "Bearer "+validToken, "read", http.StatusOK)
+	assertTestAPIToken(t, m, "Bearer "+expiredToken, "read", http.StatusForbidden)
+}
+
+func TestAPITokenRevocation(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, true)
+	bob := createTestUser(t, db, "bob")
+	token, apiToken := createTestAPIToken(t, db, alice, []string{"read"}, nil)
+
+	tokens, err := GetAPITokens(db, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != apiToken.ID {
+		t.Fatalf("expected the token of alice, got %v", tokens)
+	}
+
+	// Users can only revoke their own tokens
+	if err := RevokeAPIToken(db, bob, apiToken.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected %v, got %v", ErrAPITokenNotFound, err)
+	}
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusOK)
+
+	if err := RevokeAPIToken(db, alice, apiToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusForbidden)
+	if err := RevokeAPIToken(db, alice, apiToken.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected %v, got %v", ErrAPITokenNotFound, err)
+	}
+}
+
+func TestAPITokenLastUsed(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, true)
+	token, apiToken := createTestAPIToken(t, db, alice, []string{"read"}, nil)
+
+	lastUsedAt := func() sql.NullTime {
+		t.Helper()
+		var stored utilitymodels.APIToken
+		if err := db.First(&stored, apiToken.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored.LastUsedAt
+	}
+	setLastUsedAt := func(lastUsed time.Time) {
+		t.Helper()
+		if err := db.Model(apiToken).Update("last_used_at", lastUsed).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusOK)
+	if !lastUsedAt().Valid {
+		t.Fatal("expected last_used_at to be set")
+	}
+
+	// Within the interval, last_used_at isn't written again
+	recent := time.Now().UTC().Add(-apiTokenLastUsedInterval / 2).Truncate(time.Second)
+	setLastUsedAt(recent)
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusOK)
+	if stored := lastUsedAt(); !stored.Time.Equal(recent) {
+		t.Fatalf("expected last_used_at to stay %v, got %v", recent, stored.Time)
+	}
+
+	old := time.Now().UTC().Add(-2 * apiTokenLastUsedInterval).Truncate(time.Second)
+	setLastUsedAt(old)
+	assertTestAPIToken(t, m, "Bearer "+token, "read", http.StatusOK)
+	if stored := lastUsedAt(); !stored.Time.After(old) {
+		t.Fatalf("expected last_used_at to be updated, got %v", stored.Time)
+	}
+}
+
+func TestInvalidateSessionsRevokesAPITokens(t *testing.T) {
+	m, db, alice := newTestAPITokenManager(t, true)
+	bob := createTestUser(t, db, "bob")
+	aliceToken, _ := createTestAPIToken(t, db, alice, []string{"read"}, nil)
+	bobToken, _ := createTestAPIToken(t, db, bob, []string{"read"}, nil)
+
+	if err := m.InvalidateSessions(alice.ID, utilitymodels.LocalAuthKey); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTestAPIToken(t, m, "Bearer "+aliceToken, "read", http.StatusForbidden)
+	assertTestAPIToken(t, m, "Bearer "+bobToken, "read", http.StatusOK)
+}
@@ -16,6 +16,11 @@ func LoginRequired(f func(echo.Context) error) echo.HandlerFunc {
 			return c.JSON(403, struct{ Error string }{Error: "Unauthenticated"})
 		}
 
+		// Check if the email of the user has to be verified
+		if isEmailVerificationMissing(sessionContext.GetSessionConfig(), sessionContext.GetUser()) {
+			return c.JSON(403, struct{ Error string }{Error: "Email not verified"})
+		}
+
 		return f(c)
 	}
 }
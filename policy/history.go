@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"github.com/obaraelijah/echo-tools/hashing"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"gorm.io/gorm"
+)
+
+// CheckHistory returns a *ViolationError if the password matches the current password of the user or one of the
+// previous passwords within HistorySize. Does nothing if HistorySize is 0.
+func (p *PasswordPolicy) CheckHistory(db *gorm.DB, user *utilitymodels.LocalUser, password string) error {
+	if p.HistorySize <= 0 {
+		return nil
+	}
+
+	hashes := []string{user.Password}
+
+	if p.HistorySize > 1 {
+		var history []utilitymodels.PasswordHistory
+		if err := db.Order("id desc").Limit(p.HistorySize-1).Find(&history, "local_user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		for _, h := range history {
+			hashes = append(hashes, h.Password)
+		}
+	}
+
+	for _, hash := range hashes {
+		// Hashes of unknown formats can't match, so errors are ignored
+		if ok, _, _ := hashing.Verify(hash, password); ok {
+			return &ViolationError{Violations: []Rule{RuleReused}}
+		}
+	}
+
+	return nil
+}
+
+// RecordHistory stores the hash of the password which is about to be replaced and removes entries
+// which are no longer covered by HistorySize. Does nothing if HistorySize is lower than 2, as the
+// current password is always checked.
+func (p *PasswordPolicy) RecordHistory(db *gorm.DB, userID uint, oldHash string) error {
+	if p.HistorySize < 2 {
+		return nil
+	}
+
+	if err := db.Omit("LocalUser").Create(&utilitymodels.PasswordHistory{
+		LocalUserID: userID,
+		Password:    oldHash,
+	}).Error; err != nil {
+		return err
+	}
+
+	var keep []uint
+	if err := db.Model(&utilitymodels.PasswordHistory{}).
+		Where("local_user_id = ?", userID).
+		Order("id desc").
+		Limit(p.HistorySize-1).
+		Pluck("id", &keep).Error; err != nil {
+		return err
+	}
+
+	return db.Where("local_user_id = ? AND id NOT IN ?", userID, keep).Delete(&utilitymodels.PasswordHistory{}).Error
+}
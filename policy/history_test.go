@@ -0,0 +1,127 @@
+package policy
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/obaraelijah/echo-tools/hashing"
+	"github.com/obaraelijah/echo-tools/utilitymodels"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// openTestDB returns a SQLite database with the tables of the password history. testutil.OpenTestDB can't be
+// used, as the database package it migrates with depends on this package.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&utilitymodels.LocalUser{}, &utilitymodels.PasswordHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func hashTestPassword(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := hashing.NewBcryptHasher(bcrypt.MinCost).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// changeTestPassword records the current password in the history and sets the new one, like auth does
+func changeTestPassword(t *testing.T, db *gorm.DB, p *PasswordPolicy, u *utilitymodels.LocalUser, password string) {
+	t.Helper()
+
+	if err := p.RecordHistory(db, u.ID, u.Password); err != nil {
+		t.Fatal(err)
+	}
+	u.Password = hashTestPassword(t, password)
+	if err := db.Save(u).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	db := openTestDB(t)
+	p := &PasswordPolicy{HistorySize: 3}
+
+	u := utilitymodels.LocalUser{Username: "alice", Password: hashTestPassword(t, "first password")}
+	if err := db.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The current password can't be reused
+	assertViolations(t, p.CheckHistory(db, &u, "first password"), RuleReused)
+	assertViolations(t, p.CheckHistory(db, &u, "second password"))
+
+	changeTestPassword(t, db, p, &u, "second password")
+	changeTestPassword(t, db, p, &u, "third password")
+	assertViolations(t, p.CheckHistory(db, &u, "first password"), RuleReused)
+	assertViolations(t, p.CheckHistory(db, &u, "second password"), RuleReused)
+	assertViolations(t, p.CheckHistory(db, &u, "third password"), RuleReused)
+
+	// The oldest password drops out of the history
+	changeTestPassword(t, db, p, &u, "fourth password")
+	assertViolations(t, p.CheckHistory(db, &u, "first password"))
+	assertViolations(t, p.CheckHistory(db, &u, "second password"), RuleReused)
+
+	// Without history, even the current password may be reused
+	assertViolations(t, (&PasswordPolicy{}).CheckHistory(db, &u, "fourth password"))
+}
+
+func TestRecordHistoryPrunes(t *testing.T) {
+	db := openTestDB(t)
+	p := &PasswordPolicy{HistorySize: 3}
+
+	alice := utilitymodels.LocalUser{Username: "alice", Password: hashTestPassword(t, "password 0")}
+	bob := utilitymodels.LocalUser{Username: "bob", Password: hashTestPassword(t, "password 0")}
+	if err := db.Create(&alice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&bob).Error; err != nil {
+		t.Fatal(err)
+	}
+	changeTestPassword(t, db, p, &bob, "password 1")
+
+	var hashes []string
+	for _, password := range []string{"password 1", "password 2", "password 3", "password 4"} {
+		hashes = append(hashes, alice.Password)
+		changeTestPassword(t, db, p, &alice, password)
+	}
+
+	// Only HistorySize-1 entries are kept, the current password is stored in the user
+	var history []utilitymodels.PasswordHistory
+	db.Order("id").Find(&history, "local_user_id = ?", alice.ID)
+	if len(history) != 2 || history[0].Password != hashes[2] || history[1].Password != hashes[3] {
+		t.Fatalf("expected the 2 newest entries to be kept, got %d", len(history))
+	}
+
+	// Entries of other users are kept
+	var count int64
+	db.Model(&utilitymodels.PasswordHistory{}).Where("local_user_id = ?", bob.ID).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected the history of bob to be kept, got %d entries", count)
+	}
+
+	// Nothing is recorded if only the current password is checked
+	if err := (&PasswordPolicy{HistorySize: 1}).RecordHistory(db, bob.ID, bob.Password); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&utilitymodels.PasswordHistory{}).Where("local_user_id = ?", bob.ID).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected nothing to be recorded, got %d entries", count)
+	}
+}
@@ -0,0 +1,273 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrPasswordPolicyViolation = errors.New("password violates the password policy")
+	ErrBreachedListUnavailable = errors.New("breached password list could not be read")
+)
+
+// Rule identifies a rule of the PasswordPolicy
+type Rule string
+
+const (
+	RuleMinLength     Rule = "min_length"
+	RuleMaxLength     Rule = "max_length"
+	RuleUppercase     Rule = "uppercase"
+	RuleLowercase     Rule = "lowercase"
+	RuleDigit         Rule = "digit"
+	RuleSymbol        Rule = "symbol"
+	RuleBreached      Rule = "breached"
+	RuleSimilarToUser Rule = "similar_to_user"
+	RuleReused        Rule = "reused"
+)
+
+// ViolationError is returned if a password violates one or more rules of the PasswordPolicy.
+// errors.Is(err, ErrPasswordPolicyViolation) is true for every ViolationError.
+type ViolationError struct {
+	Violations []Rule
+}
+
+func (e *ViolationError) Error() string {
+	rules := make([]string, 0, len(e.Violations))
+	for _, r := range e.Violations {
+		rules = append(rules, string(r))
+	}
+	return ErrPasswordPolicyViolation.Error() + ": " + strings.Join(rules, ", ")
+}
+
+func (e *ViolationError) Is(target error) bool {
+	return target == ErrPasswordPolicyViolation
+}
+
+// PasswordPolicy Set the rules a new password has to fulfill.
+// Parameter MinLength is the minimum number of characters. 0 disables the check.
+// Parameter MaxLength is the maximum number of characters. 0 disables the check.
+// Parameters RequireUppercase, RequireLowercase, RequireDigit and RequireSymbol require at least one character of
+// the respective class.
+// Parameter BreachedPasswordsFile is the path to a list of breached passwords, one per line. Lines may either contain
+// the plaintext password or its hex encoded SHA-1 hash, optionally followed by ":<count>". The file is read once.
+// Parameter RejectSimilarToUser rejects passwords which contain the username or the local part of the email,
+// are contained in them, or are within a small edit distance.
+// Parameter HistorySize is the number of previous passwords, including the current one, which can't be reused.
+type PasswordPolicy struct {
+	MinLength             int
+	MaxLength             int
+	RequireUppercase      bool
+	RequireLowercase      bool
+	RequireDigit          bool
+	RequireSymbol         bool
+	BreachedPasswordsFile string
+	RejectSimilarToUser   bool
+	HistorySize           int
+
+	breachedOnce sync.Once
+	breached     map[string]struct{}
+	breachedErr  error
+}
+
+var (
+	lock          sync.RWMutex
+	defaultPolicy = &PasswordPolicy{MinLength: 8}
+)
+
+// SetDefaultPolicy sets the policy enforced by database.CreateLocalUser and auth.SetNewPasswordForLocalUser.
+// Defaults to a minimum length of 8. Pass nil to disable the enforcement.
+func SetDefaultPolicy(p *PasswordPolicy) {
+	lock.Lock()
+	defer lock.Unlock()
+	defaultPolicy = p
+}
+
+// GetDefaultPolicy returns the policy set with SetDefaultPolicy. May be nil.
+func GetDefaultPolicy() *PasswordPolicy {
+	lock.RLock()
+	defer lock.RUnlock()
+	return defaultPolicy
+}
+
+// Check validates the password against every rule, which doesn't need the password history.
+// Returns a *ViolationError listing every violated rule.
+func (p *PasswordPolicy) Check(password string, username string, email *string) error {
+	var violations []Rule
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, RuleMinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, RuleMaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUppercase && !upper {
+		violations = append(violations, RuleUppercase)
+	}
+	if p.RequireLowercase && !lower {
+		violations = append(violations, RuleLowercase)
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, RuleDigit)
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, RuleSymbol)
+	}
+
+	if p.BreachedPasswordsFile != "" {
+		breached, err := p.isBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, RuleBreached)
+		}
+	}
+
+	if p.RejectSimilarToUser {
+		identifiers := []string{username}
+		if email != nil {
+			identifiers = append(identifiers, *email)
+			if at := strings.LastIndex(*email, "@"); at > 0 {
+				identifiers = append(identifiers, (*email)[:at])
+			}
+		}
+		for _, identifier := range identifiers {
+			if isSimilar(password, identifier) {
+				violations = append(violations, RuleSimilarToUser)
+				break
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return &ViolationError{Violations: violations}
+	}
+	return nil
+}
+
+func (p *PasswordPolicy) isBreached(password string) (bool, error) {
+	p.breachedOnce.Do(func() {
+		p.breached, p.breachedErr = loadBreachedPasswords(p.BreachedPasswordsFile)
+	})
+	if p.breachedErr != nil {
+		return false, ErrBreachedListUnavailable
+	}
+
+	_, exists := p.breached[sha1Hex(password)]
+	return exists, nil
+}
+
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			breached[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			breached[sha1Hex(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return breached, nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// isSimilar compares case-insensitive and ignores everything but letters and digits
+func isSimilar(password string, identifier string) bool {
+	p := normalize(password)
+	i := normalize(identifier)
+
+	// Too short to compare meaningfully
+	if len(i) < 3 || len(p) == 0 {
+		return false
+	}
+
+	if strings.Contains(p, i) || strings.Contains(i, p) {
+		return true
+	}
+
+	return levenshtein(p, i) <= 2
+}
+
+func normalize(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func levenshtein(a string, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// assertViolations checks that err is a *ViolationError with exactly the given rules, none means no error
+func assertViolations(t *testing.T, err error, rules ...Rule) {
+	t.Helper()
+
+	if len(rules) == 0 {
+		if err != nil {
+			t.Fatalf("expected no violation, got %v", err)
+		}
+		return
+	}
+
+	var violation *ViolationError
+	if !errors.As(err, &violation) || !errors.Is(err, ErrPasswordPolicyViolation) {
+		t.Fatalf("expected a policy violation, got %v", err)
+	}
+	if !reflect.DeepEqual(violation.Violations, rules) {
+		t.Fatalf("expected violations %v, got %v", rules, violation.Violations)
+	}
+}
+
+func TestCheckLength(t *testing.T) {
+	p := &PasswordPolicy{MinLength: 8, MaxLength: 12}
+
+	assertViolations(t, p.Check("short", "alice", nil), RuleMinLength)
+	assertViolations(t, p.Check("exactly8", "alice", nil))
+	assertViolations(t, p.Check("much too long password", "alice", nil), RuleMaxLength)
+
+	// Characters are counted, not bytes
+	assertViolations(t, p.Check("äöüäöüäö", "alice", nil))
+	assertViolations(t, (&PasswordPolicy{}).Check("", "alice", nil))
+}
+
+func TestCheckCharacterClasses(t *testing.T) {
+	p := &PasswordPolicy{RequireUppercase: true, RequireLowercase: true, RequireDigit: true, RequireSymbol: true}
+
+	assertViolations(t, p.Check("", "alice", nil), RuleUppercase, RuleLowercase, RuleDigit, RuleSymbol)
+	assertViolations(t, p.Check("lowercase", "alice", nil), RuleUppercase, RuleDigit, RuleSymbol)
+	assertViolations(t, p.Check("Mixed Case 1", "alice", nil))
+	assertViolations(t, p.Check("Ümlaut-9", "alice", nil))
+	assertViolations(t, p.Check("NoSymbol1", "alice", nil), RuleSymbol)
+}
+
+func TestCheckSimilarToUser(t *testing.T) {
+	p := &PasswordPolicy{RejectSimilarToUser: true}
+	email := "bob.builder@example.org"
+
+	for _, password := range []string{
+		"alice",
+		"Alice-1990",
+		"xalicex",
+		"alcie",
+		"bob.builder@example.org",
+		"BobBuilder!",
+	} {
+		assertViolations(t, p.Check(password, "alice", &email), RuleSimilarToUser)
+	}
+
+	assertViolations(t, p.Check("correct horse battery staple", "alice", &email))
+	// Identifiers which are too short are not compared
+	assertViolations(t, p.Check("al", "al", nil))
+	assertViolations(t, (&PasswordPolicy{}).Check("alice", "alice", nil))
+}
+
+func TestCheckBreached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	// "hunter2" in plaintext and the SHA-1 of "password" with a count
+	content := "hunter2\r\n\n5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:3730471\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := &PasswordPolicy{BreachedPasswordsFile: path}
+
+	assertViolations(t, p.Check("hunter2", "alice", nil), RuleBreached)
+	assertViolations(t, p.Check("password", "alice", nil), RuleBreached)
+	assertViolations(t, p.Check("correct horse battery staple", "alice", nil))
+
+	missing := &PasswordPolicy{BreachedPasswordsFile: filepath.Join(t.TempDir(), "missing.txt")}
+	if err := missing.Check("hunter2", "alice", nil); !errors.Is(err, ErrBreachedListUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrBreachedListUnavailable, err)
+	}
+}
+
+func TestViolationErrorMessage(t *testing.T) {
+	err := &ViolationError{Violations: []Rule{RuleMinLength, RuleDigit}}
+	if err.Error() != "password violates the password policy: min_length, digit" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+}
@@ -0,0 +1,13 @@
+package utilitymodels
+
+// ImpersonationLog is the audit trail of admins impersonating users
+type ImpersonationLog struct {
+	Common
+	Action    string `json:"action" gorm:"not null"` // Either "start" or "stop"
+	ActorKey  string `json:"actor_key" gorm:"not null;index:idx_impersonation_log_actor"`
+	ActorID   uint   `json:"actor_id" gorm:"not null;index:idx_impersonation_log_actor"`
+	TargetKey string `json:"target_key" gorm:"not null;index:idx_impersonation_log_target"`
+	TargetID  uint   `json:"target_id" gorm:"not null;index:idx_impersonation_log_target"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
@@ -0,0 +1,15 @@
+package utilitymodels
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LoginAttempt tracks failed logins per username or per client IP
+type LoginAttempt struct {
+	Common
+	Identifier  string       `json:"-" gorm:"not null;unique"` // Either "username:<name>" or "ip:<address>"
+	Failures    int          `json:"-" gorm:"not null;default:0"`
+	LastFailure time.Time    `json:"-" gorm:"not null"`
+	LockedUntil sql.NullTime `json:"-" gorm:"default:null"`
+}
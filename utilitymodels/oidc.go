@@ -0,0 +1,92 @@
+package utilitymodels
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type OIDCProvider struct {
+	Common
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string `json:"-"`
+	RedirectURL  string
+	Scopes       *string // Space separated, "openid" is always requested
+}
+
+type OIDCUser struct {
+	Common
+	LastLoginAt    sql.NullTime `json:"-" gorm:"default:null"` // This is only relevant if the session middleware is in use
+	OIDCProviderID uint         `gorm:"not null;uniqueIndex:idx_oidc_provider_subject"`
+	OIDCProvider   OIDCProvider
+	Subject        string  `gorm:"not null;uniqueIndex:idx_oidc_provider_subject"`
+	Username       string  `json:"username"`
+	Email          *string `json:"email" gorm:"default:null"`
+}
+
+// OIDCAuthRequest holds state, nonce and PKCE verifier of an authorization request until the callback arrives
+type OIDCAuthRequest struct {
+	Common
+	OIDCProviderID uint      `json:"-" gorm:"not null"`
+	State          string    `json:"-" gorm:"not null;unique"`
+	Nonce          string    `json:"-" gorm:"not null"`
+	CodeVerifier   string    `json:"-" gorm:"not null"`
+	ValidUntil     time.Time `json:"-" gorm:"not null"`
+}
+
+func (user *OIDCUser) GetAuthModelIdentifier() (string, uint) {
+	return OIDCAuthKey, user.ID
+}
+
+func (user *OIDCUser) UpdateLastLogin(c echo.Context, db *gorm.DB, loginTime time.Time) {
+	if err := db.Model(&user).Update("last_login_at", loginTime).Error; err != nil {
+		c.Logger().Warnf("Error updating last_login_at of oidc user %d: %s", user.ID, err.Error())
+	}
+}
+
+// GetID, GetDisplayName, GetProviderKey and GetEmail implement middleware.Principal
+
+func (user *OIDCUser) GetID() uint {
+	return user.ID
+}
+
+// GetDisplayName Returns the username claimed by the identity provider, or the subject if there was none
+func (user *OIDCUser) GetDisplayName() string {
+	if user.Username != "" {
+		return user.Username
+	}
+	return user.Subject
+}
+
+func (user *OIDCUser) GetProviderKey() string {
+	return OIDCAuthKey
+}
+
+// GetEmail Returns the email of the user or an empty string, if the user has none
+func (user *OIDCUser) GetEmail() string {
+	if user.Email == nil {
+		return ""
+	}
+	return *user.Email
+}
+
+func GetOIDCUser(db *gorm.DB) func() (string, func(foreignKey uint) any) {
+	return func() (string, func(foreignKey uint) any) {
+		return OIDCAuthKey, func(foreignKey uint) any {
+			var user OIDCUser
+
+			var count int64
+			db.Find(&user, "ID = ?", foreignKey).Count(&count)
+
+			if count != 1 {
+				return nil
+			}
+
+			return &user
+		}
+	}
+}
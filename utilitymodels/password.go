@@ -0,0 +1,21 @@
+package utilitymodels
+
+import "time"
+
+// PasswordHistory holds a previous password hash of a LocalUser to prevent its reuse
+type PasswordHistory struct {
+	Common
+	LocalUserID uint      `json:"-" gorm:"not null;index"`
+	LocalUser   LocalUser `json:"-"`
+	Password    string    `json:"-" gorm:"not null"`
+}
+
+// PasswordResetToken is a single-use token to set a new password for a LocalUser.
+// Only the SHA-256 hash of the token is stored.
+type PasswordResetToken struct {
+	Common
+	LocalUserID uint      `json:"-" gorm:"not null;index"`
+	LocalUser   LocalUser `json:"-"`
+	TokenHash   string    `json:"-" gorm:"not null;unique"`
+	ValidUntil  time.Time `json:"-" gorm:"not null"`
+}
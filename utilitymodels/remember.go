@@ -0,0 +1,22 @@
+package utilitymodels
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RememberToken is a long-lived login of a device using the selector/validator pattern. The selector identifies the
+// device and stays the same, the validator is replaced on every use. Only the SHA-256 hash of the validator is stored.
+type RememberToken struct {
+	Common
+	AuthID                uint         `json:"-" gorm:"not null;index:idx_remember_token_owner"`
+	AuthKey               string       `json:"-" gorm:"not null;index:idx_remember_token_owner"`
+	Selector              string       `json:"-" gorm:"not null;unique"`
+	ValidatorHash         string       `json:"-" gorm:"not null"`
+	PreviousValidatorHash string       `json:"-"`
+	RotatedAt             sql.NullTime `json:"-" gorm:"default:null"`
+	ExpiresAt             time.Time    `json:"expires_at" gorm:"not null"`
+	IP                    string       `json:"ip"`
+	UserAgent             string       `json:"user_agent"`
+	LastUsedAt            sql.NullTime `json:"last_used_at" gorm:"default:null"`
+}
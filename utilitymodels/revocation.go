@@ -0,0 +1,10 @@
+package utilitymodels
+
+// SessionRevocation holds the revocation counter of a user for stateless sessions.
+// Stateless sessions sealed with a lower revision are invalid.
+type SessionRevocation struct {
+	Common
+	AuthID   uint   `json:"-" gorm:"not null;uniqueIndex:idx_session_revocation_auth"`
+	AuthKey  string `json:"-" gorm:"not null;uniqueIndex:idx_session_revocation_auth"`
+	Revision uint64 `json:"-" gorm:"not null;default:0"`
+}
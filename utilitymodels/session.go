@@ -4,8 +4,25 @@ import "time"
 
 type Session struct {
 	Common
-	AuthID     uint      `json:"auth_id" gorm:"not null"`
-	AuthKey    string    `json:"auth_key" gorm:"not null"`
-	SessionID  string    `json:"-" gorm:"not null;unique"`
-	ValidUntil time.Time `json:"valid_until" gorm:"not null"`
+	AuthID              uint      `json:"auth_id" gorm:"not null"`
+	AuthKey             string    `json:"auth_key" gorm:"not null"`
+	SessionID           string    `json:"-" gorm:"not null;unique"`
+	ValidUntil          time.Time `json:"valid_until" gorm:"not null"`
+	SecondFactorPending bool      `json:"second_factor_pending" gorm:"not null;default:false"`
+	Persistent          bool      `json:"-" gorm:"not null;default:false"` // Cookie was set with MaxAge
+	PublicID            string    `json:"public_id" gorm:"index"`          // Identifies the session towards its user
+	IP                  string    `json:"ip"`                              // IP address of the login
+	UserAgent           string    `json:"user_agent"`                      // User agent of the login
+	LastSeenAt          time.Time `json:"last_seen_at"`
+	DeviceLabel         string    `json:"device_label"`
+	Data                []byte    `json:"-"` // JSON encoded values of the session, see middleware.SessionContext
+	ImpersonatorKey     string    `json:"-"` // Auth key of the admin impersonating the user, empty if not impersonated
+	ImpersonatorID      uint      `json:"-"`
+}
+
+// SessionLock has one row per user, which is locked while a login checks the session limit of the user
+type SessionLock struct {
+	Common
+	AuthID  uint   `json:"-" gorm:"not null;uniqueIndex:idx_session_lock_auth"`
+	AuthKey string `json:"-" gorm:"not null;uniqueIndex:idx_session_lock_auth"`
 }
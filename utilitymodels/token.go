@@ -0,0 +1,34 @@
+package utilitymodels
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// APIToken is a personal access token of a user of any registered auth provider.
+// Only the SHA-256 hash of the token is stored.
+type APIToken struct {
+	Common
+	AuthID     uint         `json:"-" gorm:"not null;index:idx_api_token_owner"`
+	AuthKey    string       `json:"-" gorm:"not null;index:idx_api_token_owner"`
+	Name       string       `json:"name" gorm:"not null"`
+	TokenHash  string       `json:"-" gorm:"not null;unique"`
+	Scopes     string       `json:"-"` // Space separated
+	ExpiresAt  sql.NullTime `json:"-" gorm:"default:null"`
+	LastUsedAt sql.NullTime `json:"-" gorm:"default:null"`
+}
+
+// GetScopes Returns the scopes of the token
+func (t *APIToken) GetScopes() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope Returns true if the token was granted the given scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.GetScopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
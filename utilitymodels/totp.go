@@ -0,0 +1,10 @@
+package utilitymodels
+
+// RecoveryCode is a one-time code which can be used instead of a TOTP code.
+// Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	Common
+	LocalUserID uint      `json:"-" gorm:"not null;index"`
+	LocalUser   LocalUser `json:"-"`
+	CodeHash    string    `json:"-" gorm:"not null"`
+}
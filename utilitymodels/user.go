@@ -8,12 +8,24 @@ import (
 	"gorm.io/gorm"
 )
 
+// Keys of the auth providers of this package. They are returned by GetAuthModelIdentifier and GetProviderKey and
+// the providers are registered with them, e.g. by GetLocalUser.
+const (
+	LocalAuthKey = "local"
+	LDAPAuthKey  = "ldap"
+	OIDCAuthKey  = "oidc"
+)
+
 type LocalUser struct {
 	Common
-	LastLoginAt sql.NullTime `json:"-" gorm:"default:null"` // This is only relevant if the session middleware is in use
-	Email       *string      `json:"email" gorm:"unique;default:null"`
-	Username    string       `json:"username" gorm:"unique;not null"`
-	Password    string       `json:"-" gorm:"not null"`
+	LastLoginAt     sql.NullTime `json:"-" gorm:"default:null"` // This is only relevant if the session middleware is in use
+	Email           *string      `json:"email" gorm:"unique;default:null"`
+	EmailVerified   sql.NullTime `json:"-" gorm:"default:null"` // Set by auth.VerifyEmail, reset by SetEmail
+	Username        string       `json:"username" gorm:"unique;not null"`
+	Password        string       `json:"-" gorm:"not null"`
+	TOTPSecret      *string      `json:"-" gorm:"default:null"`           // Encrypted, see auth.SetTOTPKeys
+	TOTPEnabled     bool         `json:"-" gorm:"not null;default:false"` // Set after the enrollment was confirmed
+	TOTPLastCounter int64        `json:"-" gorm:"not null;default:0"`     // Last accepted time step, prevents replays
 }
 
 type LDAPProvider struct {
@@ -35,19 +47,45 @@ type LDAPUser struct {
 	LDAPProvider   LDAPProvider
 	Username       string
 	DN             string
+	DisplayName    string `gorm:"not null;default:''"` // Updated from the displayName attribute on every login
+	Email          string `gorm:"not null;default:''"` // Updated from the mail attribute on every login
 }
 
 func (user *LDAPUser) GetAuthModelIdentifier() (string, uint) {
-	return "ldap", user.ID
+	return LDAPAuthKey, user.ID
+}
+
+func (user *LDAPUser) UpdateLastLogin(c echo.Context, db *gorm.DB, loginTime time.Time) {
+	if err := db.Model(&user).Update("last_login_at", loginTime).Error; err != nil {
+		c.Logger().Warnf("Error updating last_login_at of ldap user %d: %s", user.ID, err.Error())
+	}
 }
 
-func (user *LDAPUser) UpdateLastLogin(echo.Context, *gorm.DB, time.Time) {
+// GetID, GetDisplayName, GetProviderKey and GetEmail implement middleware.Principal
 
+func (user *LDAPUser) GetID() uint {
+	return user.ID
+}
+
+// GetDisplayName Returns the displayName of the directory entry, or the username if it has none
+func (user *LDAPUser) GetDisplayName() string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	return user.Username
+}
+
+func (user *LDAPUser) GetProviderKey() string {
+	return LDAPAuthKey
+}
+
+func (user *LDAPUser) GetEmail() string {
+	return user.Email
 }
 
 func GetLDAPUser(db *gorm.DB) func() (string, func(foreignKey uint) any) {
 	return func() (string, func(foreignKey uint) any) {
-		return "ldap", func(foreignKey uint) any {
+		return LDAPAuthKey, func(foreignKey uint) any {
 			var user LDAPUser
 
 			var count int64
@@ -63,7 +101,7 @@ func GetLDAPUser(db *gorm.DB) func() (string, func(foreignKey uint) any) {
 }
 
 func (user *LocalUser) GetAuthModelIdentifier() (string, uint) {
-	return "local", user.ID
+	return LocalAuthKey, user.ID
 }
 
 func (user *LocalUser) UpdateLastLogin(c echo.Context, db *gorm.DB, loginTime time.Time) {
@@ -72,9 +110,54 @@ func (user *LocalUser) UpdateLastLogin(c echo.Context, db *gorm.DB, loginTime ti
 	}
 }
 
+// GetID, GetDisplayName, GetProviderKey and GetEmail implement middleware.Principal
+
+func (user *LocalUser) GetID() uint {
+	return user.ID
+}
+
+func (user *LocalUser) GetDisplayName() string {
+	return user.Username
+}
+
+func (user *LocalUser) GetProviderKey() string {
+	return LocalAuthKey
+}
+
+// GetEmail Returns the email of the user or an empty string, if the user has none
+func (user *LocalUser) GetEmail() string {
+	if user.Email == nil {
+		return ""
+	}
+	return *user.Email
+}
+
+// RequiresSecondFactor Returns true if the user has confirmed a TOTP enrollment.
+// middleware.Login will create a session with a pending second factor in that case.
+func (user *LocalUser) RequiresSecondFactor() bool {
+	return user.TOTPEnabled
+}
+
+// IsEmailVerified Returns true if the user has an email which was verified.
+// middleware.Login and middleware.LoginRequired use it if SessionConfig.RequireVerifiedEmail is set.
+func (user *LocalUser) IsEmailVerified() bool {
+	return user.Email != nil && user.EmailVerified.Valid
+}
+
+// SetEmail Sets the email of the user and resets EmailVerified, as the new email wasn't verified.
+// A nil email removes it. Emails must be changed with SetEmail, updating the column directly keeps the verification.
+func (user *LocalUser) SetEmail(db *gorm.DB, email *string) error {
+	if err := db.Model(user).Updates(map[string]any{"email": email, "email_verified": nil}).Error; err != nil {
+		return err
+	}
+	user.Email = email
+	user.EmailVerified = sql.NullTime{}
+	return nil
+}
+
 func GetLocalUser(db *gorm.DB) func() (string, func(foreignKey uint) any) {
 	return func() (string, func(foreignKey uint) any) {
-		return "local", func(foreignKey uint) any {
+		return LocalAuthKey, func(foreignKey uint) any {
 			var user LocalUser
 
 			var count int64
@@ -0,0 +1,33 @@
+package utilitymodels
+
+import (
+	"database/sql"
+	"time"
+)
+
+// WebAuthnCredential is a passkey registered by a LocalUser
+type WebAuthnCredential struct {
+	Common
+	LocalUserID     uint         `json:"-" gorm:"not null;index"`
+	LocalUser       LocalUser    `json:"-"`
+	Name            string       `json:"name"`
+	LastUsedAt      sql.NullTime `json:"-" gorm:"default:null"`
+	CredentialID    []byte       `json:"-" gorm:"not null;uniqueIndex"`
+	PublicKey       []byte       `json:"-" gorm:"not null"`
+	AttestationType string       `json:"-"`
+	Transport       string       `json:"-"` // Comma separated list of transports
+	AAGUID          []byte       `json:"-"`
+	SignCount       uint32       `json:"-" gorm:"not null;default:0"`
+	UserVerified    bool         `json:"-"`
+	BackupEligible  bool         `json:"-"`
+	BackupState     bool         `json:"-"`
+}
+
+// WebAuthnCeremony holds the state of a running registration or login ceremony
+// between its begin and finish request
+type WebAuthnCeremony struct {
+	Common
+	CeremonyID string    `json:"-" gorm:"not null;unique"`
+	Data       string    `json:"-" gorm:"not null"`
+	ValidUntil time.Time `json:"-" gorm:"not null"`
+}